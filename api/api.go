@@ -2,44 +2,49 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/penglongli/gin-metrics/ginmetrics"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
-	"github.com/safwentrabelsi/tezos-delegation-watcher/metrics"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/store"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
 	"github.com/sirupsen/logrus"
 )
 
 type APIServer struct {
-	cfg   *config.ServerConfig
-	store storeInterface
+	cfg          *config.ServerConfig
+	store        storeInterface
+	router       *gin.Engine
+	metricRouter *gin.Engine
 }
 
 var log = logrus.WithField("module", "server")
 
-// Created a specific interface for the server since we only need GetDelegations
+const (
+	// defaultOrphanedLimit and maxOrphanedLimit bound the page size of the orphaned delegations
+	defaultOrphanedLimit = 100
+	maxOrphanedLimit     = 1000
+)
+
+// Created a specific interface for the server since we only need the read operations
 // It makes it easier to mock
 type storeInterface interface {
-	GetDelegations(ctx context.Context, year string) ([]types.Delegation, error)
+	GetDelegations(ctx context.Context, year string, finalOnly bool) ([]types.Delegation, error)
+	GetOrphanedDelegations(ctx context.Context, limit int, cursor string) ([]types.OrphanedDelegation, string, error)
 }
 
 // NewAPIServer creates a new api server instance with the specified config and data store.
+// The request metrics are registered here, the metrics registry must be complete before any goroutine updates it.
 func NewAPIServer(cfg *config.ServerConfig, store storeInterface) *APIServer {
-	return &APIServer{
-		cfg:   cfg,
-		store: store,
-	}
-}
-
-// Run starts Server with the metrics server.
-func (s *APIServer) Run() {
 	router := gin.Default()
 
 	// Setup middlewares
-	router.Use(ValidateYearParam(s.cfg.GetMinValidYear()))
+	router.Use(ValidateYearParam(cfg.GetMinValidYear()))
+	router.Use(ValidateFinalParam())
 
 	metricRouter := gin.New()
 	m := ginmetrics.GetMonitor()
@@ -47,20 +52,27 @@ func (s *APIServer) Run() {
 	m.SetMetricPath("/metrics")
 	m.Expose(metricRouter)
 
+	return &APIServer{
+		cfg:          cfg,
+		store:        store,
+		router:       router,
+		metricRouter: metricRouter,
+	}
+}
+
+// Run starts Server with the metrics server.
+func (s *APIServer) Run() {
 	go func() {
-		if err := metrics.Init(); err != nil {
-			log.Errorf(fmt.Sprintf("Metrics init failed: %s", err))
-		}
 		log.Infof("Metrics server started at url http://%s:%d/metrics", s.cfg.GetHost(), s.cfg.GetMetricsPort())
-		if err := metricRouter.Run(fmt.Sprintf(":%d", s.cfg.GetMetricsPort())); err != nil {
+		if err := s.metricRouter.Run(fmt.Sprintf(":%d", s.cfg.GetMetricsPort())); err != nil {
 			log.Errorf("Metrics server stopped: %v", err)
 		}
-
 	}()
 
-	router.GET("/xtz/delegations", s.handleGetDelegation)
-	router.GET("/liveness", s.handleLiveness)
-	if err := router.Run(s.cfg.GetListenAddress()); err != nil {
+	s.router.GET("/xtz/delegations", s.handleGetDelegation)
+	s.router.GET("/xtz/delegations/orphaned", s.handleGetOrphanedDelegations)
+	s.router.GET("/liveness", s.handleLiveness)
+	if err := s.router.Run(s.cfg.GetListenAddress()); err != nil {
 		log.Fatalf("API server stopped: %v", err)
 	}
 }
@@ -68,7 +80,9 @@ func (s *APIServer) Run() {
 func (s *APIServer) handleGetDelegation(c *gin.Context) {
 
 	year := c.Query("year")
-	delegations, err := s.store.GetDelegations(c.Request.Context(), year)
+	// the parameter is validated by the middleware, a missing one returns the pending delegations too
+	final, _ := strconv.ParseBool(c.Query("final"))
+	delegations, err := s.store.GetDelegations(c.Request.Context(), year, final)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -77,6 +91,32 @@ func (s *APIServer) handleGetDelegation(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"data": delegations})
 }
 
+// handleGetOrphanedDelegations responds with a page of the delegations removed by reorgs, the next page
+// is requested with the returned cursor.
+func (s *APIServer) handleGetOrphanedDelegations(c *gin.Context) {
+	limit := defaultOrphanedLimit
+	if limitStr := c.Query("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l < 1 || l > maxOrphanedLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Limit must be between 1 and %d", maxOrphanedLimit)})
+			return
+		}
+		limit = l
+	}
+
+	delegations, next, err := s.store.GetOrphanedDelegations(c.Request.Context(), limit, c.Query("cursor"))
+	if errors.Is(err, store.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cursor is invalid"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": delegations, "next": next})
+}
+
 // handleLiveness responds with HTTP 200 OK to indicate that the service is live.
 func (s *APIServer) handleLiveness(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/store"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -20,33 +22,67 @@ type MockStore struct {
 	mock.Mock
 }
 
-func (m *MockStore) GetDelegations(ctx context.Context, year string) ([]types.Delegation, error) {
-	args := m.Called(ctx, year)
+func (m *MockStore) GetDelegations(ctx context.Context, year string, finalOnly bool) ([]types.Delegation, error) {
+	args := m.Called(ctx, year, finalOnly)
 	return args.Get(0).([]types.Delegation), args.Error(1)
 }
 
+func (m *MockStore) GetOrphanedDelegations(ctx context.Context, limit int, cursor string) ([]types.OrphanedDelegation, string, error) {
+	args := m.Called(ctx, limit, cursor)
+	return args.Get(0).([]types.OrphanedDelegation), args.String(1), args.Error(2)
+}
+
 func TestHandleGetDelegation_NominalCase(t *testing.T) {
 	router := gin.New()
 	router.Use(gin.Recovery())
-	mockStore := new(MockStore)
-	server := NewAPIServer(&config.ServerConfig{}, mockStore)
+	memoryStore := store.NewMemoryStore()
+	server := NewAPIServer(&config.ServerConfig{}, memoryStore)
 
 	router.GET("/xtz/delegations", server.handleGetDelegation)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/xtz/delegations?year=2024", nil)
 
-	expectedDelegations := []types.Delegation{
-		{Timestamp: "2024-04-21T16:23:27Z", Amount: 100, Delegator: "tz1", Block: 1},
-	}
-	mockStore.On("GetDelegations", mock.Anything, "2024").Return(expectedDelegations, nil)
+	err := memoryStore.SaveDelegations(context.Background(), types.Block{Level: 1, Hash: "BL1"}, []types.FetchedDelegation{
+		{ID: 42, Hash: "oo1", Counter: 7, Timestamp: "2024-04-21T16:23:27Z", Amount: 100, Sender: types.Sender{Address: "tz1"},
+			NewDelegate: &types.Delegate{Address: "tz1baker"}, Status: "applied", BakerFee: 400, GasUsed: 1000, Level: 1},
+		// the delegations of other years are left out
+		{ID: 43, Hash: "oo2", Counter: 8, Timestamp: "2023-12-31T23:59:59Z", Amount: 200, Sender: types.Sender{Address: "tz2"},
+			Status: "applied", Level: 1},
+	})
+	assert.NoError(t, err)
 
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Code)
-	assert.JSONEq(t, `{"data":[{"timestamp":"2024-04-21T16:23:27Z","amount":100,"delegator":"tz1","block":1}]}`, w.Body.String())
-	mockStore.AssertExpectations(t)
+	assert.JSONEq(t, `{"data":[{"operationId":42,"hash":"oo1","counter":7,"timestamp":"2024-04-21T16:23:27Z","amount":100,"delegator":"tz1","newDelegate":"tz1baker","prevDelegate":null,"status":"applied","bakerFee":400,"gasUsed":1000,"block":1,"finality":"pending"}]}`, w.Body.String())
+}
+
+func TestHandleGetDelegation_FinalOnly(t *testing.T) {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	memoryStore := store.NewMemoryStore()
+	server := NewAPIServer(&config.ServerConfig{}, memoryStore)
 
+	router.GET("/xtz/delegations", server.handleGetDelegation)
+
+	ctx := context.Background()
+	for level := uint64(1); level <= 2; level++ {
+		err := memoryStore.SaveDelegations(ctx, types.Block{Level: level, Hash: fmt.Sprintf("BL%d", level)}, []types.FetchedDelegation{
+			{ID: 40 + level, Hash: fmt.Sprintf("oo%d", level), Counter: 7, Timestamp: "2024-04-21T16:23:27Z", Amount: 100,
+				Sender: types.Sender{Address: "tz1"}, Status: "applied", Level: level},
+		})
+		assert.NoError(t, err)
+	}
+	// the delegation of the second block is still pending
+	assert.NoError(t, memoryStore.FinalizeDelegations(ctx, 1))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/xtz/delegations?final=true", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"data":[{"operationId":41,"hash":"oo1","counter":7,"timestamp":"2024-04-21T16:23:27Z","amount":100,"delegator":"tz1","newDelegate":null,"prevDelegate":null,"status":"applied","bakerFee":0,"gasUsed":0,"block":1,"finality":"final"}]}`, w.Body.String())
 }
 
 func TestHandleGetDelegation_DBError(t *testing.T) {
@@ -60,7 +96,114 @@ func TestHandleGetDelegation_DBError(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/xtz/delegations?year=2024", nil)
-	mockStore.On("GetDelegations", mock.Anything, "2024").Return([]types.Delegation{}, errors.New("database error"))
+	mockStore.On("GetDelegations", mock.Anything, "2024", false).Return([]types.Delegation{}, errors.New("database error"))
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"error":"database error"}`, w.Body.String())
+	mockStore.AssertExpectations(t)
+}
+
+func TestHandleGetOrphanedDelegations(t *testing.T) {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	memoryStore := store.NewMemoryStore()
+	server := NewAPIServer(&config.ServerConfig{}, memoryStore)
+
+	router.GET("/xtz/delegations/orphaned", server.handleGetOrphanedDelegations)
+
+	// the delegations of blocks 2 and 3 are orphaned by a reorg, block 2 is then replaced
+	ctx := context.Background()
+	for level := uint64(1); level <= 3; level++ {
+		err := memoryStore.SaveDelegations(ctx, types.Block{Level: level, Hash: fmt.Sprintf("BL%d", level)}, []types.FetchedDelegation{
+			{ID: 40 + level, Hash: fmt.Sprintf("oo%d", level), Counter: 7, Timestamp: "2024-04-21T16:23:27Z", Amount: 100,
+				Sender: types.Sender{Address: "tz1"}, NewDelegate: &types.Delegate{Address: "tz1baker"}, Status: "applied",
+				BakerFee: 400, GasUsed: 1000, Level: level},
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, memoryStore.RollbackToLevel(ctx, 1))
+	assert.NoError(t, memoryStore.SaveDelegations(ctx, types.Block{Level: 2, Hash: "BL2b", Predecessor: "BL1"}, nil))
+
+	type page struct {
+		Data []types.OrphanedDelegation `json:"data"`
+		Next string                     `json:"next"`
+	}
+	get := func(t *testing.T, query string) page {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/xtz/delegations/orphaned"+query, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var p page
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+		return p
+	}
+
+	t.Run("Nominal case", func(t *testing.T) {
+		p := get(t, "")
+
+		assert.Empty(t, p.Next)
+		if assert.Len(t, p.Data, 2) {
+			assert.Equal(t, "oo3", p.Data[0].Hash)
+			assert.Nil(t, p.Data[0].ReplacingBlockHash)
+			orphaned := p.Data[1]
+			assert.Equal(t, "oo2", orphaned.Hash)
+			assert.Equal(t, uint64(42), orphaned.OperationID)
+			assert.Equal(t, "tz1baker", *orphaned.NewDelegate)
+			assert.Equal(t, uint64(2), orphaned.Block)
+			assert.Equal(t, uint64(1), orphaned.ReorgLevel)
+			assert.NotEmpty(t, orphaned.DetectedAt)
+			if assert.NotNil(t, orphaned.ReplacingBlockHash) {
+				assert.Equal(t, "BL2b", *orphaned.ReplacingBlockHash)
+			}
+		}
+	})
+
+	t.Run("Paging", func(t *testing.T) {
+		first := get(t, "?limit=1")
+		if assert.Len(t, first.Data, 1) {
+			assert.Equal(t, "oo3", first.Data[0].Hash)
+		}
+		assert.NotEmpty(t, first.Next)
+
+		second := get(t, "?limit=1&cursor="+first.Next)
+		if assert.Len(t, second.Data, 1) {
+			assert.Equal(t, "oo2", second.Data[0].Hash)
+		}
+	})
+
+	t.Run("Invalid limit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/xtz/delegations/orphaned?limit=5000", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.JSONEq(t, `{"error":"Limit must be between 1 and 1000"}`, w.Body.String())
+	})
+
+	t.Run("Invalid cursor", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/xtz/delegations/orphaned?cursor=bad", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.JSONEq(t, `{"error":"Cursor is invalid"}`, w.Body.String())
+	})
+}
+
+func TestHandleGetOrphanedDelegations_DBError(t *testing.T) {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	mockStore := new(MockStore)
+	server := NewAPIServer(&config.ServerConfig{}, mockStore)
+
+	router.GET("/xtz/delegations/orphaned", server.handleGetOrphanedDelegations)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/xtz/delegations/orphaned", nil)
+	mockStore.On("GetOrphanedDelegations", mock.Anything, 100, "").Return([]types.OrphanedDelegation{}, "", errors.New("database error")).Once()
 
 	router.ServeHTTP(w, req)
 
@@ -101,3 +244,27 @@ func TestValidateYearParam(t *testing.T) {
 	})
 
 }
+
+func TestValidateFinalParam(t *testing.T) {
+	router := gin.New()
+	router.Use(gin.Recovery())
+
+	router.GET("/test", ValidateFinalParam(), func(c *gin.Context) {
+		c.String(http.StatusOK, "OK")
+	})
+
+	t.Run("Nominal case", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/test?final=false", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Test non boolean final", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/test?final=yes", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.JSONEq(t, `{"error":"Final must be a boolean"}`, w.Body.String())
+	})
+}
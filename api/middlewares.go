@@ -30,3 +30,17 @@ func ValidateYearParam(minValidYear int) gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// ValidateFinalParam rejects the requests whose final parameter is not a boolean.
+func ValidateFinalParam() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if final := c.Query("final"); final != "" {
+			if _, err := strconv.ParseBool(final); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Final must be a boolean"})
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
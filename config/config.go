@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
@@ -11,11 +12,14 @@ import (
 
 // Config contains all top-level configuration settings for the application, accessible for reading.
 type Config struct {
-	Server *ServerConfig
-	Log    *LogConfig
-	Tzkt   *TzktConfig
-	DB     *DBConfig
-	Poller *PollerConfig
+	Server   *ServerConfig
+	Log      *LogConfig
+	Tzkt     *TzktConfig
+	DB       *DBConfig
+	Poller   *PollerConfig
+	Node     *NodeConfig
+	Verifier *VerifierConfig
+	Gaps     *GapsConfig
 }
 
 // ServerConfig contains configuration details for the server, with fields unexported for encapsulation.
@@ -33,18 +37,57 @@ type LogConfig struct {
 
 // TzktConfig contains configuration details for interacting with the Tzkt API.
 type TzktConfig struct {
+	timeout             int
+	urls                []string
+	retryAttempts       int
+	subscription        string
+	healthCheckInterval int
+	rateLimit           float64
+	rateBurst           int
+	retryDelay          int
+	maxRetryDelay       int
+	// recording file of the traffic, written in record mode and read in replay mode
+	record      string
+	replay      string
+	replaySpeed float64
+}
+
+// NodeConfig contains configuration details for interacting with the RPC of a Tezos node.
+type NodeConfig struct {
 	timeout       int
 	url           string
 	retryAttempts int
 }
 
+// GapsConfig contains the settings of the job repairing the levels missing below the checkpoint.
+type GapsConfig struct {
+	enabled    bool
+	interval   int
+	startLevel uint64
+	maxLevels  uint64
+}
+
+// VerifierConfig contains the settings of the job comparing the delegations of the poller source with a second source.
+type VerifierConfig struct {
+	enabled  bool
+	interval int
+	levels   uint64
+	lag      uint64
+	tzkt     *TzktConfig
+	node     *NodeConfig
+}
+
 // DBConfig contains database connection settings with sensitive details unexported.
 type DBConfig struct {
+	driver   string
+	path     string
 	user     string
 	dbname   string
 	password string
 	host     string
 	port     int
+	// number of delegations above which a batch is copied in bulk
+	bulkThreshold int
 }
 
 // PollerConfig contains poller settings.
@@ -52,8 +95,73 @@ type PollerConfig struct {
 	startLevel    uint64
 	retryAttempts int
 	fetchOld      bool
+	concurrency   int
+	batchSize     uint64
+	// number of fetched levels saved in a single transaction
+	saveBatchSize uint64
+	maxReorgDepth int
+	source        string
+	// reconnect settings of the head subscription
+	reconnectDelay    int
+	maxReconnectDelay int
+	reconnectForever  bool
+	healthyAfter      int
+	// head silence watchdog settings
+	blockTime         int
+	headSilenceBlocks int
+	// number of blocks on top of a block before its delegations are final
+	finalityDepth uint64
 }
 
+// Subscription modes of the TzKT WebSocket.
+const (
+	// SubscriptionHead receives new heads and fetches their delegations over HTTP.
+	SubscriptionHead = "head"
+	// SubscriptionOperations receives the delegations of new blocks directly from the operations channel.
+	SubscriptionOperations = "operations"
+)
+
+// Sources the delegations can be ingested from.
+const (
+	// SourceTzkt reads the delegations from the TzKT indexer.
+	SourceTzkt = "tzkt"
+	// SourceNode reads the delegations from the RPC of a Tezos node.
+	SourceNode = "node"
+)
+
+// Database drivers of the store.
+const (
+	// DriverPostgres stores the delegations in a PostgreSQL server.
+	DriverPostgres = "postgres"
+	// DriverSQLite stores the delegations in a SQLite file.
+	DriverSQLite = "sqlite"
+)
+
+const (
+	defaultTzktHealthCheckInterval = 30
+	defaultTzktRateLimit           = 10
+	defaultTzktRetryDelay          = 500
+	defaultTzktMaxRetryDelay       = 30000
+	defaultTzktReplaySpeed         = 1
+	defaultPollerConcurrency       = 4
+	defaultPollerBatchSize         = 10000
+	defaultPollerSaveBatchSize     = 100
+	defaultPollerMaxReorgDepth     = 64
+	defaultPollerReconnectDelay    = 1000
+	defaultPollerMaxReconnectDelay = 60000
+	defaultPollerHealthyAfter      = 300
+	defaultPollerBlockTime         = 8
+	defaultPollerHeadSilenceBlocks = 5
+	defaultPollerFinalityDepth     = 2
+	defaultVerifierInterval        = 600
+	defaultVerifierLevels          = 1000
+	defaultVerifierLag             = 10
+	defaultGapsInterval            = 3600
+	defaultGapsMaxLevels           = 1000
+	defaultDBBulkThreshold         = 500
+	defaultDBPath                  = "delegations.db"
+)
+
 var (
 	cfg     *Config
 	once    sync.Once
@@ -68,26 +176,26 @@ func LoadConfig(configFile string) (*Config, error) {
 
 		absPath, err := filepath.Abs(configFile)
 		if err != nil {
-			loadErr = fmt.Errorf("Error finding absolute path for the configuration file: %v", err)
+			loadErr = fmt.Errorf("Error finding absolute path for the configuration file: %w", err)
 			return
 		}
 
 		yamlFile, err := os.ReadFile(absPath)
 		if err != nil {
-			loadErr = fmt.Errorf("Error reading YAML file: %v", err)
+			loadErr = fmt.Errorf("Error reading YAML file: %w", err)
 			return
 		}
 
 		configYAML := configYAML{}
 		err = yaml.Unmarshal(yamlFile, &configYAML)
 		if err != nil {
-			loadErr = fmt.Errorf("Error parsing YAML file: %v", err)
+			loadErr = fmt.Errorf("Error parsing YAML file: %w", err)
 			return
 		}
 
 		// Perform validation
 		if err := validate.Struct(configYAML); err != nil {
-			loadErr = fmt.Errorf("validation error: %v", err)
+			loadErr = fmt.Errorf("validation error: %w", err)
 			return
 		}
 		cfg.Server = &ServerConfig{
@@ -99,28 +207,200 @@ func LoadConfig(configFile string) (*Config, error) {
 		cfg.Log = &LogConfig{
 			level: configYAML.Log.Level,
 		}
-		cfg.Tzkt = &TzktConfig{
-			timeout:       configYAML.Tzkt.Timeout,
-			url:           configYAML.Tzkt.URL,
-			retryAttempts: configYAML.Tzkt.RetryAttempts,
-		}
+		cfg.Tzkt = newTzktConfig(configYAML.Tzkt)
 		cfg.DB = &DBConfig{
+			driver:   configYAML.DB.Driver,
+			path:     configYAML.DB.Path,
 			user:     configYAML.DB.User,
 			dbname:   configYAML.DB.DBName,
 			password: configYAML.DB.Password,
 			host:     configYAML.DB.Host,
 			port:     configYAML.DB.Port,
+
+			bulkThreshold: configYAML.DB.BulkThreshold,
+		}
+		if cfg.DB.driver == "" {
+			cfg.DB.driver = DriverPostgres
+		}
+		if cfg.DB.path == "" {
+			cfg.DB.path = defaultDBPath
+		}
+		if cfg.DB.bulkThreshold == 0 {
+			cfg.DB.bulkThreshold = defaultDBBulkThreshold
 		}
 		cfg.Poller = &PollerConfig{
 			startLevel:    configYAML.Poller.StartLevel,
 			retryAttempts: configYAML.Poller.RetryAttempts,
 			fetchOld:      configYAML.Poller.FetchOld,
+			concurrency:   configYAML.Poller.Concurrency,
+			batchSize:     configYAML.Poller.BatchSize,
+			saveBatchSize: configYAML.Poller.SaveBatchSize,
+			maxReorgDepth: configYAML.Poller.MaxReorgDepth,
+			source:        configYAML.Poller.Source,
+
+			reconnectDelay:    configYAML.Poller.ReconnectDelay,
+			maxReconnectDelay: configYAML.Poller.MaxReconnectDelay,
+			reconnectForever:  configYAML.Poller.ReconnectForever,
+			healthyAfter:      configYAML.Poller.HealthyAfter,
+			blockTime:         configYAML.Poller.BlockTime,
+			headSilenceBlocks: configYAML.Poller.HeadSilenceBlocks,
+			finalityDepth:     defaultPollerFinalityDepth,
+		}
+		if cfg.Poller.reconnectDelay == 0 {
+			cfg.Poller.reconnectDelay = defaultPollerReconnectDelay
+		}
+		if cfg.Poller.maxReconnectDelay == 0 {
+			cfg.Poller.maxReconnectDelay = max(defaultPollerMaxReconnectDelay, cfg.Poller.reconnectDelay)
+		}
+		if cfg.Poller.healthyAfter == 0 {
+			cfg.Poller.healthyAfter = defaultPollerHealthyAfter
+		}
+		if cfg.Poller.blockTime == 0 {
+			cfg.Poller.blockTime = defaultPollerBlockTime
+		}
+		if cfg.Poller.headSilenceBlocks == 0 {
+			cfg.Poller.headSilenceBlocks = defaultPollerHeadSilenceBlocks
+		}
+		// 0 is a valid depth, the delegations are final as soon as they are stored
+		if configYAML.Poller.FinalityDepth != nil {
+			cfg.Poller.finalityDepth = *configYAML.Poller.FinalityDepth
+		}
+		if cfg.Poller.concurrency == 0 {
+			cfg.Poller.concurrency = defaultPollerConcurrency
+		}
+		if cfg.Poller.batchSize == 0 {
+			cfg.Poller.batchSize = defaultPollerBatchSize
+		}
+		if cfg.Poller.saveBatchSize == 0 {
+			cfg.Poller.saveBatchSize = defaultPollerSaveBatchSize
+		}
+		if cfg.Poller.maxReorgDepth == 0 {
+			cfg.Poller.maxReorgDepth = defaultPollerMaxReorgDepth
+		}
+		if cfg.Poller.source == "" {
+			cfg.Poller.source = SourceTzkt
+		}
+		if configYAML.Node != nil {
+			cfg.Node = newNodeConfig(configYAML.Node)
+		}
+		if cfg.Poller.source == SourceNode && cfg.Node == nil {
+			loadErr = fmt.Errorf("validation error: node configuration is required when the poller source is %s", SourceNode)
+			return
+		}
+		cfg.Verifier = &VerifierConfig{}
+		if configYAML.Verifier != nil {
+			cfg.Verifier = &VerifierConfig{
+				enabled:  configYAML.Verifier.Enabled,
+				interval: configYAML.Verifier.Interval,
+				levels:   configYAML.Verifier.Levels,
+				lag:      configYAML.Verifier.Lag,
+			}
+			if configYAML.Verifier.Tzkt != nil {
+				cfg.Verifier.tzkt = newTzktConfig(configYAML.Verifier.Tzkt)
+			}
+			if configYAML.Verifier.Node != nil {
+				cfg.Verifier.node = newNodeConfig(configYAML.Verifier.Node)
+			}
+		}
+		if cfg.Verifier.interval == 0 {
+			cfg.Verifier.interval = defaultVerifierInterval
+		}
+		if cfg.Verifier.levels == 0 {
+			cfg.Verifier.levels = defaultVerifierLevels
+		}
+		if cfg.Verifier.lag == 0 {
+			cfg.Verifier.lag = defaultVerifierLag
+		}
+		if cfg.Verifier.enabled && cfg.Verifier.tzkt == nil && cfg.Verifier.node == nil {
+			loadErr = fmt.Errorf("validation error: a tzkt or node source is required when the verifier is enabled")
+			return
+		}
+		cfg.Gaps = &GapsConfig{}
+		if configYAML.Gaps != nil {
+			cfg.Gaps = &GapsConfig{
+				enabled:    configYAML.Gaps.Enabled,
+				interval:   configYAML.Gaps.Interval,
+				startLevel: configYAML.Gaps.StartLevel,
+				maxLevels:  configYAML.Gaps.MaxLevels,
+			}
+		}
+		if cfg.Gaps.interval == 0 {
+			cfg.Gaps.interval = defaultGapsInterval
+		}
+		if cfg.Gaps.startLevel == 0 {
+			cfg.Gaps.startLevel = cfg.Poller.startLevel
+		}
+		if cfg.Gaps.maxLevels == 0 {
+			cfg.Gaps.maxLevels = defaultGapsMaxLevels
 		}
 	})
 
 	return cfg, loadErr
 }
 
+// newTzktConfig creates a TzktConfig from its YAML settings, applying the defaults.
+func newTzktConfig(tzkt *tzktConfigYAML) *TzktConfig {
+	t := &TzktConfig{
+		timeout:             tzkt.Timeout,
+		urls:                tzktURLs(tzkt),
+		retryAttempts:       tzkt.RetryAttempts,
+		subscription:        tzkt.Subscription,
+		healthCheckInterval: tzkt.HealthCheckInterval,
+		rateLimit:           tzkt.RateLimit,
+		rateBurst:           tzkt.RateBurst,
+		retryDelay:          tzkt.RetryDelay,
+		maxRetryDelay:       tzkt.MaxRetryDelay,
+		record:              tzkt.Record,
+		replay:              tzkt.Replay,
+		replaySpeed:         tzkt.ReplaySpeed,
+	}
+	if t.healthCheckInterval == 0 {
+		t.healthCheckInterval = defaultTzktHealthCheckInterval
+	}
+	if t.rateLimit == 0 {
+		t.rateLimit = defaultTzktRateLimit
+	}
+	if t.rateBurst == 0 {
+		t.rateBurst = int(math.Ceil(t.rateLimit))
+	}
+	if t.retryDelay == 0 {
+		t.retryDelay = defaultTzktRetryDelay
+	}
+	if t.replaySpeed == 0 {
+		t.replaySpeed = defaultTzktReplaySpeed
+	}
+	if t.maxRetryDelay == 0 {
+		t.maxRetryDelay = max(defaultTzktMaxRetryDelay, t.retryDelay)
+	}
+	if t.subscription == "" {
+		t.subscription = SubscriptionHead
+	}
+	return t
+}
+
+// newNodeConfig creates a NodeConfig from its YAML settings.
+func newNodeConfig(node *nodeConfigYAML) *NodeConfig {
+	return &NodeConfig{
+		timeout:       node.Timeout,
+		url:           node.URL,
+		retryAttempts: node.RetryAttempts,
+	}
+}
+
+// tzktURLs merges the url and urls settings, the url is preferred and duplicates are removed.
+func tzktURLs(tzkt *tzktConfigYAML) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, url := range append([]string{tzkt.URL}, tzkt.URLs...) {
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		urls = append(urls, url)
+	}
+	return urls
+}
+
 // GetHost returns the host configuration from the ServerConfig.
 func (s *ServerConfig) GetHost() string {
 	return s.host
@@ -151,9 +431,19 @@ func (t *TzktConfig) GetTimeout() int {
 	return t.timeout
 }
 
-// GetURL returns the url configuration from the TzktConfig.
+// GetURL returns the preferred url from the TzktConfig.
 func (t *TzktConfig) GetURL() string {
-	return t.url
+	return t.urls[0]
+}
+
+// GetURLs returns all the endpoint urls from the TzktConfig, in order of preference.
+func (t *TzktConfig) GetURLs() []string {
+	return t.urls
+}
+
+// GetHealthCheckInterval returns the interval in seconds between two endpoint health checks from the TzktConfig.
+func (t *TzktConfig) GetHealthCheckInterval() int {
+	return t.healthCheckInterval
 }
 
 // GetRetryAttempts returns the maximum retry attempts from the TzktConfig.
@@ -161,6 +451,46 @@ func (t *TzktConfig) GetRetryAttempts() int {
 	return t.retryAttempts
 }
 
+// GetSubscription returns the WebSocket subscription mode from the TzktConfig.
+func (t *TzktConfig) GetSubscription() string {
+	return t.subscription
+}
+
+// GetRateLimit returns the maximum number of requests per second sent to TzKT from the TzktConfig.
+func (t *TzktConfig) GetRateLimit() float64 {
+	return t.rateLimit
+}
+
+// GetRateBurst returns the number of requests that can be sent at once above the rate limit from the TzktConfig.
+func (t *TzktConfig) GetRateBurst() int {
+	return t.rateBurst
+}
+
+// GetRetryDelay returns the delay in milliseconds before the first retry of a failed request from the TzktConfig.
+func (t *TzktConfig) GetRetryDelay() int {
+	return t.retryDelay
+}
+
+// GetMaxRetryDelay returns the maximum delay in milliseconds between two retries from the TzktConfig.
+func (t *TzktConfig) GetMaxRetryDelay() int {
+	return t.maxRetryDelay
+}
+
+// GetRecord returns the file the TzKT traffic is recorded to from the TzktConfig, empty when not recording.
+func (t *TzktConfig) GetRecord() string {
+	return t.record
+}
+
+// GetReplay returns the recording the TzKT traffic is replayed from from the TzktConfig, empty when not replaying.
+func (t *TzktConfig) GetReplay() string {
+	return t.replay
+}
+
+// GetReplaySpeed returns the factor the recorded timing of the ws messages is accelerated by from the TzktConfig.
+func (t *TzktConfig) GetReplaySpeed() float64 {
+	return t.replaySpeed
+}
+
 // GetStartLevel returns the start level configuration from the pollerConfig.
 func (p *PollerConfig) GetStartLevel() uint64 {
 	return p.startLevel
@@ -176,6 +506,137 @@ func (p *PollerConfig) GetFetchOld() bool {
 	return p.fetchOld
 }
 
+// GetConcurrency returns the number of level ranges fetched in parallel from the pollerConfig.
+func (p *PollerConfig) GetConcurrency() int {
+	return p.concurrency
+}
+
+// GetBatchSize returns the number of levels fetched by a single backfill worker from the pollerConfig.
+func (p *PollerConfig) GetBatchSize() uint64 {
+	return p.batchSize
+}
+
+// GetSaveBatchSize returns the maximum number of fetched levels the processor saves in a single transaction from the pollerConfig.
+func (p *PollerConfig) GetSaveBatchSize() uint64 {
+	return p.saveBatchSize
+}
+
+// GetMaxReorgDepth returns the number of levels checked for a common ancestor when a reorg is detected from the pollerConfig.
+func (p *PollerConfig) GetMaxReorgDepth() int {
+	return p.maxReorgDepth
+}
+
+// GetSource returns the source the delegations are ingested from from the pollerConfig.
+func (p *PollerConfig) GetSource() string {
+	return p.source
+}
+
+// GetReconnectDelay returns the delay in milliseconds before the first reconnection from the pollerConfig.
+func (p *PollerConfig) GetReconnectDelay() int {
+	return p.reconnectDelay
+}
+
+// GetMaxReconnectDelay returns the maximum delay in milliseconds between two reconnections from the pollerConfig.
+func (p *PollerConfig) GetMaxReconnectDelay() int {
+	return p.maxReconnectDelay
+}
+
+// GetReconnectForever returns whether the poller reconnects without limit of attempts from the pollerConfig.
+func (p *PollerConfig) GetReconnectForever() bool {
+	return p.reconnectForever
+}
+
+// GetHeadSilenceTimeout returns the number of seconds without new head after which the subscription is restarted
+// from the pollerConfig. It is the expected time for headSilenceBlocks blocks.
+func (p *PollerConfig) GetHeadSilenceTimeout() int {
+	return p.blockTime * p.headSilenceBlocks
+}
+
+// GetFinalityDepth returns the number of blocks baked on top of a block before its delegations are final from the pollerConfig.
+func (p *PollerConfig) GetFinalityDepth() uint64 {
+	return p.finalityDepth
+}
+
+// GetHealthyAfter returns the number of seconds after which a connection is healthy and the reconnection attempts are reset from the pollerConfig.
+func (p *PollerConfig) GetHealthyAfter() int {
+	return p.healthyAfter
+}
+
+// GetTimeout returns the timeout configuration from the NodeConfig.
+func (n *NodeConfig) GetTimeout() int {
+	return n.timeout
+}
+
+// GetURL returns the url configuration from the NodeConfig.
+func (n *NodeConfig) GetURL() string {
+	return n.url
+}
+
+// GetRetryAttempts returns the maximum retry attempts from the NodeConfig.
+func (n *NodeConfig) GetRetryAttempts() int {
+	return n.retryAttempts
+}
+
+// GetEnabled returns whether the verifier runs in the background from the VerifierConfig.
+func (v *VerifierConfig) GetEnabled() bool {
+	return v.enabled
+}
+
+// GetInterval returns the number of seconds between two verifications from the VerifierConfig.
+func (v *VerifierConfig) GetInterval() int {
+	return v.interval
+}
+
+// GetLevels returns the maximum number of levels compared at once from the VerifierConfig.
+func (v *VerifierConfig) GetLevels() uint64 {
+	return v.levels
+}
+
+// GetLag returns the number of levels below the checkpoint that are not verified yet from the VerifierConfig.
+func (v *VerifierConfig) GetLag() uint64 {
+	return v.lag
+}
+
+// GetTzkt returns the TzKT instance compared with the poller source, nil if the verifier uses a node.
+func (v *VerifierConfig) GetTzkt() *TzktConfig {
+	return v.tzkt
+}
+
+// GetNode returns the Tezos node compared with the poller source, nil if the verifier uses a TzKT instance.
+func (v *VerifierConfig) GetNode() *NodeConfig {
+	return v.node
+}
+
+// GetEnabled returns whether the gaps are repaired in the background from the GapsConfig.
+func (g *GapsConfig) GetEnabled() bool {
+	return g.enabled
+}
+
+// GetInterval returns the number of seconds between two gap scans from the GapsConfig.
+func (g *GapsConfig) GetInterval() int {
+	return g.interval
+}
+
+// GetStartLevel returns the first level expected to be processed from the GapsConfig.
+func (g *GapsConfig) GetStartLevel() uint64 {
+	return g.startLevel
+}
+
+// GetMaxLevels returns the maximum number of levels repaired by a scan from the GapsConfig.
+func (g *GapsConfig) GetMaxLevels() uint64 {
+	return g.maxLevels
+}
+
+// GetDriver returns the database driver, postgres or sqlite, from the DBConfig.
+func (d *DBConfig) GetDriver() string {
+	return d.driver
+}
+
+// GetPath returns the file of the sqlite database from the DBConfig.
+func (d *DBConfig) GetPath() string {
+	return d.path
+}
+
 // GetUser returns the user configuration from the DBConfig.
 func (d *DBConfig) GetUser() string {
 	return d.user
@@ -201,6 +662,11 @@ func (d *DBConfig) GetPort() int {
 	return d.port
 }
 
+// GetBulkThreshold returns the number of delegations above which a batch is saved with COPY from the DBConfig.
+func (d *DBConfig) GetBulkThreshold() int {
+	return d.bulkThreshold
+}
+
 // GetPostgresqlDSN constructs a PostgreSQL DSN from the DBConfig.
 func (d *DBConfig) GetPostgresqlDSN() string {
 	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable", d.user, d.password, d.host, d.port, d.dbname)
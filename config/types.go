@@ -4,11 +4,14 @@ import "github.com/go-playground/validator/v10"
 
 // ConfigYAML is a transitional struct that contains all the configuration settings, mirroring the structure of the Config struct.
 type configYAML struct {
-	Server *serverConfigYAML `yaml:"server"`
-	Log    *logConfigYAML    `yaml:"log"`
-	Tzkt   *tzktConfigYAML   `yaml:"tzkt"`
-	DB     *dbConfigYAML     `yaml:"db"`
-	Poller *pollerConfigYAML `yaml:"poller"`
+	Server   *serverConfigYAML   `yaml:"server"`
+	Log      *logConfigYAML      `yaml:"log"`
+	Tzkt     *tzktConfigYAML     `yaml:"tzkt"`
+	DB       *dbConfigYAML       `yaml:"db"`
+	Poller   *pollerConfigYAML   `yaml:"poller"`
+	Node     *nodeConfigYAML     `yaml:"node"`
+	Verifier *verifierConfigYAML `yaml:"verifier"`
+	Gaps     *gapsConfigYAML     `yaml:"gaps"`
 }
 
 // dbConfigYAML is a transitional struct used for unmarshaling the database configuration from YAML.
@@ -21,17 +24,40 @@ type serverConfigYAML struct {
 }
 
 type tzktConfigYAML struct {
+	Timeout             int      `yaml:"timeout" validate:"required,gte=0"`
+	URL                 string   `yaml:"url" validate:"required_without=URLs,omitempty,url"`
+	URLs                []string `yaml:"urls" validate:"omitempty,dive,url"`
+	RetryAttempts       int      `yaml:"retryAttempts" validate:"required,gte=0"`
+	Subscription        string   `yaml:"subscription" validate:"omitempty,oneof=head operations"`
+	HealthCheckInterval int      `yaml:"healthCheckInterval" validate:"gte=0"`
+	RateLimit           float64  `yaml:"rateLimit" validate:"gte=0"`
+	RateBurst           int      `yaml:"rateBurst" validate:"gte=0"`
+	RetryDelay          int      `yaml:"retryDelay" validate:"gte=0"`
+	MaxRetryDelay       int      `yaml:"maxRetryDelay" validate:"gte=0"`
+	Record              string   `yaml:"record" validate:"excluded_with=Replay"`
+	Replay              string   `yaml:"replay"`
+	ReplaySpeed         float64  `yaml:"replaySpeed" validate:"gte=0"`
+}
+
+// nodeConfigYAML is a transitional struct used for unmarshaling the Tezos node configuration from YAML.
+type nodeConfigYAML struct {
 	Timeout       int    `yaml:"timeout" validate:"required,gte=0"`
 	URL           string `yaml:"url" validate:"required,url"`
 	RetryAttempts int    `yaml:"retryAttempts" validate:"required,gte=0"`
 }
 
 type dbConfigYAML struct {
-	User     string `yaml:"user" validate:"required"`
-	DBName   string `yaml:"dbname" validate:"required"`
-	Password string `yaml:"password" validate:"required"`
-	Host     string `yaml:"host" validate:"required"`
-	Port     int    `yaml:"port" validate:"required,gte=1024,lte=49151"`
+	Driver string `yaml:"driver" validate:"omitempty,oneof=postgres sqlite"`
+	Path   string `yaml:"path"`
+
+	// the connection settings are only required by postgres
+	User     string `yaml:"user" validate:"required_unless=Driver sqlite"`
+	DBName   string `yaml:"dbname" validate:"required_unless=Driver sqlite"`
+	Password string `yaml:"password" validate:"required_unless=Driver sqlite"`
+	Host     string `yaml:"host" validate:"required_unless=Driver sqlite"`
+	Port     int    `yaml:"port" validate:"required_unless=Driver sqlite,omitempty,gte=1024,lte=49151"`
+
+	BulkThreshold int `yaml:"bulkThreshold" validate:"gte=0"`
 }
 
 // logConfigYAML is a transitional struct used for unmarshaling the log configuration from YAML.
@@ -44,6 +70,37 @@ type pollerConfigYAML struct {
 	StartLevel    uint64 `yaml:"startLevel" validate:"required"`
 	RetryAttempts int    `yaml:"retryAttempts" validate:"required,gte=0"`
 	FetchOld      bool   `yaml:"fetchOld"`
+	Concurrency   int    `yaml:"concurrency" validate:"gte=0"`
+	BatchSize     uint64 `yaml:"batchSize" validate:"gte=0"`
+	SaveBatchSize uint64 `yaml:"saveBatchSize" validate:"gte=0"`
+	MaxReorgDepth int    `yaml:"maxReorgDepth" validate:"gte=0"`
+	Source        string `yaml:"source" validate:"omitempty,oneof=tzkt node"`
+
+	ReconnectDelay    int     `yaml:"reconnectDelay" validate:"gte=0"`
+	MaxReconnectDelay int     `yaml:"maxReconnectDelay" validate:"gte=0"`
+	ReconnectForever  bool    `yaml:"reconnectForever"`
+	HealthyAfter      int     `yaml:"healthyAfter" validate:"gte=0"`
+	BlockTime         int     `yaml:"blockTime" validate:"gte=0"`
+	HeadSilenceBlocks int     `yaml:"headSilenceBlocks" validate:"gte=0"`
+	FinalityDepth     *uint64 `yaml:"finalityDepth" validate:"omitempty,gte=0"`
+}
+
+// verifierConfigYAML is a transitional struct used for unmarshaling the verifier configuration from YAML.
+type verifierConfigYAML struct {
+	Enabled  bool            `yaml:"enabled"`
+	Interval int             `yaml:"interval" validate:"gte=0"`
+	Levels   uint64          `yaml:"levels" validate:"gte=0"`
+	Lag      uint64          `yaml:"lag" validate:"gte=0"`
+	Tzkt     *tzktConfigYAML `yaml:"tzkt" validate:"excluded_with=Node"`
+	Node     *nodeConfigYAML `yaml:"node"`
+}
+
+// gapsConfigYAML is a transitional struct used for unmarshaling the gap repair configuration from YAML.
+type gapsConfigYAML struct {
+	Enabled    bool   `yaml:"enabled"`
+	Interval   int    `yaml:"interval" validate:"gte=0"`
+	StartLevel uint64 `yaml:"startLevel" validate:"gte=0"`
+	MaxLevels  uint64 `yaml:"maxLevels" validate:"gte=0"`
 }
 
 var validate *validator.Validate
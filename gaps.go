@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/gaps"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// runGaps finds the levels missing in the store once, prints them as JSON and fetches them again from the
+// poller source unless -dry-run is set. It returns the exit code: 1 on failure and 2 when gaps remain in dry-run mode.
+func runGaps(cfg *config.Config, s store.Storer, args []string) int {
+	flags := flag.NewFlagSet("gaps", flag.ContinueOnError)
+	from := flags.Uint64("from", 0, "first level to scan, defaults to gaps.startLevel")
+	to := flags.Uint64("to", 0, "last level to scan, defaults to the checkpoint")
+	dryRun := flags.Bool("dry-run", false, "only report the missing levels")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	source, _ := newPollerSource(ctx, cfg)
+	scanner := gaps.NewScanner(source, s, cfg.Gaps)
+	missing, err := scanner.Scan(ctx, *from, *to)
+	if err != nil {
+		log.Errorf("Gap scan failed: %v", err)
+		return 1
+	}
+	for _, gap := range missing {
+		out, _ := json.Marshal(gap)
+		fmt.Println(string(out))
+	}
+	if len(missing) == 0 {
+		return 0
+	}
+	if *dryRun {
+		return 2
+	}
+
+	if _, err := scanner.Repair(ctx, missing); err != nil {
+		log.Errorf("Gap repair failed: %v", err)
+		return 1
+	}
+	return 0
+}
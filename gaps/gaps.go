@@ -0,0 +1,159 @@
+package gaps
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/metrics"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/sirupsen/logrus"
+)
+
+type sourceInterface interface {
+	GetDelegationsByLevel(ctx context.Context, level uint64, dataChan chan<- *types.ChanMsg) error
+}
+
+type storeInterface interface {
+	GetCheckpoint(ctx context.Context) (types.Checkpoint, error)
+	GetGaps(ctx context.Context, fromLevel, toLevel uint64) ([]types.LevelRange, error)
+	RepairLevel(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) (bool, error)
+}
+
+type configInterface interface {
+	GetInterval() int
+	GetStartLevel() uint64
+	GetMaxLevels() uint64
+}
+
+type scanner struct {
+	source sourceInterface
+	store  storeInterface
+	cfg    configInterface
+}
+
+var log = logrus.WithField("module", "gaps")
+
+// NewScanner creates a scanner finding the levels missing below the checkpoint and fetching them again from the source.
+func NewScanner(source sourceInterface, store storeInterface, cfg configInterface) *scanner {
+	return &scanner{
+		source: source,
+		store:  store,
+		cfg:    cfg,
+	}
+}
+
+// Run scans and repairs the gaps at each interval until the context is done.
+// Errors are logged and the remaining gaps are repaired at the next run.
+func (s *scanner) Run(ctx context.Context) {
+	log.Info("Starting the gap scanner")
+
+	ticker := time.NewTicker(time.Duration(s.cfg.GetInterval()) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			gaps, err := s.Scan(ctx, 0, 0)
+			if err == nil && len(gaps) > 0 {
+				_, err = s.Repair(ctx, gaps)
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Errorf("Gap repair failed: %v", err)
+			}
+		case <-ctx.Done():
+			log.Info("Gap scanner shutdown initiated, stopping operations")
+			return
+		}
+	}
+}
+
+// Scan returns the ranges of levels missing between fromLevel and toLevel. A zero fromLevel stands for the
+// configured start level and a zero toLevel for the checkpoint, the levels above it are not processed yet.
+func (s *scanner) Scan(ctx context.Context, fromLevel, toLevel uint64) ([]types.LevelRange, error) {
+	if fromLevel == 0 {
+		fromLevel = s.cfg.GetStartLevel()
+	}
+	if toLevel == 0 {
+		checkpoint, err := s.store.GetCheckpoint(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to get checkpoint: %w", types.ErrStorage, err)
+		}
+		toLevel = checkpoint.Level
+	}
+	if fromLevel > toLevel {
+		return nil, nil
+	}
+
+	gaps, err := s.store.GetGaps(ctx, fromLevel, toLevel)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to get gaps: %w", types.ErrStorage, err)
+	}
+
+	var missing uint64
+	for _, gap := range gaps {
+		missing += gap.Len()
+	}
+	if missing > 0 {
+		log.Warnf("Found %d missing levels in %d gaps between levels %d and %d", missing, len(gaps), fromLevel, toLevel)
+	} else {
+		log.Debugf("No missing level between levels %d and %d", fromLevel, toLevel)
+	}
+	return gaps, nil
+}
+
+// Repair fetches the levels of the gaps again and saves them, at most the configured maximum number of levels,
+// lowest levels first. It returns the number of levels repaired, the levels found above the checkpoint once
+// fetched, after a rollback, are left to the poller.
+func (s *scanner) Repair(ctx context.Context, gaps []types.LevelRange) (uint64, error) {
+	var repaired uint64
+	for _, gap := range gaps {
+		for level := gap.Start; level <= gap.End; level++ {
+			if repaired >= s.cfg.GetMaxLevels() {
+				log.Infof("Repaired %d levels, the remaining gaps are left for the next scan", repaired)
+				return repaired, nil
+			}
+			saved, err := s.repairLevel(ctx, level)
+			if err != nil {
+				return repaired, err
+			}
+			if !saved {
+				log.Infof("Repaired %d levels, level %d is above the checkpoint and left to the poller", repaired, level)
+				return repaired, nil
+			}
+			repaired++
+			metrics.RepairedLevelsCountInc()
+		}
+	}
+
+	log.Infof("Repaired %d levels", repaired)
+	return repaired, nil
+}
+
+// repairLevel fetches the delegations of a level and saves them, the checkpoint is left untouched.
+// It returns false when the level is no longer below the checkpoint.
+func (s *scanner) repairLevel(ctx context.Context, level uint64) (bool, error) {
+	dataChan := make(chan *types.ChanMsg, 1)
+	if err := s.source.GetDelegationsByLevel(ctx, level, dataChan); err != nil {
+		return false, fmt.Errorf("failed to fetch level %d: %w", level, err)
+	}
+	var msg *types.ChanMsg
+	select {
+	case msg = <-dataChan:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	block := types.Block{
+		Level:       msg.Level,
+		Hash:        msg.BlockHash,
+		Predecessor: msg.Predecessor,
+	}
+	saved, err := s.store.RepairLevel(ctx, block, msg.Data)
+	if err != nil {
+		return false, fmt.Errorf("%w: failed to save level %d: %w", types.ErrStorage, level, err)
+	}
+	if saved {
+		log.Debugf("Level %d repaired with %d delegations", level, len(msg.Data))
+	}
+	return saved, nil
+}
@@ -0,0 +1,185 @@
+package gaps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/processor"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/store"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/tzkt"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/tzkttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSource struct {
+	mock.Mock
+}
+
+func (m *mockSource) GetDelegationsByLevel(ctx context.Context, level uint64, dataChan chan<- *types.ChanMsg) error {
+	args := m.Called(ctx, level, dataChan)
+	if args.Error(0) == nil {
+		dataChan <- &types.ChanMsg{
+			Level:     level,
+			BlockHash: fmt.Sprintf("BL%d", level),
+			Data:      []types.FetchedDelegation{{Level: level}},
+		}
+	}
+	return args.Error(0)
+}
+
+type mockStore struct {
+	mock.Mock
+}
+
+func (m *mockStore) GetCheckpoint(ctx context.Context) (types.Checkpoint, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(types.Checkpoint), args.Error(1)
+}
+
+func (m *mockStore) GetGaps(ctx context.Context, fromLevel, toLevel uint64) ([]types.LevelRange, error) {
+	args := m.Called(ctx, fromLevel, toLevel)
+	return args.Get(0).([]types.LevelRange), args.Error(1)
+}
+
+func (m *mockStore) RepairLevel(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) (bool, error) {
+	args := m.Called(ctx, block, delegations)
+	return args.Bool(0), args.Error(1)
+}
+
+type mockConfig struct{}
+
+func (m *mockConfig) GetInterval() int      { return 1 }
+func (m *mockConfig) GetStartLevel() uint64 { return 100 }
+func (m *mockConfig) GetMaxLevels() uint64  { return 3 }
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Scan up to the checkpoint", func(t *testing.T) {
+		store := new(mockStore)
+		store.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 200}, nil)
+		store.On("GetGaps", mock.Anything, uint64(100), uint64(200)).Return([]types.LevelRange{{Start: 150, End: 151}}, nil)
+
+		gaps, err := NewScanner(new(mockSource), store, &mockConfig{}).Scan(ctx, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.LevelRange{{Start: 150, End: 151}}, gaps)
+	})
+
+	t.Run("Explicit range", func(t *testing.T) {
+		store := new(mockStore)
+		store.On("GetGaps", mock.Anything, uint64(120), uint64(130)).Return([]types.LevelRange{}, nil)
+
+		gaps, err := NewScanner(new(mockSource), store, &mockConfig{}).Scan(ctx, 120, 130)
+		assert.NoError(t, err)
+		assert.Empty(t, gaps)
+		store.AssertNotCalled(t, "GetCheckpoint", mock.Anything)
+	})
+
+	t.Run("Store error", func(t *testing.T) {
+		store := new(mockStore)
+		store.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{}, errors.New("db error"))
+
+		_, err := NewScanner(new(mockSource), store, &mockConfig{}).Scan(ctx, 0, 0)
+		assert.ErrorIs(t, err, types.ErrStorage)
+	})
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Levels are saved up to the maximum", func(t *testing.T) {
+		source, store := new(mockSource), new(mockStore)
+		source.On("GetDelegationsByLevel", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		store.On("RepairLevel", mock.Anything, mock.Anything, mock.Anything).Return(true, nil)
+
+		repaired, err := NewScanner(source, store, &mockConfig{}).Repair(ctx, []types.LevelRange{{Start: 150, End: 151}, {Start: 160, End: 170}})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(3), repaired)
+
+		for _, level := range []uint64{150, 151, 160} {
+			store.AssertCalled(t, "RepairLevel", mock.Anything,
+				types.Block{Level: level, Hash: fmt.Sprintf("BL%d", level)}, []types.FetchedDelegation{{Level: level}})
+		}
+		store.AssertNumberOfCalls(t, "RepairLevel", 3)
+	})
+
+	t.Run("Fetch error", func(t *testing.T) {
+		source, store := new(mockSource), new(mockStore)
+		source.On("GetDelegationsByLevel", mock.Anything, uint64(150), mock.Anything).Return(nil)
+		source.On("GetDelegationsByLevel", mock.Anything, uint64(151), mock.Anything).Return(fmt.Errorf("%w: unavailable", types.ErrTransport))
+		store.On("RepairLevel", mock.Anything, mock.Anything, mock.Anything).Return(true, nil)
+
+		repaired, err := NewScanner(source, store, &mockConfig{}).Repair(ctx, []types.LevelRange{{Start: 150, End: 152}})
+		assert.ErrorIs(t, err, types.ErrTransport)
+		assert.Equal(t, uint64(1), repaired)
+	})
+
+	t.Run("Levels above the checkpoint are left to the poller", func(t *testing.T) {
+		source, store := new(mockSource), new(mockStore)
+		source.On("GetDelegationsByLevel", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		// the store was rolled back below level 151 after the scan
+		store.On("RepairLevel", mock.Anything, types.Block{Level: 150, Hash: "BL150"}, mock.Anything).Return(true, nil)
+		store.On("RepairLevel", mock.Anything, types.Block{Level: 151, Hash: "BL151"}, mock.Anything).Return(false, nil)
+
+		repaired, err := NewScanner(source, store, &mockConfig{}).Repair(ctx, []types.LevelRange{{Start: 150, End: 152}})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), repaired)
+		source.AssertNotCalled(t, "GetDelegationsByLevel", mock.Anything, uint64(152), mock.Anything)
+	})
+}
+
+func TestScan_SparseBackfill(t *testing.T) {
+	server := tzkttest.NewServer(100)
+	defer server.Close()
+	// most levels have no delegation
+	delegation := types.FetchedDelegation{Sender: types.Sender{Address: "tz1"}, Amount: 1234}
+	for level := uint64(101); level <= 120; level++ {
+		if level%7 == 0 {
+			server.AppendBlock(delegation)
+		} else {
+			server.AppendBlock()
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := fmt.Sprintf(`
+server: {host: localhost, port: 8080, metricsPort: 8081, minValidYear: 2018}
+log: {level: info}
+tzkt: {timeout: 10, url: "%s", retryAttempts: 3, retryDelay: 10}
+db: {driver: sqlite, path: "%s"}
+poller: {startLevel: 101, retryAttempts: 3}
+`, server.URL, filepath.Join(t.TempDir(), "delegations.db"))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	cfg, err := config.LoadConfig(path)
+	require.NoError(t, err)
+	s, err := store.NewSQLiteStore(cfg.DB)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dataChan := make(chan *types.ChanMsg, 20)
+	errorChan := make(chan error, 1)
+	go processor.NewProcessor(s, dataChan, make(chan uint64, 1), errorChan, cfg.Poller).Run(ctx)
+
+	client := tzkt.NewClient(cfg.Tzkt)
+	require.NoError(t, client.GetDelegationsByRange(ctx, 101, 120, dataChan))
+	require.Eventually(t, func() bool {
+		checkpoint, err := s.GetCheckpoint(ctx)
+		return err == nil && checkpoint.Level == 120
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, errorChan)
+
+	scanner := NewScanner(client, s, &mockConfig{})
+	gaps, err := scanner.Scan(ctx, 101, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, gaps, "the levels without delegations were processed")
+}
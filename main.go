@@ -3,15 +3,21 @@ package main
 import (
 	"context"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/safwentrabelsi/tezos-delegation-watcher/api"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/gaps"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/metrics"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/node"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/poller"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/processor"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/store"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/tzkt"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/utils"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/verifier"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -32,9 +38,27 @@ func main() {
 	}
 	log.SetLevel(logLevel)
 
-	store, err := store.NewPostgresStore(cfg.DB)
+	// the metrics registry isn't safe for concurrent use, every metric is registered before a goroutine updates one
+	if err := metrics.Init(); err != nil {
+		log.Fatalf("Metrics init failed: %v", err)
+	}
+
+	// the migrate subcommand opens the database as it is, migrating it first would defeat reverting a migration
+	migrate := len(os.Args) > 1 && os.Args[1] == "migrate"
+	store, err := newStore(cfg.DB, !migrate)
 	if err != nil {
-		log.Fatalf("Failed to initialize Postgres store: %v", err)
+		log.Fatalf("Failed to initialize %s store: %v", cfg.DB.GetDriver(), err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(runVerify(cfg, store, os.Args[2:]))
+		case "gaps":
+			os.Exit(runGaps(cfg, store, os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrate(store, os.Args[2:]))
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -46,15 +70,86 @@ func main() {
 	dataChannel := make(chan *types.ChanMsg, 100)
 	defer close(dataChannel)
 
-	tzktClient := tzkt.NewClient(cfg.Tzkt)
+	rollbackChannel := make(chan uint64, 1)
+	defer close(rollbackChannel)
+
+	// the server registers the request metrics, it is created before the goroutines updating the others
+	server := api.NewAPIServer(cfg.Server, store)
+
+	source, primary := newPollerSource(ctx, cfg)
+	if cfg.Verifier.GetEnabled() {
+		_, secondary := newSource(ctx, cfg.Verifier.GetTzkt(), cfg.Verifier.GetNode())
+		go verifier.NewVerifier(primary, secondary, store, cfg.Verifier).Run(ctx)
+	}
+	if cfg.Gaps.GetEnabled() {
+		go gaps.NewScanner(source, store, cfg.Gaps).Run(ctx)
+	}
 
-	delegationPoller := poller.NewPoller(tzktClient, dataChannel, store, cfg.Poller, errorChan)
-	delegationProcessor := processor.NewProcessor(store, dataChannel, errorChan)
+	delegationPoller := poller.NewPoller(source, dataChannel, rollbackChannel, store, cfg.Poller, errorChan)
+	delegationProcessor := processor.NewProcessor(store, dataChannel, rollbackChannel, errorChan, cfg.Poller)
 
 	go delegationPoller.Run(ctx)
 	go delegationProcessor.Run(ctx)
 	go utils.HandleErrors(ctx, cancel, errorChan)
 
-	server := api.NewAPIServer(cfg.Server, store)
 	server.Run()
 }
+
+// migratedStore is a store whose schema is versioned by migrations.
+type migratedStore interface {
+	store.Storer
+	Migrate(ctx context.Context) error
+	MigrateTo(ctx context.Context, version int) error
+	SchemaVersion(ctx context.Context) (current int, latest int, err error)
+}
+
+// newStore opens the store of the configured database driver, migrating it to the latest schema when migrate is set.
+func newStore(cfg *config.DBConfig, migrate bool) (migratedStore, error) {
+	switch {
+	case cfg.GetDriver() == config.DriverSQLite && migrate:
+		return store.NewSQLiteStore(cfg)
+	case cfg.GetDriver() == config.DriverSQLite:
+		return store.OpenSQLiteStore(cfg)
+	case migrate:
+		return store.NewPostgresStore(cfg)
+	default:
+		return store.OpenPostgresStore(cfg)
+	}
+}
+
+// newPollerSource creates the client of the source the poller ingests from.
+func newPollerSource(ctx context.Context, cfg *config.Config) (tzkt.TzktInterface, verifier.Source) {
+	if cfg.Poller.GetSource() == config.SourceNode {
+		log.Info("Ingesting delegations from the Tezos node")
+		return newSource(ctx, nil, cfg.Node)
+	}
+	return newSource(ctx, cfg.Tzkt, nil)
+}
+
+// newSource creates a node client when nodeCfg is set and a TzKT client otherwise,
+// along with its name in the verifier discrepancies.
+func newSource(ctx context.Context, tzktCfg *config.TzktConfig, nodeCfg *config.NodeConfig) (tzkt.TzktInterface, verifier.Source) {
+	if nodeCfg != nil {
+		client := node.NewClient(nodeCfg)
+		return client, verifier.Source{Name: "node " + nodeCfg.GetURL(), Client: client}
+	}
+	client := tzkt.NewClient(tzktCfg)
+	if path := tzktCfg.GetRecord(); path != "" {
+		recorder, err := tzkt.NewRecorder(path)
+		if err != nil {
+			log.Fatalf("Failed to record TzKT traffic: %v", err)
+		}
+		log.Infof("Recording TzKT traffic to %s", path)
+		client.Record(recorder)
+	}
+	if path := tzktCfg.GetReplay(); path != "" {
+		replay, err := tzkt.LoadReplay(path, tzktCfg.GetReplaySpeed())
+		if err != nil {
+			log.Fatalf("Failed to replay TzKT traffic: %v", err)
+		}
+		log.Infof("Replaying TzKT traffic from %s", path)
+		client.Replay(replay)
+	}
+	go client.MonitorEndpoints(ctx, time.Duration(tzktCfg.GetHealthCheckInterval())*time.Second)
+	return client, verifier.Source{Name: "tzkt " + strings.Join(tzktCfg.GetURLs(), ","), Client: client}
+}
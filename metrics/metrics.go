@@ -9,7 +9,15 @@ import (
 
 var log = logrus.WithField("module", "metrics")
 
-const reorgMsgCountMetricsName = "watcher_received_reorg_messages_count"
+const (
+	reorgMsgCountMetricsName      = "watcher_received_reorg_messages_count"
+	activeTzktEndpointMetricsName = "watcher_tzkt_active_endpoint"
+	discrepancyCountMetricsName   = "watcher_verifier_discrepancies_count"
+	pollerDegradedMetricsName     = "watcher_poller_degraded"
+	headSilenceCountMetricsName   = "watcher_poller_head_silence_count"
+	repairedLevelsMetricsName     = "watcher_gaps_repaired_levels_count"
+	saveThroughputMetricsName     = "watcher_store_save_throughput"
+)
 
 // Init metrics.
 func Init() error {
@@ -17,6 +25,30 @@ func Init() error {
 	if err != nil {
 		return err
 	}
+	err = initActiveTzktEndpoint()
+	if err != nil {
+		return err
+	}
+	err = initDiscrepancyCount()
+	if err != nil {
+		return err
+	}
+	err = initPollerDegraded()
+	if err != nil {
+		return err
+	}
+	err = initHeadSilenceCount()
+	if err != nil {
+		return err
+	}
+	err = initRepairedLevelsCount()
+	if err != nil {
+		return err
+	}
+	err = initSaveThroughput()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -44,3 +76,157 @@ func ReorgMsgCountInc() {
 		log.Error(fmt.Sprintf("Error incrementing metric: %s", err))
 	}
 }
+
+// initActiveTzktEndpoint tells which of the configured TzKT endpoints is used.
+func initActiveTzktEndpoint() error {
+	gauge := &ginmetrics.Metric{
+		Type:        ginmetrics.Gauge,
+		Name:        activeTzktEndpointMetricsName,
+		Description: "TzKT endpoint in use, 1 for the active endpoint and 0 for the others",
+		Labels:      []string{"url"},
+	}
+	err := ginmetrics.GetMonitor().AddMetric(gauge)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error adding metric: %s", err))
+		return err
+	}
+	return nil
+}
+
+// SetActiveTzktEndpoint sets the active endpoint gauge to 1 for the active url and 0 for the others.
+func SetActiveTzktEndpoint(active string, urls []string) {
+	for _, url := range urls {
+		value := 0.0
+		if url == active {
+			value = 1
+		}
+		err := ginmetrics.GetMonitor().GetMetric(activeTzktEndpointMetricsName).SetGaugeValue([]string{url}, value)
+		if err != nil {
+			log.Error(fmt.Sprintf("Error setting metric: %s", err))
+		}
+	}
+}
+
+// initDiscrepancyCount counts the levels where the verified sources disagree.
+func initDiscrepancyCount() error {
+	counter := &ginmetrics.Metric{
+		Type:        ginmetrics.Counter,
+		Name:        discrepancyCountMetricsName,
+		Description: "Levels where the poller source and the verification source returned different delegations",
+		Labels:      []string{},
+	}
+	err := ginmetrics.GetMonitor().AddMetric(counter)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error adding metric: %s", err))
+		return err
+	}
+	return nil
+}
+
+// DiscrepancyCountAdd adds the given number of discrepancies to the counter.
+func DiscrepancyCountAdd(count int) {
+	err := ginmetrics.GetMonitor().GetMetric(discrepancyCountMetricsName).Add([]string{}, float64(count))
+	if err != nil {
+		log.Error(fmt.Sprintf("Error incrementing metric: %s", err))
+	}
+}
+
+// initPollerDegraded tells whether the poller is reconnecting after connection failures.
+func initPollerDegraded() error {
+	gauge := &ginmetrics.Metric{
+		Type:        ginmetrics.Gauge,
+		Name:        pollerDegradedMetricsName,
+		Description: "1 while the poller recovers from connection failures, 0 once its connection is healthy",
+		Labels:      []string{},
+	}
+	err := ginmetrics.GetMonitor().AddMetric(gauge)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error adding metric: %s", err))
+		return err
+	}
+	return nil
+}
+
+// SetPollerDegraded sets the poller degraded gauge.
+func SetPollerDegraded(degraded bool) {
+	value := 0.0
+	if degraded {
+		value = 1
+	}
+	err := ginmetrics.GetMonitor().GetMetric(pollerDegradedMetricsName).SetGaugeValue([]string{}, value)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error setting metric: %s", err))
+	}
+}
+
+// initHeadSilenceCount counts the subscriptions restarted because no head was received.
+func initHeadSilenceCount() error {
+	counter := &ginmetrics.Metric{
+		Type:        ginmetrics.Counter,
+		Name:        headSilenceCountMetricsName,
+		Description: "Subscriptions restarted after no head was received for the head silence timeout",
+		Labels:      []string{},
+	}
+	err := ginmetrics.GetMonitor().AddMetric(counter)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error adding metric: %s", err))
+		return err
+	}
+	return nil
+}
+
+// HeadSilenceCountInc increments the head silence counter.
+func HeadSilenceCountInc() {
+	err := ginmetrics.GetMonitor().GetMetric(headSilenceCountMetricsName).Inc([]string{})
+	if err != nil {
+		log.Error(fmt.Sprintf("Error incrementing metric: %s", err))
+	}
+}
+
+// initRepairedLevelsCount counts the missing levels fetched again by the gap repair.
+func initRepairedLevelsCount() error {
+	counter := &ginmetrics.Metric{
+		Type:        ginmetrics.Counter,
+		Name:        repairedLevelsMetricsName,
+		Description: "Levels missing below the checkpoint that were fetched again",
+		Labels:      []string{},
+	}
+	err := ginmetrics.GetMonitor().AddMetric(counter)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error adding metric: %s", err))
+		return err
+	}
+	return nil
+}
+
+// RepairedLevelsCountInc increments the repaired levels counter.
+func RepairedLevelsCountInc() {
+	err := ginmetrics.GetMonitor().GetMetric(repairedLevelsMetricsName).Inc([]string{})
+	if err != nil {
+		log.Error(fmt.Sprintf("Error incrementing metric: %s", err))
+	}
+}
+
+// initSaveThroughput reports how fast the delegations of the last batch were saved.
+func initSaveThroughput() error {
+	gauge := &ginmetrics.Metric{
+		Type:        ginmetrics.Gauge,
+		Name:        saveThroughputMetricsName,
+		Description: "Delegations saved per second in the last batch, by method: insert or copy",
+		Labels:      []string{"method"},
+	}
+	err := ginmetrics.GetMonitor().AddMetric(gauge)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error adding metric: %s", err))
+		return err
+	}
+	return nil
+}
+
+// SetSaveThroughput sets the throughput gauge of the given save method.
+func SetSaveThroughput(method string, rowsPerSecond float64) {
+	err := ginmetrics.GetMonitor().GetMetric(saveThroughputMetricsName).SetGaugeValue([]string{method}, rowsPerSecond)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error setting metric: %s", err))
+	}
+}
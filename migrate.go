@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runMigrate moves the database schema to the version given by -to, reverting migrations when it is below
+// the current version, and prints the resulting version. It returns the exit code: 1 on failure.
+func runMigrate(s migratedStore, args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	to := flags.Int("to", -1, "schema version to migrate to, defaults to the latest")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	migrate := s.Migrate
+	if *to >= 0 {
+		migrate = func(ctx context.Context) error { return s.MigrateTo(ctx, *to) }
+	}
+	if err := migrate(ctx); err != nil {
+		log.Errorf("Migration failed: %v", err)
+		return 1
+	}
+
+	current, latest, err := s.SchemaVersion(ctx)
+	if err != nil {
+		log.Errorf("Failed to get schema version: %v", err)
+		return 1
+	}
+	fmt.Printf("schema version %d, latest %d\n", current, latest)
+	return 0
+}
@@ -0,0 +1,401 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/tzkt"
+	"github.com/sirupsen/logrus"
+)
+
+// Node is a client reading delegations directly from the RPC of a Tezos node.
+// It implements the same interface as the Tzkt client, the operation ids are not known by the node and are left to zero.
+type Node struct {
+	url    string
+	client tzkt.HTTPClient
+	// streamClient has no timeout as the heads monitor is a long lived request
+	streamClient  tzkt.HTTPClient
+	retryAttempts int
+}
+
+// header is the header of a block returned by the node.
+type header struct {
+	Hash        string `json:"hash"`
+	Level       uint64 `json:"level"`
+	Predecessor string `json:"predecessor"`
+	Timestamp   string `json:"timestamp"`
+}
+
+// block is a block returned by the node, operations are grouped by validation pass.
+type block struct {
+	Hash       string        `json:"hash"`
+	Header     header        `json:"header"`
+	Operations [][]operation `json:"operations"`
+}
+
+type operation struct {
+	Hash     string    `json:"hash"`
+	Contents []content `json:"contents"`
+}
+
+type content struct {
+	Kind     string  `json:"kind"`
+	Source   string  `json:"source"`
+	Fee      string  `json:"fee"`
+	Counter  string  `json:"counter"`
+	Delegate *string `json:"delegate"`
+	Metadata struct {
+		OperationResult          operationResult   `json:"operation_result"`
+		InternalOperationResults []internalContent `json:"internal_operation_results"`
+	} `json:"metadata"`
+}
+
+// internalContent is an operation emitted by a smart contract.
+type internalContent struct {
+	Kind     string          `json:"kind"`
+	Source   string          `json:"source"`
+	Nonce    uint64          `json:"nonce"`
+	Delegate *string         `json:"delegate"`
+	Result   operationResult `json:"result"`
+}
+
+type operationResult struct {
+	Status           string `json:"status"`
+	ConsumedMilligas string `json:"consumed_milligas"`
+}
+
+// contract is the state of an account in the context of a block.
+type contract struct {
+	Balance  string  `json:"balance"`
+	Delegate *string `json:"delegate"`
+}
+
+const delegationKind = "delegation"
+
+var log = logrus.WithField("module", "nodeClient")
+
+// errNotFound is returned when the node doesn't know the requested resource.
+var errNotFound = fmt.Errorf("%w: not found", types.ErrProtocol)
+
+// NewClient creates a new Node client using the provided configuration.
+func NewClient(cfg *config.NodeConfig) *Node {
+	return &Node{
+		url: cfg.GetURL(),
+		client: &http.Client{
+			Timeout: time.Duration(cfg.GetTimeout()) * time.Second,
+		},
+		streamClient:  &http.Client{},
+		retryAttempts: cfg.GetRetryAttempts(),
+	}
+}
+
+// GetDelegationsByLevel fetches the delegations included in the block at the given level.
+// A message is sent even when the level has no delegations so the level can be checkpointed.
+func (n *Node) GetDelegationsByLevel(ctx context.Context, level uint64, dataChan chan<- *types.ChanMsg) error {
+	msg, err := n.getBlockMessage(ctx, strconv.FormatUint(level, 10))
+	if err != nil {
+		return err
+	}
+
+	log.Tracef("Sending %d delegations to channel", len(msg.Data))
+	dataChan <- msg
+	return nil
+}
+
+// MaxRangeSize returns the size of the ranges the backfill should request. The node has no range queries,
+// a range is fetched level by level, so the levels are better spread over the backfill workers.
+func (n *Node) MaxRangeSize() uint64 {
+	return 1
+}
+
+// GetDelegationsByRange fetches the delegations between startLevel and endLevel (both included).
+// The node has no range queries so a message is sent for every level of the range.
+func (n *Node) GetDelegationsByRange(ctx context.Context, startLevel, endLevel uint64, dataChan chan<- *types.ChanMsg) error {
+	for level := startLevel; level <= endLevel; level++ {
+		if err := n.GetDelegationsByLevel(ctx, level, dataChan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBlockHash fetches the hash of the block at the given level.
+func (n *Node) GetBlockHash(ctx context.Context, level uint64) (string, error) {
+	var hash string
+	url := fmt.Sprintf("%s/chains/main/blocks/%d/hash", n.url, level)
+	if err := n.getJSON(ctx, url, &hash); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// SubscribeToHead monitors the new heads of the node and sends the delegations of each of them.
+// Reorgs are not notified by the node, a head replacing a processed block is sent as is and detected from its hashes.
+func (n *Node) SubscribeToHead(ctx context.Context, dataChan chan<- *types.ChanMsg, currentHead chan<- uint64, errorChan chan<- error) {
+	log.Debug("Subscribing to Tezos node heads monitor")
+
+	var head header
+	if err := n.getJSON(ctx, fmt.Sprintf("%s/chains/main/blocks/head/header", n.url), &head); err != nil {
+		errorChan <- fmt.Errorf("couldn't get node head: %w", err)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/monitor/heads/main", n.url), nil)
+	if err != nil {
+		errorChan <- fmt.Errorf("couldn't create heads monitor request: %w", err)
+		return
+	}
+	resp, err := n.streamClient.Do(req)
+	if err != nil {
+		errorChan <- fmt.Errorf("%w: couldn't monitor node heads: %w", types.ErrTransport, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		errorChan <- fmt.Errorf("couldn't monitor node heads: %w", statusError(resp.StatusCode))
+		return
+	}
+
+	// blocks above this head are processed from the monitor, the ones below by the getPastDelegations function
+	initHead := head.Level
+	select {
+	case currentHead <- initHead:
+	case <-ctx.Done():
+		return
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var newHead header
+		if err := decoder.Decode(&newHead); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			errorChan <- fmt.Errorf("%w: node heads monitor closed: %w", types.ErrTransport, err)
+			return
+		}
+		if newHead.Level <= initHead {
+			continue
+		}
+
+		log.Infof("Fetching delegations for new head level: %d", newHead.Level)
+		msg, err := n.getBlockMessage(ctx, newHead.Hash)
+		if err != nil {
+			errorChan <- fmt.Errorf("error fetching delegations: %w", err)
+			return
+		}
+		select {
+		case dataChan <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getBlockMessage fetches a block by level or hash and extracts its delegations.
+func (n *Node) getBlockMessage(ctx context.Context, blockID string) (*types.ChanMsg, error) {
+	var b block
+	if err := n.getJSON(ctx, fmt.Sprintf("%s/chains/main/blocks/%s", n.url, blockID), &b); err != nil {
+		return nil, err
+	}
+
+	var delegations []types.FetchedDelegation
+	// a sender delegating several times in the block is looked up once
+	contracts := make(map[string]contract)
+	for _, pass := range b.Operations {
+		for _, op := range pass {
+			for _, c := range op.Contents {
+				if c.Kind == delegationKind {
+					d, err := n.delegationFromContent(ctx, b, contracts, op.Hash, c)
+					if err != nil {
+						return nil, err
+					}
+					delegations = append(delegations, d)
+				}
+				for _, internal := range c.Metadata.InternalOperationResults {
+					if internal.Kind != delegationKind {
+						continue
+					}
+					d, err := n.delegationFromInternal(ctx, b, contracts, op.Hash, c.Counter, internal)
+					if err != nil {
+						return nil, err
+					}
+					delegations = append(delegations, d)
+				}
+			}
+		}
+	}
+
+	return &types.ChanMsg{
+		Level:       b.Header.Level,
+		BlockHash:   b.Hash,
+		Predecessor: b.Header.Predecessor,
+		Reorg:       false,
+		Data:        delegations,
+	}, nil
+}
+
+// delegationFromContent converts a delegation signed by an account.
+func (n *Node) delegationFromContent(ctx context.Context, b block, contracts map[string]contract, hash string, c content) (types.FetchedDelegation, error) {
+	counter, err := strconv.ParseUint(c.Counter, 10, 64)
+	if err != nil {
+		return types.FetchedDelegation{}, fmt.Errorf("%w: Decoding counter of operation %s failed: %w", types.ErrDecode, hash, err)
+	}
+	fee, err := parseMutez(c.Fee)
+	if err != nil {
+		return types.FetchedDelegation{}, fmt.Errorf("%w: Decoding fee of operation %s failed: %w", types.ErrDecode, hash, err)
+	}
+
+	d := types.FetchedDelegation{
+		Hash:     hash,
+		Counter:  counter,
+		BakerFee: fee,
+		GasUsed:  gasUsed(c.Metadata.OperationResult.ConsumedMilligas),
+		Status:   c.Metadata.OperationResult.Status,
+	}
+	return n.completeDelegation(ctx, b, contracts, d, c.Source, c.Delegate)
+}
+
+// delegationFromInternal converts a delegation emitted by a smart contract, it shares the counter of the operation that emitted it.
+func (n *Node) delegationFromInternal(ctx context.Context, b block, contracts map[string]contract, hash, counter string, c internalContent) (types.FetchedDelegation, error) {
+	parsedCounter, err := strconv.ParseUint(counter, 10, 64)
+	if err != nil {
+		return types.FetchedDelegation{}, fmt.Errorf("%w: Decoding counter of operation %s failed: %w", types.ErrDecode, hash, err)
+	}
+
+	nonce := c.Nonce
+	d := types.FetchedDelegation{
+		Hash:    hash,
+		Counter: parsedCounter,
+		Nonce:   &nonce,
+		GasUsed: gasUsed(c.Result.ConsumedMilligas),
+		Status:  c.Result.Status,
+	}
+	return n.completeDelegation(ctx, b, contracts, d, c.Source, c.Delegate)
+}
+
+// completeDelegation fills the block fields and reads the delegated balance and previous baker of the sender
+// from the context of the predecessor block, as the node doesn't report them in the operation.
+// The contracts already read for the block are taken from contracts.
+func (n *Node) completeDelegation(ctx context.Context, b block, contracts map[string]contract, d types.FetchedDelegation, source string, delegate *string) (types.FetchedDelegation, error) {
+	d.Level = b.Header.Level
+	d.Timestamp = b.Header.Timestamp
+	d.Block = b.Hash
+	d.Sender = types.Sender{Address: source}
+	if delegate != nil {
+		d.NewDelegate = &types.Delegate{Address: *delegate}
+	}
+
+	c, ok := contracts[source]
+	if !ok {
+		url := fmt.Sprintf("%s/chains/main/blocks/%s/context/contracts/%s", n.url, b.Header.Predecessor, source)
+		if err := n.getJSON(ctx, url, &c); err != nil && !errors.Is(err, errNotFound) {
+			return types.FetchedDelegation{}, err
+		}
+		contracts[source] = c
+	}
+
+	amount, err := parseMutez(c.Balance)
+	if err != nil {
+		return types.FetchedDelegation{}, fmt.Errorf("%w: Decoding balance of %s failed: %w", types.ErrDecode, source, err)
+	}
+	d.Amount = amount
+	if c.Delegate != nil {
+		d.PrevDelegate = &types.Delegate{Address: *c.Delegate}
+	}
+
+	return d, nil
+}
+
+// parseMutez parses an amount of mutez, the node encodes them as strings.
+func parseMutez(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// gasUsed converts the consumed milligas to gas units rounded up, as reported by TzKT.
+func gasUsed(milligas string) uint64 {
+	value, err := strconv.ParseFloat(milligas, 64)
+	if err != nil {
+		return 0
+	}
+	return uint64(math.Ceil(value / 1000))
+}
+
+// getJSON executes a GET request on the given url and decodes the response into out.
+func (n *Node) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("Creating request failed: %w", err)
+	}
+
+	resp, err := n.executeRequest(ctx, req)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return err
+		}
+		return fmt.Errorf("Executing request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("%w: Decoding response failed: %w", types.DecodeErrorClass(err), err)
+	}
+
+	return nil
+}
+
+// statusError classifies a non-200 status code: client errors will never succeed and are protocol errors,
+// the others transport errors.
+func statusError(code int) error {
+	class := types.ErrTransport
+	if code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests {
+		class = types.ErrProtocol
+	}
+	return fmt.Errorf("%w: non-200 status code: %v", class, code)
+}
+
+func (n *Node) executeRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	log.Tracef("Executing HTTP request to %s", req.URL)
+	return retry.DoWithData(
+		func() (*http.Response, error) {
+			req = req.WithContext(ctx)
+			resp, err := n.client.Do(req)
+			if err != nil {
+				return nil, fmt.Errorf("%w: HTTP request failed: %w", types.ErrTransport, err)
+			}
+
+			if resp.StatusCode == http.StatusNotFound {
+				resp.Body.Close()
+				return nil, retry.Unrecoverable(errNotFound)
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				err := statusError(resp.StatusCode)
+				if errors.Is(err, types.ErrProtocol) {
+					return nil, retry.Unrecoverable(err)
+				}
+				return nil, err
+			}
+
+			return resp, nil
+		},
+		retry.Context(ctx),
+		retry.Attempts(uint(n.retryAttempts)),
+		retry.OnRetry(func(n uint, err error) {
+			log.Errorf("Retry %d for error: %v", n+1, err)
+		}),
+	)
+}
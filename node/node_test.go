@@ -0,0 +1,230 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBlock returns a block containing a delegation, an undelegation, a transaction emitting
+// an internal delegation and a failed delegation.
+func fakeBlock(level uint64) string {
+	return fmt.Sprintf(`{
+		"hash": "BL%[1]d",
+		"header": {"level": %[1]d, "predecessor": "BL%[2]d", "timestamp": "2024-04-21T16:23:27Z"},
+		"operations": [
+			[{"hash": "onEndorsement", "contents": [{"kind": "attestation"}]}],
+			[],
+			[],
+			[
+				{"hash": "oo1", "contents": [{"kind": "delegation", "source": "tz1a", "fee": "400", "counter": "7", "delegate": "tz1baker",
+					"metadata": {"operation_result": {"status": "applied", "consumed_milligas": "1000000"}}}]},
+				{"hash": "oo2", "contents": [
+					{"kind": "reveal", "source": "tz1b", "fee": "300", "counter": "8", "metadata": {"operation_result": {"status": "applied"}}},
+					{"kind": "delegation", "source": "tz1b", "fee": "200", "counter": "9",
+						"metadata": {"operation_result": {"status": "applied", "consumed_milligas": "100001"}}}]},
+				{"hash": "oo3", "contents": [{"kind": "transaction", "source": "tz1c", "fee": "500", "counter": "10",
+					"metadata": {"operation_result": {"status": "applied"}, "internal_operation_results": [
+						{"kind": "delegation", "source": "KT1a", "nonce": 1, "delegate": "tz1baker", "result": {"status": "applied", "consumed_milligas": "200000"}}]}}]}
+			]
+		]
+	}`, level, level-1)
+}
+
+// newFakeNode starts a server answering the RPC endpoints used by the client.
+// It counts the failed block requests and the contract requests.
+func newFakeNode(t *testing.T, heads []string) (*httptest.Server, *atomic.Int32, *atomic.Int32) {
+	failures := new(atomic.Int32)
+	contracts := new(atomic.Int32)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chains/main/blocks/", func(w http.ResponseWriter, r *http.Request) {
+		var level uint64
+		var contract string
+		switch {
+		case r.URL.Path == "/chains/main/blocks/head/header":
+			fmt.Fprint(w, `{"hash": "BL100", "level": 100, "predecessor": "BL99", "timestamp": "2024-04-21T16:23:27Z"}`)
+		case scan(r.URL.Path, "/chains/main/blocks/%d/hash", &level):
+			switch level {
+			case 1:
+				fmt.Fprint(w, `{"hash": "BL1"}`)
+			case 2:
+				// the response is cut
+				fmt.Fprint(w, `"BL`)
+			default:
+				fmt.Fprintf(w, `"BL%d"`, level)
+			}
+		case scan(r.URL.Path, "/chains/main/blocks/BL%d/context/contracts/%s", &level, &contract):
+			contracts.Add(1)
+			switch contract {
+			case "tz1a":
+				fmt.Fprint(w, `{"balance": "1234", "delegate": "tz1oldbaker", "counter": "6"}`)
+			case "KT1a":
+				// accounts that are not delegated have no delegate
+				fmt.Fprint(w, `{"balance": "10"}`)
+			default:
+				http.NotFound(w, r)
+			}
+		case scan(r.URL.Path, "/chains/main/blocks/BL%d", &level), scan(r.URL.Path, "/chains/main/blocks/%d", &level):
+			if level == 666 {
+				failures.Add(1)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, fakeBlock(level))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/monitor/heads/main", func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		for _, head := range heads {
+			fmt.Fprintln(w, head)
+			flusher.Flush()
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, failures, contracts
+}
+
+// scan reports whether the path matches the format entirely.
+func scan(path, format string, args ...any) bool {
+	n, err := fmt.Sscanf(path, format, args...)
+	return err == nil && n == len(args)
+}
+
+func newTestNode(url string) *Node {
+	return &Node{
+		url:           url,
+		client:        &http.Client{Timeout: time.Second},
+		streamClient:  &http.Client{},
+		retryAttempts: 2,
+	}
+}
+
+func TestGetDelegationsByLevel(t *testing.T) {
+	server, _, contracts := newFakeNode(t, nil)
+	node := newTestNode(server.URL)
+
+	dataChan := make(chan *types.ChanMsg, 1)
+	err := node.GetDelegationsByLevel(context.Background(), 101, dataChan)
+	assert.NoError(t, err)
+
+	msg := <-dataChan
+	assert.Equal(t, uint64(101), msg.Level)
+	assert.Equal(t, "BL101", msg.BlockHash)
+	assert.Equal(t, "BL100", msg.Predecessor)
+	assert.False(t, msg.Reorg)
+
+	nonce := uint64(1)
+	assert.Equal(t, []types.FetchedDelegation{
+		{
+			Level: 101, Timestamp: "2024-04-21T16:23:27Z", Block: "BL101", Hash: "oo1", Counter: 7,
+			Sender: types.Sender{Address: "tz1a"}, NewDelegate: &types.Delegate{Address: "tz1baker"}, PrevDelegate: &types.Delegate{Address: "tz1oldbaker"},
+			Amount: 1234, Status: "applied", BakerFee: 400, GasUsed: 1000,
+		},
+		{
+			Level: 101, Timestamp: "2024-04-21T16:23:27Z", Block: "BL101", Hash: "oo2", Counter: 9,
+			Sender: types.Sender{Address: "tz1b"},
+			Status: "applied", BakerFee: 200, GasUsed: 101,
+		},
+		{
+			Level: 101, Timestamp: "2024-04-21T16:23:27Z", Block: "BL101", Hash: "oo3", Counter: 10, Nonce: &nonce,
+			Sender: types.Sender{Address: "KT1a"}, NewDelegate: &types.Delegate{Address: "tz1baker"},
+			Amount: 10, Status: "applied", GasUsed: 200,
+		},
+	}, msg.Data)
+	// the balance and the delegate of a sender are read in a single request
+	assert.Equal(t, int32(3), contracts.Load())
+}
+
+func TestGetDelegationsByRange(t *testing.T) {
+	server, failures, _ := newFakeNode(t, nil)
+	node := newTestNode(server.URL)
+
+	dataChan := make(chan *types.ChanMsg, 3)
+	err := node.GetDelegationsByRange(context.Background(), 101, 103, dataChan)
+	assert.NoError(t, err)
+	assert.Len(t, dataChan, 3)
+	for level := uint64(101); level <= 103; level++ {
+		msg := <-dataChan
+		assert.Equal(t, level, msg.Level)
+		assert.Len(t, msg.Data, 3)
+	}
+
+	// server errors are retried before failing the range
+	err = node.GetDelegationsByRange(context.Background(), 665, 667, dataChan)
+	assert.ErrorIs(t, err, types.ErrTransport)
+	assert.Equal(t, int32(2), failures.Load())
+	assert.Equal(t, uint64(665), (<-dataChan).Level)
+	assert.Empty(t, dataChan)
+}
+
+func TestGetBlockHash(t *testing.T) {
+	server, _, _ := newFakeNode(t, nil)
+	node := newTestNode(server.URL)
+
+	hash, err := node.GetBlockHash(context.Background(), 42)
+	assert.NoError(t, err)
+	assert.Equal(t, "BL42", hash)
+
+	_, err = node.GetBlockHash(context.Background(), 1)
+	assert.ErrorIs(t, err, types.ErrDecode, "the node answered with something else than a hash")
+
+	_, err = node.GetBlockHash(context.Background(), 2)
+	assert.ErrorIs(t, err, types.ErrTransport, "an incomplete response is a transport failure")
+}
+
+func TestSubscribeToHead(t *testing.T) {
+	t.Run("Nominal case", func(t *testing.T) {
+		heads := []string{
+			`{"hash": "BL100", "level": 100, "predecessor": "BL99"}`,
+			`{"hash": "BL101", "level": 101, "predecessor": "BL100"}`,
+			`{"hash": "BL102", "level": 102, "predecessor": "BL101"}`,
+		}
+		server, _, _ := newFakeNode(t, heads)
+		node := newTestNode(server.URL)
+
+		dataChan := make(chan *types.ChanMsg, 10)
+		currentHead := make(chan uint64, 1)
+		errorChan := make(chan error, 1)
+
+		go node.SubscribeToHead(context.Background(), dataChan, currentHead, errorChan)
+
+		assert.Equal(t, uint64(100), <-currentHead)
+		// the current head is processed by the backfill
+		msg := <-dataChan
+		assert.Equal(t, uint64(101), msg.Level)
+		assert.Equal(t, "BL100", msg.Predecessor)
+		assert.Len(t, msg.Data, 3)
+		assert.Equal(t, uint64(102), (<-dataChan).Level)
+
+		// the monitor is closed by the server
+		assert.ErrorContains(t, <-errorChan, "node heads monitor closed")
+	})
+
+	t.Run("Node unavailable", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode("unavailable")
+		}))
+		defer server.Close()
+		node := newTestNode(server.URL)
+
+		errorChan := make(chan error, 1)
+		go node.SubscribeToHead(context.Background(), make(chan *types.ChanMsg), make(chan uint64), errorChan)
+
+		err := <-errorChan
+		assert.ErrorIs(t, err, types.ErrTransport)
+		assert.ErrorContains(t, err, "couldn't get node head")
+	})
+}
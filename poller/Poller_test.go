@@ -3,10 +3,20 @@ package poller
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
 	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/processor"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/store"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/tzkt"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/tzkttest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -19,27 +29,70 @@ func (m *mockTzkt) GetDelegationsByLevel(ctx context.Context, level uint64, data
 	args := m.Called(ctx, level, dataChan)
 	if args.Get(0) == nil {
 		dataChan <- &types.ChanMsg{
-			Level: level,
-			Data:  []types.FetchedDelegation{{Sender: types.Sender{Address: "tz1"}, Level: level, Amount: 1234}},
+			Level:     level,
+			BlockHash: fmt.Sprintf("BL%d", level),
+			Data:      []types.FetchedDelegation{{Sender: types.Sender{Address: "tz1"}, Level: level, Amount: 1234}},
 		}
 	}
 	return args.Error(0)
 }
 
+func (m *mockTzkt) GetDelegationsByRange(ctx context.Context, startLevel, endLevel uint64, dataChan chan<- *types.ChanMsg) error {
+	args := m.Called(ctx, startLevel, endLevel, dataChan)
+	for level := startLevel; level <= endLevel; level++ {
+		if err, ok := args.Get(0).(error); ok && level == endLevel {
+			return err
+		}
+		dataChan <- &types.ChanMsg{
+			Level:     level,
+			BlockHash: fmt.Sprintf("BL%d", level),
+			Data:      []types.FetchedDelegation{{Sender: types.Sender{Address: "tz1"}, Level: level, Amount: 1234}},
+		}
+	}
+	return args.Error(0)
+}
+
+func (m *mockTzkt) GetBlockHash(ctx context.Context, level uint64) (string, error) {
+	args := m.Called(ctx, level)
+	return args.String(0), args.Error(1)
+}
+
 func (m *mockTzkt) SubscribeToHead(ctx context.Context, dataChan chan<- *types.ChanMsg, currentHead chan<- uint64, errorChan chan<- error) {
 	m.Called(ctx, dataChan, currentHead, errorChan)
 }
 
+// mockNode is a source fetching a range level by level.
+type mockNode struct {
+	*mockTzkt
+	maxRangeSize uint64
+}
+
+func (m *mockNode) MaxRangeSize() uint64 {
+	return m.maxRangeSize
+}
+
 type mockStore struct {
 	mock.Mock
 }
 
-func (m *mockStore) GetCurrentLevel(ctx context.Context) (uint64, error) {
+func (m *mockStore) GetCheckpoint(ctx context.Context) (types.Checkpoint, error) {
 	args := m.Called(ctx)
-	return args.Get(0).(uint64), args.Error(1)
+	return args.Get(0).(types.Checkpoint), args.Error(1)
+}
+
+func (m *mockStore) GetBlocks(ctx context.Context, maxLevel uint64, limit int) ([]types.Block, error) {
+	args := m.Called(ctx, maxLevel, limit)
+	return args.Get(0).([]types.Block), args.Error(1)
 }
 
 type mockConfig struct {
+	reconnectForever   bool
+	headSilenceTimeout int
+	batchSize          uint64
+	saveBatchSize      uint64
+	// reconnection delays in milliseconds, 10 and 40 when unset
+	reconnectDelay    int
+	maxReconnectDelay int
 }
 
 func (m *mockConfig) GetStartLevel() uint64 {
@@ -51,6 +104,45 @@ func (m *mockConfig) GetRetryAttempts() int {
 func (m *mockConfig) GetFetchOld() bool {
 	return true
 }
+func (m *mockConfig) GetConcurrency() int {
+	return 2
+}
+func (m *mockConfig) GetBatchSize() uint64 {
+	return max(m.batchSize, 1)
+}
+func (m *mockConfig) GetFinalityDepth() uint64 {
+	return 2
+}
+func (m *mockConfig) GetSaveBatchSize() uint64 {
+	return m.saveBatchSize
+}
+func (m *mockConfig) GetMaxReorgDepth() int {
+	return 3
+}
+func (m *mockConfig) GetReconnectDelay() int {
+	if m.reconnectDelay == 0 {
+		return 10
+	}
+	return m.reconnectDelay
+}
+func (m *mockConfig) GetMaxReconnectDelay() int {
+	if m.maxReconnectDelay == 0 {
+		return 40
+	}
+	return m.maxReconnectDelay
+}
+func (m *mockConfig) GetReconnectForever() bool {
+	return m.reconnectForever
+}
+func (m *mockConfig) GetHealthyAfter() int {
+	return 1
+}
+func (m *mockConfig) GetHeadSilenceTimeout() int {
+	if m.headSilenceTimeout == 0 {
+		return 60
+	}
+	return m.headSilenceTimeout
+}
 
 func TestPoller_Run(t *testing.T) {
 
@@ -60,16 +152,17 @@ func TestPoller_Run(t *testing.T) {
 		dataChan := make(chan *types.ChanMsg)
 		errorChan := make(chan error)
 
-		mockStoreInstance.On("GetCurrentLevel", mock.Anything).Return(uint64(100), nil)
+		mockStoreInstance.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 100, BlockHash: "BL100"}, nil)
+		mockStoreInstance.On("GetBlocks", mock.Anything, mock.Anything, 3).Return([]types.Block{}, nil)
 		mockTzktInstance.On("SubscribeToHead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 			currentHead := args.Get(2).(chan<- uint64)
 			currentHead <- 101
 		})
-		mockTzktInstance.On("GetDelegationsByLevel", mock.Anything, uint64(101), mock.Anything).Return(nil)
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(101), uint64(101), mock.Anything).Return(nil)
 
 		cfg := &mockConfig{}
 
-		poller := NewPoller(mockTzktInstance, dataChan, mockStoreInstance, cfg, errorChan)
+		poller := NewPoller(mockTzktInstance, dataChan, make(chan uint64), mockStoreInstance, cfg, errorChan)
 
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
@@ -91,6 +184,195 @@ func TestPoller_Run(t *testing.T) {
 		mockStoreInstance.AssertExpectations(t)
 
 	})
+	t.Run("Live messages are delivered after past delegations", func(t *testing.T) {
+		mockTzktInstance := new(mockTzkt)
+		mockStoreInstance := new(mockStore)
+		dataChan := make(chan *types.ChanMsg)
+		errorChan := make(chan error)
+
+		mockStoreInstance.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 98, BlockHash: "BL98"}, nil)
+		mockStoreInstance.On("GetBlocks", mock.Anything, mock.Anything, 3).Return([]types.Block{}, nil)
+		mockTzktInstance.On("SubscribeToHead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			liveChan := args.Get(1).(chan<- *types.ChanMsg)
+			currentHead := args.Get(2).(chan<- uint64)
+			currentHead <- 100
+			liveChan <- &types.ChanMsg{Level: 101}
+		})
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(99), uint64(99), mock.Anything).Return(nil).After(50 * time.Millisecond)
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(100), uint64(100), mock.Anything).Return(nil)
+
+		cfg := &mockConfig{}
+
+		poller := NewPoller(mockTzktInstance, dataChan, make(chan uint64), mockStoreInstance, cfg, errorChan)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		go poller.Run(ctx)
+
+		for _, level := range []uint64{99, 100, 101} {
+			select {
+			case err := <-errorChan:
+				assert.Fail(t, "Unexpected error", err)
+			case msg := <-dataChan:
+				assert.Equal(t, level, msg.Level)
+			case <-ctx.Done():
+				assert.Fail(t, "Timeout waiting for level", level)
+			}
+		}
+	})
+	t.Run("Replaced levels are fetched again after a rollback", func(t *testing.T) {
+		mockTzktInstance := new(mockTzkt)
+		mockStoreInstance := new(mockStore)
+		dataChan := make(chan *types.ChanMsg)
+		rollbackChan := make(chan uint64)
+		errorChan := make(chan error)
+
+		mockStoreInstance.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 100, BlockHash: "BL100"}, nil)
+		mockStoreInstance.On("GetBlocks", mock.Anything, mock.Anything, 3).Return([]types.Block{}, nil)
+		mockTzktInstance.On("SubscribeToHead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			liveChan := args.Get(1).(chan<- *types.ChanMsg)
+			currentHead := args.Get(2).(chan<- uint64)
+			currentHead <- 100
+			liveChan <- &types.ChanMsg{Level: 101}
+			liveChan <- &types.ChanMsg{Level: 99, Reorg: true}
+			liveChan <- &types.ChanMsg{Level: 102}
+		})
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(100), uint64(100), mock.Anything).Return(nil)
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(101), uint64(101), mock.Anything).Return(nil)
+
+		cfg := &mockConfig{}
+
+		poller := NewPoller(mockTzktInstance, dataChan, rollbackChan, mockStoreInstance, cfg, errorChan)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		go poller.Run(ctx)
+
+		expected := []struct {
+			level uint64
+			reorg bool
+		}{{101, false}, {99, true}, {100, false}, {101, false}, {102, false}}
+		for _, e := range expected {
+			select {
+			case err := <-errorChan:
+				assert.Fail(t, "Unexpected error", err)
+			case msg := <-dataChan:
+				assert.Equal(t, e.level, msg.Level)
+				assert.Equal(t, e.reorg, msg.Reorg)
+				if msg.Reorg {
+					// acting as the processor
+					rollbackChan <- msg.Level
+				}
+			case <-ctx.Done():
+				assert.Fail(t, "Timeout waiting for level", e.level)
+			}
+		}
+
+		mockTzktInstance.AssertExpectations(t)
+	})
+	t.Run("Diverged blocks are rolled back on connect", func(t *testing.T) {
+		mockTzktInstance := new(mockTzkt)
+		mockStoreInstance := new(mockStore)
+		dataChan := make(chan *types.ChanMsg)
+		rollbackChan := make(chan uint64)
+		errorChan := make(chan error)
+
+		// level 100 was replaced while the ws was disconnected
+		mockStoreInstance.On("GetBlocks", mock.Anything, uint64(101), 3).Return([]types.Block{
+			{Level: 100, Hash: "BL100a", Predecessor: "BL99"},
+			{Level: 99, Hash: "BL99", Predecessor: "BL98"},
+		}, nil)
+		mockStoreInstance.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 99, BlockHash: "BL99"}, nil)
+		mockTzktInstance.On("GetBlockHash", mock.Anything, uint64(100)).Return("BL100", nil)
+		mockTzktInstance.On("GetBlockHash", mock.Anything, uint64(99)).Return("BL99", nil)
+		mockTzktInstance.On("SubscribeToHead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			currentHead := args.Get(2).(chan<- uint64)
+			currentHead <- 101
+		})
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(100), uint64(100), mock.Anything).Return(nil)
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(101), uint64(101), mock.Anything).Return(nil)
+
+		cfg := &mockConfig{}
+
+		poller := NewPoller(mockTzktInstance, dataChan, rollbackChan, mockStoreInstance, cfg, errorChan)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		go poller.Run(ctx)
+
+		expected := []struct {
+			level uint64
+			reorg bool
+		}{{99, true}, {100, false}, {101, false}}
+		for _, e := range expected {
+			select {
+			case err := <-errorChan:
+				assert.Fail(t, "Unexpected error", err)
+			case msg := <-dataChan:
+				assert.Equal(t, e.level, msg.Level)
+				assert.Equal(t, e.reorg, msg.Reorg)
+				if msg.Reorg {
+					rollbackChan <- msg.Level
+				}
+			case <-ctx.Done():
+				assert.Fail(t, "Timeout waiting for level", e.level)
+			}
+		}
+
+		mockTzktInstance.AssertExpectations(t)
+		mockStoreInstance.AssertExpectations(t)
+	})
+	t.Run("Head not extending the delivered chain triggers a rollback", func(t *testing.T) {
+		mockTzktInstance := new(mockTzkt)
+		mockStoreInstance := new(mockStore)
+		dataChan := make(chan *types.ChanMsg)
+		rollbackChan := make(chan uint64)
+		errorChan := make(chan error)
+
+		mockStoreInstance.On("GetBlocks", mock.Anything, mock.Anything, 3).Return([]types.Block{}, nil)
+		mockStoreInstance.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 99, BlockHash: "BL99"}, nil)
+		mockTzktInstance.On("SubscribeToHead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			liveChan := args.Get(1).(chan<- *types.ChanMsg)
+			currentHead := args.Get(2).(chan<- uint64)
+			currentHead <- 101
+			// BL100 was delivered during the backfill but the new head is built on another block
+			liveChan <- &types.ChanMsg{Level: 102, BlockHash: "BL102", Predecessor: "BL101b"}
+		})
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(100), uint64(100), mock.Anything).Return(nil)
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(101), uint64(101), mock.Anything).Return(nil).Once()
+		mockTzktInstance.On("GetBlockHash", mock.Anything, uint64(101)).Return("BL101b", nil)
+		mockTzktInstance.On("GetBlockHash", mock.Anything, uint64(100)).Return("BL100", nil)
+
+		cfg := &mockConfig{}
+
+		poller := NewPoller(mockTzktInstance, dataChan, rollbackChan, mockStoreInstance, cfg, errorChan)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		go poller.Run(ctx)
+
+		expected := []struct {
+			level uint64
+			reorg bool
+		}{{100, false}, {101, false}, {100, true}, {101, false}, {102, false}}
+		for _, e := range expected {
+			select {
+			case err := <-errorChan:
+				assert.Fail(t, "Unexpected error", err)
+			case msg := <-dataChan:
+				assert.Equal(t, e.level, msg.Level)
+				assert.Equal(t, e.reorg, msg.Reorg)
+				if msg.Reorg {
+					mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(101), uint64(101), mock.Anything).Return(nil).Once()
+					rollbackChan <- msg.Level
+				}
+			case <-ctx.Done():
+				assert.Fail(t, "Timeout waiting for level", e.level)
+			}
+		}
+
+		mockTzktInstance.AssertExpectations(t)
+	})
 	t.Run("Subscribe to head error", func(t *testing.T) {
 
 		mockTzktInstance := new(mockTzkt)
@@ -105,7 +387,7 @@ func TestPoller_Run(t *testing.T) {
 
 		cfg := &mockConfig{}
 
-		poller := NewPoller(mockTzktInstance, dataChan, mockStoreInstance, cfg, errorChan)
+		poller := NewPoller(mockTzktInstance, dataChan, make(chan uint64), mockStoreInstance, cfg, errorChan)
 
 		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 		defer cancel()
@@ -116,30 +398,114 @@ func TestPoller_Run(t *testing.T) {
 		mockTzktInstance.AssertExpectations(t)
 
 	})
-	t.Run("Get current level error", func(t *testing.T) {
+	t.Run("Reconnects forever when configured", func(t *testing.T) {
+		mockTzktInstance := new(mockTzkt)
+		mockStoreInstance := new(mockStore)
+		errorChan := make(chan error)
+		calls := make(chan struct{}, 10)
+
+		mockTzktInstance.On("SubscribeToHead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			errorChan := args.Get(3).(chan<- error)
+			errorChan <- errors.New("couldn't connect to tzkt ws: connection failed")
+			calls <- struct{}{}
+		})
+
+		poller := NewPoller(mockTzktInstance, make(chan *types.ChanMsg), make(chan uint64), mockStoreInstance, &mockConfig{reconnectForever: true}, errorChan)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			poller.Run(ctx)
+			close(done)
+		}()
+
+		// more attempts than the configured retry attempts
+		for i := 0; i < 5; i++ {
+			<-calls
+		}
+		assert.Empty(t, errorChan)
+		cancel()
+		<-done
+	})
+	t.Run("Silent subscription is restarted", func(t *testing.T) {
+		mockTzktInstance := new(mockTzkt)
+		mockStoreInstance := new(mockStore)
+		dataChan := make(chan *types.ChanMsg, 10)
+		errorChan := make(chan error)
+		subscriptions := make(chan context.Context, 2)
+
+		mockStoreInstance.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 100, BlockHash: "BL100"}, nil)
+		mockStoreInstance.On("GetBlocks", mock.Anything, mock.Anything, 3).Return([]types.Block{}, nil)
+		// the first subscription sends the current head and nothing else
+		mockTzktInstance.On("SubscribeToHead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			subscriptions <- args.Get(0).(context.Context)
+			args.Get(2).(chan<- uint64) <- 100
+		}).Once()
+		mockTzktInstance.On("SubscribeToHead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			subscriptions <- args.Get(0).(context.Context)
+			args.Get(2).(chan<- uint64) <- 101
+		}).Once()
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(101), uint64(101), mock.Anything).Return(nil)
+
+		poller := NewPoller(mockTzktInstance, dataChan, make(chan uint64), mockStoreInstance, &mockConfig{headSilenceTimeout: 1}, errorChan)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		go poller.Run(ctx)
+
+		first := <-subscriptions
+		second := <-subscriptions
+		// the silent subscription is stopped and the missed level fetched
+		assert.Error(t, first.Err())
+		assert.NoError(t, second.Err())
+		assert.Equal(t, uint64(101), (<-dataChan).Level)
+		assert.Empty(t, errorChan)
+	})
+	t.Run("Decode error is not retried", func(t *testing.T) {
+		mockTzktInstance := new(mockTzkt)
+		mockStoreInstance := new(mockStore)
+		errorChan := make(chan error)
+
+		mockTzktInstance.On("SubscribeToHead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			errorChan := args.Get(3).(chan<- error)
+			errorChan <- fmt.Errorf("%w: unexpected head", types.ErrDecode)
+		})
+
+		poller := NewPoller(mockTzktInstance, make(chan *types.ChanMsg), make(chan uint64), mockStoreInstance, &mockConfig{}, errorChan)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		go poller.Run(ctx)
+
+		assert.ErrorIs(t, <-errorChan, types.ErrDecode)
+		mockTzktInstance.AssertNumberOfCalls(t, "SubscribeToHead", 1)
+	})
+	t.Run("Get checkpoint error", func(t *testing.T) {
 
 		mockTzktInstance := new(mockTzkt)
 		mockStoreInstance := new(mockStore)
 		dataChan := make(chan *types.ChanMsg)
 		errorChan := make(chan error)
 
-		mockStoreInstance.On("GetCurrentLevel", mock.Anything).Return(uint64(100), errors.New("db error"))
+		mockStoreInstance.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 100}, errors.New("db error"))
+		mockStoreInstance.On("GetBlocks", mock.Anything, mock.Anything, 3).Return([]types.Block{}, nil)
 		mockTzktInstance.On("SubscribeToHead", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 			currentHead := args.Get(2).(chan<- uint64)
 			currentHead <- 101
 		})
-		mockTzktInstance.On("GetDelegationsByLevel", mock.Anything, uint64(101), mock.Anything).Return(nil)
 
 		cfg := &mockConfig{}
 
-		poller := NewPoller(mockTzktInstance, dataChan, mockStoreInstance, cfg, errorChan)
+		poller := NewPoller(mockTzktInstance, dataChan, make(chan uint64), mockStoreInstance, cfg, errorChan)
 
 		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 		defer cancel()
 		go poller.Run(ctx)
 
 		// no retries for db errors
-		assert.Equal(t, (<-errorChan).Error(), "Error getting current database level: db error")
+		err := <-errorChan
+		assert.ErrorIs(t, err, types.ErrStorage)
+		assert.EqualError(t, err, "storage error: Error getting checkpoint: db error")
 
 		mockStoreInstance.AssertExpectations(t)
 		mockTzktInstance.AssertExpectations(t)
@@ -148,26 +514,228 @@ func TestPoller_Run(t *testing.T) {
 
 }
 
+func TestPoller_reconnectDelay(t *testing.T) {
+	poller := NewPoller(new(mockTzkt), nil, nil, new(mockStore), &mockConfig{}, nil)
+
+	for attempt, maxDelay := range []time.Duration{10, 20, 40, 40, 40} {
+		maxDelay *= time.Millisecond
+		delay := poller.reconnectDelay(attempt)
+		assert.GreaterOrEqual(t, delay, maxDelay/2)
+		assert.LessOrEqual(t, delay, maxDelay)
+	}
+	assert.LessOrEqual(t, poller.reconnectDelay(100), 40*time.Millisecond)
+
+	// long delays reach the maximum without overflowing
+	poller = NewPoller(new(mockTzkt), nil, nil, new(mockStore), &mockConfig{reconnectDelay: 30_000, maxReconnectDelay: 3_600_000}, nil)
+	for attempt := 0; attempt < 100; attempt++ {
+		delay := poller.reconnectDelay(attempt)
+		assert.GreaterOrEqual(t, delay, 15*time.Second)
+		assert.LessOrEqual(t, delay, time.Hour)
+	}
+	assert.GreaterOrEqual(t, poller.reconnectDelay(40), 30*time.Minute)
+}
+
 func TestPoller_getPastDelegations(t *testing.T) {
+	t.Run("Fetch error", func(t *testing.T) {
+		mockTzktInstance := new(mockTzkt)
+		mockStoreInstance := new(mockStore)
+		dataChan := make(chan *types.ChanMsg, 3)
+		errorChan := make(chan error)
+
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(101), uint64(101), mock.Anything).Return(nil)
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(102), uint64(102), mock.Anything).Return(nil)
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(103), uint64(103), mock.Anything).Return(errors.New("some error"))
+
+		cfg := &mockConfig{}
+
+		poller := NewPoller(mockTzktInstance, dataChan, make(chan uint64), mockStoreInstance, cfg, errorChan)
+
+		ctx := context.Background()
+		err := poller.getPastDelegations(ctx, 101, 103)
+
+		assert.EqualError(t, err, "Error fetching delegations for levels 103 to 103: some error")
+		assert.Equal(t, (<-dataChan).Level, uint64(101))
+		assert.Equal(t, (<-dataChan).Level, uint64(102))
+
+		mockTzktInstance.AssertExpectations(t)
+	})
+
+	t.Run("Ordered delivery", func(t *testing.T) {
+		mockTzktInstance := new(mockTzkt)
+		mockStoreInstance := new(mockStore)
+		dataChan := make(chan *types.ChanMsg, 4)
+		errorChan := make(chan error)
+
+		// the first range is the slowest, it should still be delivered first
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(101), uint64(101), mock.Anything).Return(nil).After(100 * time.Millisecond)
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(102), uint64(102), mock.Anything).Return(nil)
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(103), uint64(103), mock.Anything).Return(nil)
+		mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(104), uint64(104), mock.Anything).Return(nil)
+
+		cfg := &mockConfig{}
+
+		poller := NewPoller(mockTzktInstance, dataChan, make(chan uint64), mockStoreInstance, cfg, errorChan)
+
+		err := poller.getPastDelegations(context.Background(), 101, 104)
+		assert.NoError(t, err)
+		for level := uint64(101); level <= 104; level++ {
+			assert.Equal(t, level, (<-dataChan).Level)
+		}
+
+		mockTzktInstance.AssertExpectations(t)
+	})
+}
+
+func TestPoller_getPastDelegations_rangeLimiter(t *testing.T) {
 	mockTzktInstance := new(mockTzkt)
-	mockStoreInstance := new(mockStore)
 	dataChan := make(chan *types.ChanMsg, 3)
-	errorChan := make(chan error)
 
-	mockTzktInstance.On("GetDelegationsByLevel", mock.Anything, uint64(101), mock.Anything).Return(nil)
-	mockTzktInstance.On("GetDelegationsByLevel", mock.Anything, uint64(102), mock.Anything).Return(nil)
-	mockTzktInstance.On("GetDelegationsByLevel", mock.Anything, uint64(103), mock.Anything).Return(errors.New("some error"))
+	// the source fetches levels one by one, the range is split per level whatever the batch size
+	mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(101), uint64(101), mock.Anything).Return(nil)
+	mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(102), uint64(102), mock.Anything).Return(nil)
+	mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(103), uint64(103), mock.Anything).Return(nil)
 
-	cfg := &mockConfig{}
+	poller := NewPoller(&mockNode{mockTzkt: mockTzktInstance, maxRangeSize: 1}, dataChan, make(chan uint64), new(mockStore), &mockConfig{batchSize: 10}, make(chan error))
 
-	poller := NewPoller(mockTzktInstance, dataChan, mockStoreInstance, cfg, errorChan)
+	err := poller.getPastDelegations(context.Background(), 101, 103)
+	assert.NoError(t, err)
+	for level := uint64(101); level <= 103; level++ {
+		assert.Equal(t, level, (<-dataChan).Level)
+	}
 
-	ctx := context.Background()
-	err := poller.getPastDelegations(ctx, 101, 103)
+	mockTzktInstance.AssertExpectations(t)
+}
 
-	assert.EqualError(t, err, "Error fetching delegations for level 103: some error")
-	assert.Equal(t, (<-dataChan).Level, uint64(101))
-	assert.Equal(t, (<-dataChan).Level, uint64(102))
+func TestPoller_getPastDelegations_copy(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
 
+	mockTzktInstance := new(mockTzkt)
+	mockTzktInstance.On("GetDelegationsByRange", mock.Anything, uint64(101), uint64(110), mock.Anything).Return(nil)
+
+	// the range is saved in a single transaction, its delegations are above the bulk threshold
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec(regexp.QuoteMeta("CREATE TEMP TABLE delegations_staging")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := sqlMock.ExpectPrepare(regexp.QuoteMeta(`COPY "delegations_staging"`))
+	for level := uint64(101); level <= 110; level++ {
+		prep.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	prep.ExpectExec().WithoutArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlMock.ExpectExec(regexp.QuoteMeta("FROM delegations_staging")).
+		WillReturnResult(sqlmock.NewResult(0, 10))
+	sqlMock.ExpectExec(regexp.QuoteMeta("UPDATE checkpoint")).
+		WithArgs(uint64(110), "BL110").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for level := uint64(101); level <= 110; level++ {
+		sqlMock.ExpectExec(regexp.QuoteMeta("INSERT INTO processed_levels")).
+			WithArgs(level).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectExec(regexp.QuoteMeta("INSERT INTO blocks")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectExec(regexp.QuoteMeta("UPDATE orphaned_delegations")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	sqlMock.ExpectCommit()
+	sqlMock.ExpectExec(regexp.QuoteMeta("UPDATE delegations SET finality")).
+		WithArgs(uint64(108), types.FinalityFinal, types.FinalityPending).
+		WillReturnResult(sqlmock.NewResult(0, 8))
+
+	dataChan := make(chan *types.ChanMsg, 10)
+	errorChan := make(chan error, 1)
+	cfg := &mockConfig{batchSize: 10, saveBatchSize: 10}
+	poller := NewPoller(mockTzktInstance, dataChan, make(chan uint64), new(mockStore), cfg, errorChan)
+	assert.NoError(t, poller.getPastDelegations(context.Background(), 101, 110))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go processor.NewProcessor(store.NewPostgresStoreFromDB(db, 5), dataChan, make(chan uint64), errorChan, cfg).Run(ctx)
+
+	assert.Eventually(t, func() bool { return sqlMock.ExpectationsWereMet() == nil }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, sqlMock.ExpectationsWereMet())
+	assert.Empty(t, errorChan)
 	mockTzktInstance.AssertExpectations(t)
 }
+
+// fakeTzktConfig loads a configuration whose TzKT instance is the given url.
+func fakeTzktConfig(t *testing.T, url string) *config.TzktConfig {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := fmt.Sprintf(`
+server: {host: localhost, port: 8080, metricsPort: 8081, minValidYear: 2018}
+log: {level: info}
+tzkt: {timeout: 10, url: "%s", retryAttempts: 3, retryDelay: 10}
+db: {user: postgres, dbname: delegations, password: postgres, host: localhost, port: 5432}
+poller: {startLevel: 1, retryAttempts: 3}
+`, url)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Tzkt
+}
+
+func TestPoller_FakeTzkt(t *testing.T) {
+	server := tzkttest.NewServer(100)
+	defer server.Close()
+	delegation := types.FetchedDelegation{Sender: types.Sender{Address: "tz1"}, Amount: 1234}
+	for i := 0; i < 3; i++ {
+		server.AppendBlock(delegation)
+	}
+
+	mockStoreInstance := new(mockStore)
+	mockStoreInstance.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 100, BlockHash: "BL100"}, nil)
+	mockStoreInstance.On("GetBlocks", mock.Anything, mock.Anything, 3).Return([]types.Block{{Level: 100, Hash: "BL100"}}, nil)
+
+	dataChan := make(chan *types.ChanMsg)
+	rollbackChan := make(chan uint64)
+	errorChan := make(chan error, 1)
+	poller := NewPoller(tzkt.NewClient(fakeTzktConfig(t, server.URL)), dataChan, rollbackChan, mockStoreInstance, &mockConfig{}, errorChan)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go poller.Run(ctx)
+
+	receive := func() *types.ChanMsg {
+		select {
+		case msg := <-dataChan:
+			return msg
+		case err := <-errorChan:
+			t.Fatalf("Unexpected error: %v", err)
+		case <-ctx.Done():
+			t.Fatal("Timeout waiting for a message")
+		}
+		return nil
+	}
+
+	// the levels baked before the subscription are fetched over HTTP
+	for _, level := range []uint64{101, 102, 103} {
+		msg := receive()
+		assert.Equal(t, level, msg.Level)
+		assert.Equal(t, fmt.Sprintf("BL%d", level), msg.BlockHash)
+		assert.Equal(t, fmt.Sprintf("BL%d", level-1), msg.Predecessor)
+		assert.Len(t, msg.Data, 1)
+	}
+
+	server.AppendBlock(delegation)
+	msg := receive()
+	assert.Equal(t, uint64(104), msg.Level)
+	assert.Equal(t, "BL103", msg.Predecessor)
+
+	server.Reorg(103)
+	msg = receive()
+	assert.True(t, msg.Reorg)
+	assert.Equal(t, uint64(103), msg.Level)
+	rollbackChan <- 103
+
+	server.AppendBlock(delegation)
+	msg = receive()
+	assert.Equal(t, uint64(104), msg.Level)
+	assert.Equal(t, "BL104r1", msg.BlockHash)
+	assert.Equal(t, "BL103", msg.Predecessor)
+}
@@ -2,42 +2,80 @@ package poller
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"time"
 
+	"github.com/safwentrabelsi/tezos-delegation-watcher/metrics"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/tzkt"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/utils"
 	"github.com/sirupsen/logrus"
 )
 
 type storeInterface interface {
-	GetCurrentLevel(ctx context.Context) (uint64, error)
+	GetCheckpoint(ctx context.Context) (types.Checkpoint, error)
+	GetBlocks(ctx context.Context, maxLevel uint64, limit int) ([]types.Block, error)
 }
 
 type configInterface interface {
 	GetStartLevel() uint64
 	GetRetryAttempts() int
 	GetFetchOld() bool
+	GetConcurrency() int
+	GetBatchSize() uint64
+	GetMaxReorgDepth() int
+	GetReconnectDelay() int
+	GetMaxReconnectDelay() int
+	GetReconnectForever() bool
+	GetHealthyAfter() int
+	GetHeadSilenceTimeout() int
 }
 
 type poller struct {
-	tzkt      tzkt.TzktInterface
-	dataChan  chan<- *types.ChanMsg
-	store     storeInterface
-	cfg       configInterface
-	errorChan chan<- error
+	tzkt         tzkt.TzktInterface
+	dataChan     chan<- *types.ChanMsg
+	rollbackChan <-chan uint64
+	store        storeInterface
+	cfg          configInterface
+	errorChan    chan<- error
+	// lastLevel is the last level delivered to the data channel
+	lastLevel uint64
+	// recentHashes holds the hashes of the last delivered blocks by level
+	recentHashes map[uint64]string
+	// degraded is set while the poller recovers from connection failures
+	degraded bool
+}
+
+// rangeJob is a level range fetched by a backfill worker. Its messages are buffered
+// until all the ranges below it have been delivered to the data channel.
+type rangeJob struct {
+	startLevel uint64
+	endLevel   uint64
+	msgs       chan *types.ChanMsg
+	done       chan error
+}
+
+// rangeLimiter is implemented by the sources fetching a range level by level. The backfill splits the ranges
+// to their size, so the levels are fetched concurrently by the workers instead of one after the other.
+type rangeLimiter interface {
+	MaxRangeSize() uint64
 }
 
 var log = logrus.WithField("module", "poller")
 
 // NewPoller creates a new Poller instance with the necessary dependencies.
-func NewPoller(tzkt tzkt.TzktInterface, dataChan chan<- *types.ChanMsg, store storeInterface, cfg configInterface, errorChan chan<- error) *poller {
+// The rollback channel receives the levels the processor rolled back to after a reorg.
+func NewPoller(tzkt tzkt.TzktInterface, dataChan chan<- *types.ChanMsg, rollbackChan <-chan uint64, store storeInterface, cfg configInterface, errorChan chan<- error) *poller {
 	return &poller{
-		tzkt:      tzkt,
-		dataChan:  dataChan,
-		store:     store,
-		cfg:       cfg,
-		errorChan: errorChan,
+		tzkt:         tzkt,
+		dataChan:     dataChan,
+		rollbackChan: rollbackChan,
+		store:        store,
+		cfg:          cfg,
+		errorChan:    errorChan,
+		recentHashes: make(map[uint64]string),
 	}
 }
 
@@ -50,43 +88,87 @@ func (p *poller) Run(ctx context.Context) {
 	attempt := 0
 
 	connect := func() error {
+		// the channels are not closed as the subscription may still be sending when connect returns,
+		// it stops once its context is canceled
 		currentHead := make(chan uint64)
-		defer close(currentHead)
-
 		errChan := make(chan error, 1)
-		defer close(errChan)
+		subCtx, stopSubscription := context.WithCancel(ctx)
+		defer stopSubscription()
 
-		go p.tzkt.SubscribeToHead(ctx, p.dataChan, currentHead, errChan)
+		// the reconnection attempts are reset once the connection stays up long enough
+		healthy := time.After(time.Duration(p.cfg.GetHealthyAfter()) * time.Second)
+
+		// the watchdog restarts the subscription when no head is received, which happens when
+		// a proxy keeps the ws open while nothing is delivered anymore
+		silenceTimeout := time.Duration(p.cfg.GetHeadSilenceTimeout()) * time.Second
+		watchdog := time.NewTimer(silenceTimeout)
+		defer watchdog.Stop()
+
+		// live messages are held until the past delegations are delivered, so the processor
+		// always receives levels in ascending order and the checkpoint never skips a level.
+		liveChan := make(chan *types.ChanMsg, 100)
+
+		go p.tzkt.SubscribeToHead(subCtx, liveChan, currentHead, errChan)
 
 		for {
 			select {
-			// if there is a problem with SubscribeToHead the connect function will return an error
-			// and before this error is pushed to the main error channel we retry to connect
+			// if there is a problem with SubscribeToHead or while fetching the delegations the connect function
+			// returns an error, the ones that can be solved by reconnecting are retried before being pushed to the main error channel
 			case err := <-errChan:
 				return err
 			// to be sure there is no delta between past blocks and blocks comming from the ws
 			case headLevel := <-currentHead:
-				// if fetchOld is true in config we proceed to fetch old delegations from the startLevel or the current db level.
+				// the chain may have been reorganized while we were not connected
+				if err := p.verifyChain(ctx, headLevel); err != nil {
+					return fmt.Errorf("Error verifying processed blocks: %w", err)
+				}
+				// if fetchOld is true in config we proceed to fetch old delegations from the startLevel or the checkpoint level.
 				if p.cfg.GetFetchOld() {
 					log.Info("Fetching old delegations is activated")
-					dbLevel, err := p.store.GetCurrentLevel(ctx)
+					checkpoint, err := p.store.GetCheckpoint(ctx)
 					if err != nil {
-						p.errorChan <- fmt.Errorf("Error getting current database level: %v", err)
+						return fmt.Errorf("%w: Error getting checkpoint: %w", types.ErrStorage, err)
 					}
-					log.Infof("Database level retrieved: %d", dbLevel)
+					log.Infof("Checkpoint level retrieved: %d", checkpoint.Level)
 					log.Infof("Received chain current head level: %d", headLevel)
 
-					startLevel := max(dbLevel+1, p.cfg.GetStartLevel())
-					if headLevel > dbLevel {
+					startLevel := max(checkpoint.Level+1, p.cfg.GetStartLevel())
+					if headLevel > checkpoint.Level {
 						log.Debugf("Fetching past delegations from level %d to %d", startLevel, headLevel)
 						if err := p.getPastDelegations(ctx, startLevel, headLevel); err != nil {
-							p.errorChan <- fmt.Errorf("Error fetching past delegations: %v", err)
+							return fmt.Errorf("Error fetching past delegations: %w", err)
 						}
 						log.Infof("Past delegations successfully fetched and processed from level %d to %d", startLevel, headLevel)
 					}
+				} else if p.lastLevel > 0 && headLevel > p.lastLevel {
+					// levels missed while reconnecting are fetched even if old delegations are not
+					log.Infof("Fetching delegations for levels %d to %d missed while reconnecting", p.lastLevel+1, headLevel)
+					if err := p.getPastDelegations(ctx, p.lastLevel+1, headLevel); err != nil {
+						return fmt.Errorf("Error fetching missed delegations: %w", err)
+					}
 				} else {
 					log.Info("Fetching old delegations is deactivated, Only new delegations will be processed")
 				}
+				p.lastLevel = headLevel
+				resetTimer(watchdog, silenceTimeout)
+
+			case msg := <-liveChan:
+				if err := p.deliverLive(ctx, msg); err != nil {
+					return fmt.Errorf("Error fetching missed delegations: %w", err)
+				}
+				resetTimer(watchdog, silenceTimeout)
+
+			case <-watchdog.C:
+				log.Warnf("No head received for %v, restarting the subscription", silenceTimeout)
+				metrics.HeadSilenceCountInc()
+				return fmt.Errorf("%w: no head received for %v", types.ErrTransport, silenceTimeout)
+
+			case <-healthy:
+				if attempt > 0 {
+					log.Infof("Connection healthy for %ds, resetting reconnection attempts", p.cfg.GetHealthyAfter())
+					attempt = 0
+				}
+				p.setDegraded(false)
 
 			case <-ctx.Done():
 				log.Info("Poller shutdown initiated, stopping operations")
@@ -103,29 +185,208 @@ func (p *poller) Run(ctx context.Context) {
 			log.Debug("Stopping reconnection attempts")
 			return
 		}
+		if !retryable(err) {
+			// the same error would happen again after reconnecting, the service is shut down
+			p.errorChan <- err
+			return
+		}
 		// The retry logic is here  and not in the tzkt module  because we should be aware in case of block delta when the connection was closed
-		if attempt < p.cfg.GetRetryAttempts() {
-			waitTime := 1 * time.Second
-			log.Errorf("Attempt %d: Connection failed with error: %v. Retrying in %v...", attempt+1, err, waitTime)
-			time.Sleep(waitTime)
-			attempt++
-		} else {
+		if attempt >= p.cfg.GetRetryAttempts() && !p.cfg.GetReconnectForever() {
 			// if we attempted max retries with no success we push the error to the main errorChan which will stop the server
-			p.errorChan <- fmt.Errorf("maximum reconnection attempts reached: %v", err)
+			p.errorChan <- fmt.Errorf("maximum reconnection attempts reached: %w", err)
 			return
 		}
+		if attempt == p.cfg.GetRetryAttempts() {
+			log.Warnf("Maximum reconnection attempts reached, reconnecting until the connection is healthy again")
+		}
+		p.setDegraded(true)
+
+		waitTime := p.reconnectDelay(attempt)
+		log.Errorf("Attempt %d: Connection failed with error: %v. Retrying in %v...", attempt+1, err, waitTime)
+		select {
+		case <-time.After(waitTime):
+		case <-ctx.Done():
+			return
+		}
+		attempt++
+	}
+}
+
+// reconnectDelay returns the delay before a reconnection: an exponential backoff capped
+// at the maximum delay, half of it randomized so restarted watchers don't reconnect together.
+func (p *poller) reconnectDelay(attempt int) time.Duration {
+	delay := utils.Backoff(time.Duration(p.cfg.GetReconnectDelay())*time.Millisecond,
+		time.Duration(p.cfg.GetMaxReconnectDelay())*time.Millisecond, uint(attempt))
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// resetTimer restarts a timer that may have fired already.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// setDegraded reports whether the poller is recovering from connection failures.
+func (p *poller) setDegraded(degraded bool) {
+	if p.degraded == degraded {
+		return
+	}
+	p.degraded = degraded
+	if degraded {
+		log.Warn("Poller degraded, recovering from connection failures")
+	} else {
+		log.Info("Poller recovered")
+	}
+	metrics.SetPollerDegraded(degraded)
+}
+
+// retryable reports whether an error may be solved by reconnecting. Store failures, unreconciled reorgs
+// and unexpected or undecodable data are not, transport errors and unclassified errors are.
+func retryable(err error) bool {
+	for _, class := range []error{types.ErrStorage, types.ErrReorg, types.ErrDecode, types.ErrProtocol} {
+		if errors.Is(err, class) {
+			return false
+		}
+	}
+	return true
+}
+
+// deliverLive forwards a message received from the ws to the processor.
+// Levels missed by the ws are fetched first. After a reorg the poller waits for the processor to roll back
+// the store, the replaced levels are then fetched again from the canonical chain before the next head is delivered.
+func (p *poller) deliverLive(ctx context.Context, msg *types.ChanMsg) error {
+	if msg.Reorg {
+		p.rollback(ctx, msg.Level)
+		return nil
+	}
+
+	if p.diverges(msg) {
+		// the ws didn't notify this reorg, the last block shared with the processed chain is looked up
+		blocks, err := p.knownBlocks(ctx, msg.Level)
+		if err != nil {
+			return err
+		}
+		ancestor, err := p.findCommonAncestor(ctx, blocks)
+		if err != nil {
+			return err
+		}
+		log.Warnf("Block %s at level %d doesn't extend the processed chain, rolling back to level %d", msg.BlockHash, msg.Level, ancestor)
+		p.rollback(ctx, ancestor)
+	} else if msg.Level <= p.lastLevel {
+		log.Debugf("Level %d was already delivered, skipping it", msg.Level)
+		return nil
+	}
+
+	if p.lastLevel > 0 && msg.Level > p.lastLevel+1 {
+		log.Infof("Fetching delegations for levels %d to %d missing before level %d", p.lastLevel+1, msg.Level-1, msg.Level)
+		if err := p.getPastDelegations(ctx, p.lastLevel+1, msg.Level-1); err != nil {
+			return err
+		}
+	}
+
+	p.send(ctx, msg)
+	return nil
+}
+
+// send delivers a message to the processor and keeps track of the delivered chain.
+func (p *poller) send(ctx context.Context, msg *types.ChanMsg) bool {
+	select {
+	case p.dataChan <- msg:
+	case <-ctx.Done():
+		return false
+	}
+
+	if !msg.Reorg {
+		p.lastLevel = msg.Level
+		p.rememberHash(msg.Level, msg.BlockHash)
+	}
+	return true
+}
+
+// rollback asks the processor to roll the store back to the given level and waits until it is done.
+func (p *poller) rollback(ctx context.Context, level uint64) {
+	if !p.send(ctx, &types.ChanMsg{Level: level, Reorg: true}) {
+		return
+	}
+
+	select {
+	case level := <-p.rollbackChan:
+		log.Infof("Store rolled back to level %d, replaced levels will be fetched again", level)
+		p.lastLevel = level
+		p.forgetHashesAbove(level)
+	case <-ctx.Done():
 	}
 }
 
 // getPastDelegations fetches delegations from the provided start level to the end level.
+// The range is split in batches fetched concurrently, results are delivered in ascending level order.
 func (p *poller) getPastDelegations(ctx context.Context, startLevel, endLevel uint64) error {
-	for i := startLevel; i <= endLevel; i++ {
-		log.Debugf("Fetching delegations for level %d", i)
-		err := p.tzkt.GetDelegationsByLevel(ctx, i, p.dataChan)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batchSize := max(p.cfg.GetBatchSize(), 1)
+	if limiter, ok := p.tzkt.(rangeLimiter); ok {
+		batchSize = max(min(batchSize, limiter.MaxRangeSize()), 1)
+	}
+	// the queue keeps the jobs in level order and its capacity bounds the number of ranges in flight,
+	// the job being delivered counts as one of them.
+	queue := make(chan *rangeJob, max(p.cfg.GetConcurrency(), 1)-1)
+
+	go func() {
+		defer close(queue)
+		for from := startLevel; from <= endLevel; from += batchSize {
+			job := &rangeJob{
+				startLevel: from,
+				endLevel:   min(from+batchSize-1, endLevel),
+				done:       make(chan error, 1),
+			}
+			// a range holds at most one message per level so workers never block on it
+			job.msgs = make(chan *types.ChanMsg, job.endLevel-job.startLevel+1)
+
+			select {
+			case queue <- job:
+			case <-ctx.Done():
+				return
+			}
+
+			go func() {
+				log.Debugf("Fetching delegations for levels %d to %d", job.startLevel, job.endLevel)
+				job.done <- p.tzkt.GetDelegationsByRange(ctx, job.startLevel, job.endLevel, job.msgs)
+			}()
+		}
+	}()
+
+	for job := range queue {
+		var err error
+		select {
+		case err = <-job.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		if err != nil {
-			log.Errorf("Failed fetching delegations for level %d: %v", i, err)
-			return fmt.Errorf("Error fetching delegations for level %d: %v", i, err)
+			log.Errorf("Failed fetching delegations for levels %d to %d: %v", job.startLevel, job.endLevel, err)
+			return fmt.Errorf("Error fetching delegations for levels %d to %d: %w", job.startLevel, job.endLevel, err)
 		}
+
+		close(job.msgs)
+		for msg := range job.msgs {
+			if !p.send(ctx, msg) {
+				return ctx.Err()
+			}
+		}
+		log.Debugf("Delegations delivered for levels %d to %d", job.startLevel, job.endLevel)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 	log.Infof("Delegations fetched for levels %d to %d", startLevel, endLevel)
 	return nil
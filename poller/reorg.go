@@ -0,0 +1,114 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+)
+
+// verifyChain compares the last processed blocks with the chain and rolls the store back to the
+// last common block if they diverged, which happens when a reorg occurs while the ws is disconnected.
+func (p *poller) verifyChain(ctx context.Context, headLevel uint64) error {
+	blocks, err := p.knownBlocks(ctx, headLevel)
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	ancestor, err := p.findCommonAncestor(ctx, blocks)
+	if err != nil {
+		return err
+	}
+	if ancestor == blocks[0].Level {
+		log.Debugf("Processed blocks up to level %d match the chain", ancestor)
+		return nil
+	}
+
+	log.Warnf("Processed block at level %d is no longer in the chain, rolling back to level %d", blocks[0].Level, ancestor)
+	p.rollback(ctx, ancestor)
+	return nil
+}
+
+// diverges reports whether the block of the message doesn't extend the delivered chain.
+func (p *poller) diverges(msg *types.ChanMsg) bool {
+	if hash, ok := p.recentHashes[msg.Level-1]; ok && msg.Predecessor != "" && hash != msg.Predecessor {
+		return true
+	}
+	if hash, ok := p.recentHashes[msg.Level]; ok && msg.BlockHash != "" && hash != msg.BlockHash {
+		return true
+	}
+	return false
+}
+
+// findCommonAncestor returns the highest of the given blocks that is still part of the chain.
+// The blocks must be sorted by descending level.
+func (p *poller) findCommonAncestor(ctx context.Context, blocks []types.Block) (uint64, error) {
+	for _, block := range blocks {
+		hash, err := p.tzkt.GetBlockHash(ctx, block.Level)
+		if err != nil {
+			return 0, fmt.Errorf("failed to fetch block hash at level %d: %w", block.Level, err)
+		}
+		if hash == block.Hash {
+			return block.Level, nil
+		}
+		log.Debugf("Block at level %d diverged: processed %s, chain %s", block.Level, block.Hash, hash)
+	}
+	return 0, fmt.Errorf("%w: no common ancestor found in the last %d processed blocks", types.ErrReorg, len(blocks))
+}
+
+// knownBlocks returns the last blocks delivered or stored below or at maxLevel, highest level first.
+// Blocks delivered recently may not be stored yet and take precedence over the stored ones.
+func (p *poller) knownBlocks(ctx context.Context, maxLevel uint64) ([]types.Block, error) {
+	depth := max(p.cfg.GetMaxReorgDepth(), 1)
+
+	stored, err := p.store.GetBlocks(ctx, maxLevel, depth)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to get processed blocks: %w", types.ErrStorage, err)
+	}
+
+	hashes := make(map[uint64]string, len(stored)+len(p.recentHashes))
+	for _, block := range stored {
+		hashes[block.Level] = block.Hash
+	}
+	for level, hash := range p.recentHashes {
+		if level <= maxLevel {
+			hashes[level] = hash
+		}
+	}
+
+	blocks := make([]types.Block, 0, len(hashes))
+	for level, hash := range hashes {
+		blocks = append(blocks, types.Block{Level: level, Hash: hash})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Level > blocks[j].Level })
+
+	return blocks[:min(len(blocks), depth)], nil
+}
+
+// rememberHash records the hash of a delivered block, only the blocks within the reorg depth are kept.
+func (p *poller) rememberHash(level uint64, hash string) {
+	if hash == "" {
+		return
+	}
+	p.recentHashes[level] = hash
+
+	depth := uint64(max(p.cfg.GetMaxReorgDepth(), 1))
+	for l := range p.recentHashes {
+		if l+depth <= level {
+			delete(p.recentHashes, l)
+		}
+	}
+}
+
+// forgetHashesAbove drops the hashes of the blocks rolled back.
+func (p *poller) forgetHashesAbove(level uint64) {
+	for l := range p.recentHashes {
+		if l > level {
+			delete(p.recentHashes, l)
+		}
+	}
+}
@@ -10,20 +10,30 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+type configInterface interface {
+	GetFinalityDepth() uint64
+	GetSaveBatchSize() uint64
+}
+
 type processor struct {
-	store       store.Storer
-	dataChannel <-chan *types.ChanMsg
-	errorChan   chan<- error
+	store        store.Storer
+	dataChannel  <-chan *types.ChanMsg
+	rollbackChan chan<- uint64
+	errorChan    chan<- error
+	cfg          configInterface
 }
 
 var log = logrus.WithField("module", "processor")
 
-// NewProcessor creates a new processor instance with the specified data store, data channel, and error channel.
-func NewProcessor(store store.Storer, dataChannel <-chan *types.ChanMsg, errorChan chan<- error) *processor {
+// NewProcessor creates a new processor instance with the specified data store, data channel, rollback channel and error channel.
+// The level of every completed rollback is sent on the rollback channel so the poller can fetch the replaced levels again.
+func NewProcessor(store store.Storer, dataChannel <-chan *types.ChanMsg, rollbackChan chan<- uint64, errorChan chan<- error, cfg configInterface) *processor {
 	return &processor{
-		store:       store,
-		dataChannel: dataChannel,
-		errorChan:   errorChan,
+		store:        store,
+		dataChannel:  dataChannel,
+		rollbackChan: rollbackChan,
+		errorChan:    errorChan,
+		cfg:          cfg,
 	}
 }
 
@@ -39,47 +49,102 @@ func (p *processor) Run(ctx context.Context) {
 			if msg == nil {
 				continue
 			}
-			if !msg.Reorg {
-				log.Infof("Received new delegations at level %d", msg.Level)
-				err := p.processDelegations(ctx, msg.Data)
-				if err != nil {
-					log.WithError(err).Error("Failed to process delegations")
-					p.errorChan <- err
-				}
-			} else {
-				log.Infof("Received reorg command for level %d", msg.Level)
-				metrics.ReorgMsgCountInc()
-				err := p.processReorg(ctx, msg.Level)
-				if err != nil {
-					log.WithError(err).Error("Failed to process reorg")
-					p.errorChan <- err
-				}
+			if msg.Reorg {
+				p.handleReorg(ctx, msg)
+				continue
+			}
+			batch, reorg := p.nextBatch(msg)
+			log.Infof("Received new delegations at levels %d to %d", batch[0].Level, batch[len(batch)-1].Level)
+			err := p.processDelegations(ctx, batch)
+			if err != nil {
+				log.WithError(err).Error("Failed to process delegations")
+				p.errorChan <- err
+			}
+			if reorg != nil {
+				p.handleReorg(ctx, reorg)
 			}
 		}
 	}
 }
 
-// processDelegations handles the processing of fetched delegations and attempts to save them through the store.
-func (p *processor) processDelegations(ctx context.Context, delegations []types.FetchedDelegation) error {
-	if len(delegations) == 0 {
-		log.Debug("No delegations to process")
-		return nil
+// nextBatch gathers the delegation messages already waiting behind msg, up to the save batch size, so the levels
+// of a backfilled range are saved together. A reorg message stops the batch and is returned to be handled after it.
+func (p *processor) nextBatch(msg *types.ChanMsg) ([]*types.ChanMsg, *types.ChanMsg) {
+	batch := []*types.ChanMsg{msg}
+	for uint64(len(batch)) < p.cfg.GetSaveBatchSize() {
+		select {
+		case next := <-p.dataChannel:
+			if next == nil {
+				return batch, nil
+			}
+			if next.Reorg {
+				return batch, next
+			}
+			batch = append(batch, next)
+		default:
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+// handleReorg processes a reorg message, reporting its failure on the error channel.
+func (p *processor) handleReorg(ctx context.Context, msg *types.ChanMsg) {
+	log.Infof("Received reorg command for level %d", msg.Level)
+	metrics.ReorgMsgCountInc()
+	err := p.processReorg(ctx, msg.Level)
+	if err != nil {
+		log.WithError(err).Error("Failed to process reorg")
+		p.errorChan <- err
+	}
+}
+
+// processDelegations saves the fetched delegations of a batch of levels through the store in a single call.
+// Every level of the batch is checkpointed even if it has no delegations, and the delegations buried under
+// the finality depth by the last block are promoted to final.
+func (p *processor) processDelegations(ctx context.Context, batch []*types.ChanMsg) error {
+	blocks := make([]types.Block, 0, len(batch))
+	var delegations []types.FetchedDelegation
+	for _, msg := range batch {
+		blocks = append(blocks, types.Block{
+			Level:       msg.Level,
+			Hash:        msg.BlockHash,
+			Predecessor: msg.Predecessor,
+		})
+		delegations = append(delegations, msg.Data...)
 	}
+	level := blocks[len(blocks)-1].Level
+
 	log.Infof("Processing %d delegations", len(delegations))
-	err := p.store.SaveDelegations(ctx, delegations)
+	err := p.store.SaveBlocks(ctx, blocks, delegations)
 	if err != nil {
-		return fmt.Errorf("failed to save delegations: %w", err)
+		return fmt.Errorf("%w: failed to save delegations: %w", types.ErrStorage, err)
 	}
-	log.Info("Delegations processed and saved successfully")
+	log.Infof("Delegations processed and saved successfully, checkpoint at level %d", level)
+
+	depth := p.cfg.GetFinalityDepth()
+	if level <= depth {
+		return nil
+	}
+	if err := p.store.FinalizeDelegations(ctx, level-depth); err != nil {
+		return fmt.Errorf("%w: failed to finalize delegations: %w", types.ErrStorage, err)
+	}
+	log.Debugf("Delegations up to level %d are final", level-depth)
 	return nil
 }
 
-// processReorg handles reorganization commands by deleting delegations from the store.
+// processReorg handles reorganization commands by rolling back the store to the given level
+// and notifying the poller that the replaced levels must be fetched again.
 func (p *processor) processReorg(ctx context.Context, level uint64) error {
 	log.Infof("Processing reorganization from block level %d", level)
-	err := p.store.DeleteDelegationsFromLevel(ctx, level)
+	err := p.store.RollbackToLevel(ctx, level)
 	if err != nil {
-		return fmt.Errorf("failed to delete delegations: %w", err)
+		return fmt.Errorf("%w: failed to rollback delegations: %w", types.ErrStorage, err)
+	}
+
+	select {
+	case p.rollbackChan <- level:
+	case <-ctx.Done():
 	}
 	log.Info("Reorganization processed successfully")
 	return nil
@@ -3,8 +3,11 @@ package processor
 import (
 	"context"
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/safwentrabelsi/tezos-delegation-watcher/store"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -14,62 +17,117 @@ type MockStore struct {
 	mock.Mock
 }
 
-func (m *MockStore) SaveDelegations(ctx context.Context, delegations []types.FetchedDelegation) error {
-	args := m.Called(ctx, delegations)
+func (m *MockStore) SaveDelegations(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) error {
+	args := m.Called(ctx, block, delegations)
 	return args.Error(0)
 }
 
-func (m *MockStore) DeleteDelegationsFromLevel(ctx context.Context, level uint64) error {
+func (m *MockStore) RepairLevel(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) (bool, error) {
+	args := m.Called(ctx, block, delegations)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockStore) SaveBlocks(ctx context.Context, blocks []types.Block, delegations []types.FetchedDelegation) error {
+	args := m.Called(ctx, blocks, delegations)
+	return args.Error(0)
+}
+
+func (m *MockStore) RollbackToLevel(ctx context.Context, level uint64) error {
 	args := m.Called(ctx, level)
 	return args.Error(0)
 }
 
-func (m *MockStore) GetCurrentLevel(ctx context.Context) (uint64, error) {
+func (m *MockStore) GetCheckpoint(ctx context.Context) (types.Checkpoint, error) {
 	args := m.Called(ctx)
-	return args.Get(0).(uint64), args.Error(1)
+	return args.Get(0).(types.Checkpoint), args.Error(1)
 }
 
-func (m *MockStore) GetDelegations(ctx context.Context, year string) ([]types.Delegation, error) {
-	args := m.Called(ctx, year)
+func (m *MockStore) GetDelegations(ctx context.Context, year string, finalOnly bool) ([]types.Delegation, error) {
+	args := m.Called(ctx, year, finalOnly)
 	return args.Get(0).([]types.Delegation), args.Error(1)
 }
 
+func (m *MockStore) QueryDelegations(ctx context.Context, query types.DelegationQuery) ([]types.Delegation, string, error) {
+	args := m.Called(ctx, query)
+	return args.Get(0).([]types.Delegation), args.String(1), args.Error(2)
+}
+
+func (m *MockStore) FinalizeDelegations(ctx context.Context, level uint64) error {
+	args := m.Called(ctx, level)
+	return args.Error(0)
+}
+
+func (m *MockStore) GetBlocks(ctx context.Context, maxLevel uint64, limit int) ([]types.Block, error) {
+	args := m.Called(ctx, maxLevel, limit)
+	return args.Get(0).([]types.Block), args.Error(1)
+}
+
+func (m *MockStore) GetOrphanedDelegations(ctx context.Context, limit int, cursor string) ([]types.OrphanedDelegation, string, error) {
+	args := m.Called(ctx, limit, cursor)
+	return args.Get(0).([]types.OrphanedDelegation), args.String(1), args.Error(2)
+}
+
+func (m *MockStore) SaveDiscrepancies(ctx context.Context, discrepancies []types.Discrepancy) error {
+	args := m.Called(ctx, discrepancies)
+	return args.Error(0)
+}
+
+func (m *MockStore) GetGaps(ctx context.Context, fromLevel, toLevel uint64) ([]types.LevelRange, error) {
+	args := m.Called(ctx, fromLevel, toLevel)
+	return args.Get(0).([]types.LevelRange), args.Error(1)
+}
+
+type mockConfig struct {
+	// the messages are saved one by one when unset
+	saveBatchSize uint64
+}
+
+func (m *mockConfig) GetFinalityDepth() uint64 { return 2 }
+func (m *mockConfig) GetSaveBatchSize() uint64 { return m.saveBatchSize }
+
 func TestProcessor_Run(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	mockStore := new(MockStore)
-	dataChan := make(chan *types.ChanMsg, 1)
+	memoryStore := store.NewMemoryStore()
+	dataChan := make(chan *types.ChanMsg)
 	errorChan := make(chan error, 1)
-	doneChan := make(chan bool, 1)
-	processor := NewProcessor(mockStore, dataChan, errorChan)
-
-	mockStore.On("SaveDelegations", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
-		doneChan <- true // Signal that SaveDelegations has completed
-	})
-	mockStore.On("DeleteDelegationsFromLevel", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
-		doneChan <- true // Signal that SaveDelegations has completed
-	})
+	rollbackChan := make(chan uint64)
 
+	processor := NewProcessor(memoryStore, dataChan, rollbackChan, errorChan, &mockConfig{})
 	go processor.Run(ctx)
 
-	dataChan <- &types.ChanMsg{
-		Reorg: false,
-		Level: 100,
-		Data:  []types.FetchedDelegation{{Timestamp: "2024-04-21T16:23:27Z", Amount: 1000, Sender: types.Sender{Address: "tz1"}, Level: 100}},
+	delegation := func(level uint64) []types.FetchedDelegation {
+		return []types.FetchedDelegation{{Hash: fmt.Sprintf("oo%d", level), Timestamp: "2024-04-21T16:23:27Z", Amount: 1000,
+			Sender: types.Sender{Address: "tz1"}, Level: level}}
 	}
-
-	<-doneChan // Wait for signal that processing has completed
-	mockStore.AssertCalled(t, "SaveDelegations", mock.Anything, mock.Anything)
-
-	dataChan <- &types.ChanMsg{
-		Reorg: true,
-		Level: 100,
+	dataChan <- &types.ChanMsg{Level: 100, BlockHash: "BL100", Predecessor: "BL99", Data: delegation(100)}
+	// empty levels are checkpointed too
+	dataChan <- &types.ChanMsg{Level: 101, BlockHash: "BL101", Predecessor: "BL100"}
+	dataChan <- &types.ChanMsg{Level: 102, BlockHash: "BL102", Predecessor: "BL101", Data: delegation(102)}
+	dataChan <- &types.ChanMsg{Level: 101, Reorg: true}
+	// the poller is notified once the rollback is done
+	assert.Equal(t, uint64(101), <-rollbackChan)
+
+	delegations, err := memoryStore.GetDelegations(ctx, "2024", false)
+	assert.NoError(t, err)
+	if assert.Len(t, delegations, 1) {
+		assert.Equal(t, "oo100", delegations[0].Hash)
+		assert.Equal(t, types.FinalityFinal, delegations[0].Finality, "block 100 is buried under the finality depth by block 102")
+	}
+	orphaned, _, err := memoryStore.GetOrphanedDelegations(ctx, 0, "")
+	assert.NoError(t, err)
+	if assert.Len(t, orphaned, 1) {
+		assert.Equal(t, "oo102", orphaned[0].Hash)
 	}
 
-	<-doneChan // Wait for signal that processing has completed
-	mockStore.AssertCalled(t, "DeleteDelegationsFromLevel", mock.Anything, uint64(100))
-
+	checkpoint, err := memoryStore.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Checkpoint{Level: 101, BlockHash: "BL101"}, checkpoint)
+	blocks, err := memoryStore.GetBlocks(ctx, 102, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Block{{Level: 101, Hash: "BL101", Predecessor: "BL100"}, {Level: 100, Hash: "BL100", Predecessor: "BL99"}}, blocks)
+	assert.Empty(t, errorChan)
 }
 
 func TestProcessor_DBError(t *testing.T) {
@@ -79,11 +137,12 @@ func TestProcessor_DBError(t *testing.T) {
 	mockStore := new(MockStore)
 	dataChan := make(chan *types.ChanMsg, 1)
 	errorChan := make(chan error, 1)
+	rollbackChan := make(chan uint64, 1)
 
-	processor := NewProcessor(mockStore, dataChan, errorChan)
+	processor := NewProcessor(mockStore, dataChan, rollbackChan, errorChan, &mockConfig{})
 
-	mockStore.On("SaveDelegations", mock.Anything, mock.Anything).Return(errors.New("DB error"))
-	mockStore.On("DeleteDelegationsFromLevel", mock.Anything, uint64(100)).Return(errors.New("DB error"))
+	mockStore.On("SaveBlocks", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("DB error"))
+	mockStore.On("RollbackToLevel", mock.Anything, uint64(100)).Return(errors.New("DB error"))
 
 	go processor.Run(ctx)
 
@@ -93,16 +152,101 @@ func TestProcessor_DBError(t *testing.T) {
 			Level: 100,
 			Data:  []types.FetchedDelegation{{Timestamp: "2024-04-21T16:23:27Z", Amount: 1000, Sender: types.Sender{Address: "tz1"}, Level: 100}},
 		}
-		assert.Equal(t, (<-errorChan).Error(), "failed to save delegations: DB error")
+		err := <-errorChan
+		assert.ErrorIs(t, err, types.ErrStorage)
+		assert.EqualError(t, err, "storage error: failed to save delegations: DB error")
 
 	})
-	t.Run("Delete error", func(t *testing.T) {
+	t.Run("Rollback error", func(t *testing.T) {
 		dataChan <- &types.ChanMsg{
 			Reorg: true,
 			Level: 100,
 		}
-		assert.Equal(t, (<-errorChan).Error(), "failed to delete delegations: DB error")
+		err := <-errorChan
+		assert.ErrorIs(t, err, types.ErrStorage)
+		assert.EqualError(t, err, "storage error: failed to rollback delegations: DB error")
+		assert.Empty(t, rollbackChan)
 
 	})
 
 }
+
+func TestProcessor_Finality(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockStore := new(MockStore)
+	dataChan := make(chan *types.ChanMsg, 1)
+	errorChan := make(chan error, 1)
+	rollbackChan := make(chan uint64, 1)
+
+	processor := NewProcessor(mockStore, dataChan, rollbackChan, errorChan, &mockConfig{})
+
+	mockStore.On("SaveBlocks", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockStore.On("FinalizeDelegations", mock.Anything, uint64(8)).Return(errors.New("DB error"))
+
+	go processor.Run(ctx)
+
+	// no block is buried under the finality depth yet
+	dataChan <- &types.ChanMsg{Level: 2}
+	dataChan <- &types.ChanMsg{Level: 10}
+
+	err := <-errorChan
+	assert.ErrorIs(t, err, types.ErrStorage)
+	assert.EqualError(t, err, "storage error: failed to finalize delegations: DB error")
+	mockStore.AssertNumberOfCalls(t, "SaveBlocks", 2)
+	mockStore.AssertNumberOfCalls(t, "FinalizeDelegations", 1)
+}
+
+// batchStore is a MemoryStore recording the levels of every batch saved.
+type batchStore struct {
+	*store.MemoryStore
+	batches [][]uint64
+}
+
+func (s *batchStore) SaveBlocks(ctx context.Context, blocks []types.Block, delegations []types.FetchedDelegation) error {
+	levels := make([]uint64, 0, len(blocks))
+	for _, block := range blocks {
+		levels = append(levels, block.Level)
+	}
+	s.batches = append(s.batches, levels)
+	return s.MemoryStore.SaveBlocks(ctx, blocks, delegations)
+}
+
+func TestProcessor_Batch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	batchStore := &batchStore{MemoryStore: store.NewMemoryStore()}
+	dataChan := make(chan *types.ChanMsg, 5)
+	errorChan := make(chan error, 1)
+	rollbackChan := make(chan uint64, 1)
+
+	// the messages waiting on the channel are saved together, up to the reorg
+	delegation := func(level uint64) []types.FetchedDelegation {
+		return []types.FetchedDelegation{{Hash: fmt.Sprintf("oo%d", level), Timestamp: "2024-04-21T16:23:27Z", Level: level}}
+	}
+	dataChan <- &types.ChanMsg{Level: 101, BlockHash: "BL101", Data: delegation(101)}
+	dataChan <- &types.ChanMsg{Level: 102, BlockHash: "BL102"}
+	dataChan <- &types.ChanMsg{Level: 103, BlockHash: "BL103", Data: delegation(103)}
+	dataChan <- &types.ChanMsg{Level: 103, Reorg: true}
+	dataChan <- &types.ChanMsg{Level: 104, BlockHash: "BL104"}
+
+	processor := NewProcessor(batchStore, dataChan, rollbackChan, errorChan, &mockConfig{saveBatchSize: 10})
+	go processor.Run(ctx)
+
+	assert.Equal(t, uint64(103), <-rollbackChan)
+	assert.Eventually(t, func() bool {
+		checkpoint, err := batchStore.GetCheckpoint(ctx)
+		return err == nil && checkpoint.Level == 104
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, [][]uint64{{101, 102, 103}, {104}}, batchStore.batches)
+	delegations, err := batchStore.GetDelegations(ctx, "2024", false)
+	assert.NoError(t, err)
+	assert.Len(t, delegations, 2)
+	final, err := batchStore.GetDelegations(ctx, "2024", true)
+	assert.NoError(t, err)
+	assert.Len(t, final, 1, "block 101 is buried under the finality depth")
+	assert.Empty(t, errorChan)
+}
@@ -0,0 +1,482 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storers creates the Storer implementations the conformance suite runs against. PostgreSQL is only tested
+// when STORE_TEST_POSTGRES_DSN points to a database the suite may wipe.
+func storers() map[string]func(t *testing.T) Storer {
+	factories := map[string]func(t *testing.T) Storer{
+		"memory": func(t *testing.T) Storer { return NewMemoryStore() },
+		"sqlite": func(t *testing.T) Storer { return newTestSQLiteStore(t) },
+	}
+	if dsn := os.Getenv("STORE_TEST_POSTGRES_DSN"); dsn != "" {
+		factories["postgres"] = func(t *testing.T) Storer {
+			db, err := sql.Open("postgres", dsn)
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+
+			// reverting every migration drops the data of the previous test
+			store := &PostgresStore{db: db}
+			require.NoError(t, store.MigrateTo(context.Background(), 0))
+			require.NoError(t, store.Migrate(context.Background()))
+			return store
+		}
+	}
+	return factories
+}
+
+func TestStorerConformance(t *testing.T) {
+	tests := map[string]func(t *testing.T, store Storer){
+		"Delegations":         testStorerDelegations,
+		"QueryDelegations":    testStorerQueryDelegations,
+		"Finality":            testStorerFinality,
+		"Checkpoint":          testStorerCheckpoint,
+		"SaveBlocks":          testStorerSaveBlocks,
+		"RepairLevel":         testStorerRepairLevel,
+		"BlocksAndGaps":       testStorerBlocksAndGaps,
+		"RollbackToLevel":     testStorerRollbackToLevel,
+		"ConcurrentSaves":     testStorerConcurrentSaves,
+		"EmptyStore":          testStorerEmpty,
+		"SaveDiscrepancies":   testStorerSaveDiscrepancies,
+		"OrphanedReplacement": testStorerOrphanedReplacement,
+		"OrphanedPaging":      testStorerOrphanedPaging,
+	}
+	for name, newStore := range storers() {
+		t.Run(name, func(t *testing.T) {
+			for test, run := range tests {
+				t.Run(test, func(t *testing.T) { run(t, newStore(t)) })
+			}
+		})
+	}
+}
+
+// delegationAt returns a delegation of the given level, identified by its hash.
+func delegationAt(level uint64, hash, timestamp string) types.FetchedDelegation {
+	return types.FetchedDelegation{ID: level*10 + uint64(len(hash)), Hash: hash, Counter: 7, Timestamp: timestamp, Amount: 100,
+		Sender: types.Sender{Address: "tz1"}, Status: "applied", Level: level}
+}
+
+func testStorerDelegations(t *testing.T, store Storer) {
+	ctx := context.Background()
+	nonce := uint64(1)
+	internal := delegationAt(10, "oo1", "2023-12-31T23:59:30Z")
+	internal.Nonce, internal.Sender.Address, internal.Amount = &nonce, "KT1", 200
+	baker := delegationAt(10, "oo1", "2023-12-31T23:59:30Z")
+	baker.NewDelegate = &types.Delegate{Address: "tz1baker"}
+
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 10, Hash: "BL10"}, []types.FetchedDelegation{baker, internal}))
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 11, Hash: "BL11"}, []types.FetchedDelegation{
+		delegationAt(11, "oo2", "2024-01-01T00:00:00Z"),
+	}))
+	// saving a level again updates its delegations instead of duplicating them
+	baker.Amount = 150
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 10, Hash: "BL10"}, []types.FetchedDelegation{baker, internal}))
+
+	all, err := store.GetDelegations(ctx, "", false)
+	assert.NoError(t, err)
+	require.Len(t, all, 3)
+	assert.Equal(t, "oo2", all[0].Hash, "the latest delegation comes first")
+	assert.Equal(t, "2024-01-01T00:00:00Z", all[0].Timestamp)
+
+	byYear, err := store.GetDelegations(ctx, "2023", false)
+	assert.NoError(t, err)
+	require.Len(t, byYear, 2)
+	amounts := map[string]uint64{}
+	for _, d := range byYear {
+		amounts[d.Delegator] = d.Amount
+		if d.Delegator == "tz1" {
+			assert.Equal(t, "tz1baker", *d.NewDelegate)
+			assert.Nil(t, d.PrevDelegate)
+		}
+	}
+	assert.Equal(t, map[string]uint64{"tz1": 150, "KT1": 200}, amounts)
+
+	none, err := store.GetDelegations(ctx, "2022", false)
+	assert.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+func testStorerQueryDelegations(t *testing.T, store Storer) {
+	ctx := context.Background()
+	for level := uint64(10); level <= 15; level++ {
+		d := delegationAt(level, fmt.Sprintf("oo%d", level), fmt.Sprintf("2024-04-21T16:%d:00Z", level))
+		d.Amount = level * 100
+		d.Sender.Address = fmt.Sprintf("tz%d", level%2)
+		if level%3 == 0 {
+			d.NewDelegate = &types.Delegate{Address: "tz1baker"}
+		}
+		// two delegations share the timestamp of level 13, the order falls back to the row id
+		if level == 14 {
+			d.Timestamp = "2024-04-21T16:13:00Z"
+		}
+		require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: level, Hash: fmt.Sprintf("BL%d", level)}, []types.FetchedDelegation{d}))
+	}
+	hashes := func(delegations []types.Delegation) []string {
+		var out []string
+		for _, d := range delegations {
+			out = append(out, d.Hash)
+		}
+		return out
+	}
+
+	for name, test := range map[string]struct {
+		query  types.DelegationQuery
+		hashes []string
+	}{
+		"Time range": {
+			query:  types.DelegationQuery{From: time.Date(2024, time.April, 21, 16, 11, 0, 0, time.UTC), To: time.Date(2024, time.April, 21, 16, 13, 0, 0, time.UTC)},
+			hashes: []string{"oo12", "oo11"},
+		},
+		"Level range":  {query: types.DelegationQuery{MinLevel: 14, MaxLevel: 15}, hashes: []string{"oo15", "oo14"}},
+		"Delegator":    {query: types.DelegationQuery{Delegator: "tz1"}, hashes: []string{"oo15", "oo13", "oo11"}},
+		"Baker":        {query: types.DelegationQuery{Baker: "tz1baker"}, hashes: []string{"oo15", "oo12"}},
+		"Amount range": {query: types.DelegationQuery{MinAmount: 1100, MaxAmount: 1200}, hashes: []string{"oo12", "oo11"}},
+		"Ascending":    {query: types.DelegationQuery{MinLevel: 12, Ascending: true}, hashes: []string{"oo12", "oo13", "oo14", "oo15"}},
+		"Same timestamp": {
+			query:  types.DelegationQuery{MinLevel: 13, MaxLevel: 14},
+			hashes: []string{"oo14", "oo13"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			delegations, cursor, err := store.QueryDelegations(ctx, test.query)
+			assert.NoError(t, err)
+			assert.Equal(t, test.hashes, hashes(delegations))
+			assert.Empty(t, cursor)
+		})
+	}
+
+	// paging through every delegation returns each of them once, in order
+	for _, ascending := range []bool{false, true} {
+		query := types.DelegationQuery{Ascending: ascending, Limit: 4}
+		var all []string
+		for pages := 0; pages < 5; pages++ {
+			page, cursor, err := store.QueryDelegations(ctx, query)
+			require.NoError(t, err)
+			all = append(all, hashes(page)...)
+			if cursor == "" {
+				break
+			}
+			query.Cursor = cursor
+		}
+		expected := []string{"oo15", "oo14", "oo13", "oo12", "oo11", "oo10"}
+		if ascending {
+			expected = []string{"oo10", "oo11", "oo12", "oo13", "oo14", "oo15"}
+		}
+		assert.Equal(t, expected, all)
+	}
+
+	_, _, err := store.QueryDelegations(ctx, types.DelegationQuery{Cursor: "not a cursor"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func testStorerFinality(t *testing.T, store Storer) {
+	ctx := context.Background()
+	for level := uint64(10); level <= 12; level++ {
+		require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: level, Hash: fmt.Sprintf("BL%d", level)}, []types.FetchedDelegation{
+			delegationAt(level, fmt.Sprintf("oo%d", level), fmt.Sprintf("2024-04-21T16:23:%dZ", level)),
+		}))
+	}
+
+	require.NoError(t, store.FinalizeDelegations(ctx, 11))
+	final, err := store.GetDelegations(ctx, "", true)
+	assert.NoError(t, err)
+	require.Len(t, final, 2)
+	for _, d := range final {
+		assert.Equal(t, types.FinalityFinal, d.Finality)
+	}
+
+	// saved again in its block a final delegation stays final, moved to another block it is pending again
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 10, Hash: "BL10"}, []types.FetchedDelegation{
+		delegationAt(10, "oo10", "2024-04-21T16:23:10Z"),
+	}))
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 12, Hash: "BL12"}, []types.FetchedDelegation{
+		delegationAt(12, "oo11", "2024-04-21T16:23:12Z"),
+	}))
+	final, err = store.GetDelegations(ctx, "", true)
+	assert.NoError(t, err)
+	require.Len(t, final, 1)
+	assert.Equal(t, "oo10", final[0].Hash)
+}
+
+func testStorerCheckpoint(t *testing.T, store Storer) {
+	ctx := context.Background()
+
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 10, Hash: "BL10", Predecessor: "BL9"}, nil))
+	checkpoint, err := store.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Checkpoint{Level: 10, BlockHash: "BL10"}, checkpoint)
+
+	// a repaired level below the checkpoint doesn't rewind it
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 5, Hash: "BL5", Predecessor: "BL4"}, nil))
+	checkpoint, err = store.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Checkpoint{Level: 10, BlockHash: "BL10"}, checkpoint)
+}
+
+func testStorerSaveBlocks(t *testing.T, store Storer) {
+	ctx := context.Background()
+	blocks := []types.Block{
+		{Level: 10, Hash: "BL10", Predecessor: "BL9"},
+		{Level: 11, Hash: "BL11", Predecessor: "BL10"},
+		{Level: 12, Hash: "BL12", Predecessor: "BL11"},
+	}
+	require.NoError(t, store.SaveBlocks(ctx, blocks, []types.FetchedDelegation{
+		delegationAt(10, "oo1", "2024-01-01T00:00:00Z"),
+		delegationAt(12, "oo2", "2024-01-01T00:01:00Z"),
+	}))
+
+	delegations, err := store.GetDelegations(ctx, "2024", false)
+	assert.NoError(t, err)
+	assert.Len(t, delegations, 2)
+
+	// every level of the batch is processed and the checkpoint is at the last one
+	checkpoint, err := store.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Checkpoint{Level: 12, BlockHash: "BL12"}, checkpoint)
+	stored, err := store.GetBlocks(ctx, 12, 10)
+	assert.NoError(t, err)
+	assert.Len(t, stored, 3)
+	gaps, err := store.GetGaps(ctx, 10, 12)
+	assert.NoError(t, err)
+	assert.Empty(t, gaps)
+
+	// an empty batch saves nothing
+	require.NoError(t, store.SaveBlocks(ctx, nil, nil))
+	checkpoint, err = store.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(12), checkpoint.Level)
+}
+
+func testStorerRepairLevel(t *testing.T, store Storer) {
+	ctx := context.Background()
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 10, Hash: "BL10"}, nil))
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 12, Hash: "BL12"}, nil))
+
+	saved, err := store.RepairLevel(ctx, types.Block{Level: 11, Hash: "BL11", Predecessor: "BL10"}, []types.FetchedDelegation{
+		delegationAt(11, "oo1", "2024-01-01T00:00:00Z"),
+	})
+	assert.NoError(t, err)
+	assert.True(t, saved)
+
+	// the repaired level is processed and the checkpoint stays at the last level
+	gaps, err := store.GetGaps(ctx, 10, 12)
+	assert.NoError(t, err)
+	assert.Empty(t, gaps)
+	delegations, err := store.GetDelegations(ctx, "2024", false)
+	assert.NoError(t, err)
+	assert.Len(t, delegations, 1)
+	checkpoint, err := store.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Checkpoint{Level: 12, BlockHash: "BL12"}, checkpoint)
+
+	// a level above the checkpoint, e.g. rolled back meanwhile, is not saved
+	saved, err = store.RepairLevel(ctx, types.Block{Level: 13, Hash: "BL13"}, []types.FetchedDelegation{
+		delegationAt(13, "oo2", "2024-01-01T00:01:00Z"),
+	})
+	assert.NoError(t, err)
+	assert.False(t, saved)
+	delegations, err = store.GetDelegations(ctx, "2024", false)
+	assert.NoError(t, err)
+	assert.Len(t, delegations, 1)
+	checkpoint, err = store.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(12), checkpoint.Level)
+	gaps, err = store.GetGaps(ctx, 13, 13)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.LevelRange{{Start: 13, End: 13}}, gaps)
+}
+
+func testStorerBlocksAndGaps(t *testing.T, store Storer) {
+	ctx := context.Background()
+	for _, level := range []uint64{10, 11, 14} {
+		block := types.Block{Level: level, Hash: fmt.Sprintf("BL%d", level), Predecessor: fmt.Sprintf("BL%d", level-1)}
+		require.NoError(t, store.SaveDelegations(ctx, block, nil))
+	}
+
+	blocks, err := store.GetBlocks(ctx, 13, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Block{{Level: 11, Hash: "BL11", Predecessor: "BL10"}, {Level: 10, Hash: "BL10", Predecessor: "BL9"}}, blocks)
+
+	gaps, err := store.GetGaps(ctx, 8, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.LevelRange{{Start: 8, End: 9}, {Start: 12, End: 13}, {Start: 15, End: 16}}, gaps)
+
+	gaps, err = store.GetGaps(ctx, 10, 11)
+	assert.NoError(t, err)
+	assert.Empty(t, gaps)
+
+	// a level saved without its block hash is processed all the same
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 12}, nil))
+	gaps, err = store.GetGaps(ctx, 10, 14)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.LevelRange{{Start: 13, End: 13}}, gaps)
+
+	// the levels rolled back must be processed again
+	require.NoError(t, store.RollbackToLevel(ctx, 11))
+	gaps, err = store.GetGaps(ctx, 10, 14)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.LevelRange{{Start: 12, End: 14}}, gaps)
+}
+
+func testStorerRollbackToLevel(t *testing.T, store Storer) {
+	ctx := context.Background()
+	for level := uint64(10); level <= 12; level++ {
+		require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: level, Hash: fmt.Sprintf("BL%d", level)}, []types.FetchedDelegation{
+			delegationAt(level, fmt.Sprintf("oo%d", level), "2024-04-21T16:23:27Z"),
+		}))
+	}
+
+	require.NoError(t, store.RollbackToLevel(ctx, 10))
+
+	delegations, err := store.GetDelegations(ctx, "", false)
+	assert.NoError(t, err)
+	require.Len(t, delegations, 1)
+	assert.Equal(t, uint64(10), delegations[0].Block)
+
+	checkpoint, err := store.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Checkpoint{Level: 10, BlockHash: "BL10"}, checkpoint)
+
+	blocks, err := store.GetBlocks(ctx, 12, 10)
+	assert.NoError(t, err)
+	assert.Len(t, blocks, 1)
+
+	orphaned, next, err := store.GetOrphanedDelegations(ctx, 0, "")
+	assert.NoError(t, err)
+	assert.Empty(t, next)
+	require.Len(t, orphaned, 2)
+	assert.Equal(t, uint64(12), orphaned[0].Block)
+	assert.Equal(t, uint64(11), orphaned[1].Block)
+	assert.Equal(t, uint64(10), orphaned[0].ReorgLevel)
+	assert.Equal(t, "oo12", orphaned[0].Hash)
+	assert.Nil(t, orphaned[0].ReplacingBlockHash)
+	assert.NotEmpty(t, orphaned[0].DetectedAt)
+
+	// rolling back above the checkpoint changes nothing
+	require.NoError(t, store.RollbackToLevel(ctx, 20))
+	checkpoint, err = store.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), checkpoint.Level)
+
+	// the kept delegation is still updated in place and the orphaned ones are stored again when refetched
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 11, Hash: "BL11b"}, []types.FetchedDelegation{
+		delegationAt(10, "oo10", "2024-04-21T16:23:27Z"),
+		delegationAt(11, "oo11", "2024-04-21T16:23:27Z"),
+	}))
+	delegations, err = store.GetDelegations(ctx, "", false)
+	assert.NoError(t, err)
+	require.Len(t, delegations, 2)
+	assert.ElementsMatch(t, []string{"oo10", "oo11"}, []string{delegations[0].Hash, delegations[1].Hash})
+}
+
+func testStorerOrphanedReplacement(t *testing.T, store Storer) {
+	ctx := context.Background()
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 10, Hash: "BL10"}, nil))
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 11, Hash: "BL11"}, []types.FetchedDelegation{
+		delegationAt(11, "oo11", "2024-04-21T16:23:27Z"),
+	}))
+	require.NoError(t, store.RollbackToLevel(ctx, 10))
+
+	// the level processed again replaces the orphaned block
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 11, Hash: "BL11b", Predecessor: "BL10"}, nil))
+	orphaned, _, err := store.GetOrphanedDelegations(ctx, 0, "")
+	assert.NoError(t, err)
+	require.Len(t, orphaned, 1)
+	require.NotNil(t, orphaned[0].ReplacingBlockHash)
+	assert.Equal(t, "BL11b", *orphaned[0].ReplacingBlockHash)
+}
+
+func testStorerOrphanedPaging(t *testing.T, store Storer) {
+	ctx := context.Background()
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 10, Hash: "BL10"}, nil))
+	for level := uint64(11); level <= 13; level++ {
+		require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: level, Hash: fmt.Sprintf("BL%d", level)}, []types.FetchedDelegation{
+			delegationAt(level, fmt.Sprintf("oo%d", level), "2024-04-21T16:23:27Z"),
+		}))
+	}
+	require.NoError(t, store.RollbackToLevel(ctx, 10))
+
+	var blocks []uint64
+	var cursor string
+	for page := 0; page < 3; page++ {
+		orphaned, next, err := store.GetOrphanedDelegations(ctx, 2, cursor)
+		require.NoError(t, err)
+		for _, d := range orphaned {
+			blocks = append(blocks, d.Block)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, []uint64{13, 12, 11}, blocks)
+
+	_, _, err := store.GetOrphanedDelegations(ctx, 2, "not a cursor")
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func testStorerConcurrentSaves(t *testing.T, store Storer) {
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for level := uint64(1); level <= 20; level++ {
+		wg.Add(1)
+		go func(level uint64) {
+			defer wg.Done()
+			err := store.SaveDelegations(ctx, types.Block{Level: level, Hash: fmt.Sprintf("BL%d", level)}, []types.FetchedDelegation{
+				delegationAt(level, fmt.Sprintf("oo%d", level), "2024-04-21T16:23:27Z"),
+			})
+			assert.NoError(t, err)
+			_, err = store.GetDelegations(ctx, "2024", false)
+			assert.NoError(t, err)
+		}(level)
+	}
+	wg.Wait()
+
+	delegations, err := store.GetDelegations(ctx, "2024", false)
+	assert.NoError(t, err)
+	assert.Len(t, delegations, 20)
+
+	checkpoint, err := store.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Checkpoint{Level: 20, BlockHash: "BL20"}, checkpoint)
+}
+
+func testStorerEmpty(t *testing.T, store Storer) {
+	ctx := context.Background()
+
+	checkpoint, err := store.GetCheckpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Checkpoint{}, checkpoint)
+
+	delegations, err := store.GetDelegations(ctx, "", false)
+	assert.NoError(t, err)
+	assert.Empty(t, delegations)
+
+	orphaned, _, err := store.GetOrphanedDelegations(ctx, 0, "")
+	assert.NoError(t, err)
+	assert.Empty(t, orphaned)
+
+	gaps, err := store.GetGaps(ctx, 1, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.LevelRange{{Start: 1, End: 3}}, gaps)
+}
+
+func testStorerSaveDiscrepancies(t *testing.T, store Storer) {
+	err := store.SaveDiscrepancies(context.Background(), []types.Discrepancy{
+		{Level: 10, PrimarySource: "tzkt", SecondarySource: "node", MissingFromPrimary: []string{"oo1:7:"}},
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,431 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+)
+
+// MemoryStore keeps the data in memory with the semantics of PostgresStore, for tests and short-lived runs.
+type MemoryStore struct {
+	mu          sync.RWMutex
+	delegations []memoryDelegation
+	// position in delegations of the stored delegations with a hash, by operation
+	byOperation   map[operationKey]int
+	orphaned      []types.OrphanedDelegation
+	blocks        map[uint64]types.Block
+	processed     map[uint64]bool
+	checkpoint    types.Checkpoint
+	discrepancies []types.Discrepancy
+	// id of the last stored delegation and of the last orphaned one
+	lastID         int
+	lastOrphanedID int
+}
+
+// memoryDelegation is a stored delegation along with the fields identifying its operation.
+type memoryDelegation struct {
+	types.Delegation
+	nonce *uint64
+}
+
+// operationKey identifies the operation of a delegation, like the unique index of the databases.
+type operationKey struct {
+	hash     string
+	counter  uint64
+	nonce    uint64
+	hasNonce bool
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		byOperation: make(map[operationKey]int),
+		blocks:      make(map[uint64]types.Block),
+		processed:   make(map[uint64]bool),
+	}
+}
+
+// operation returns the key of the operation of the delegation, rows without hash have none and are never the same.
+func (d memoryDelegation) operation() (operationKey, bool) {
+	if d.Hash == "" {
+		return operationKey{}, false
+	}
+	key := operationKey{hash: d.Hash, counter: d.Counter}
+	if d.nonce != nil {
+		key.nonce, key.hasNonce = *d.nonce, true
+	}
+	return key, true
+}
+
+// SaveDelegations saves the delegation data of a block and checkpoints the block.
+// Delegations already stored are updated, so saving the same operations twice is safe. The checkpoint only moves
+// forward, a level below it, such as a repaired gap, is saved without rewinding it.
+func (s *MemoryStore) SaveDelegations(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) error {
+	return s.SaveBlocks(ctx, []types.Block{block}, delegations)
+}
+
+// SaveBlocks saves consecutive blocks, given in level order, with their delegations and checkpoints the last block.
+func (s *MemoryStore) SaveBlocks(ctx context.Context, blocks []types.Block, delegations []types.FetchedDelegation) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.saveDelegations(delegations)
+	if last := blocks[len(blocks)-1]; last.Level >= s.checkpoint.Level {
+		s.checkpoint = types.Checkpoint{Level: last.Level, BlockHash: last.Hash}
+	}
+	for _, block := range blocks {
+		s.saveLevel(block)
+	}
+
+	return nil
+}
+
+// RepairLevel saves a level missing below the checkpoint with its delegations, without moving the checkpoint.
+// A level above the checkpoint, such as one rolled back after it was fetched, is left to the poller and false is returned.
+func (s *MemoryStore) RepairLevel(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if block.Level > s.checkpoint.Level {
+		return false, nil
+	}
+	s.saveDelegations(delegations)
+	s.saveLevel(block)
+	return true, nil
+}
+
+// saveDelegations stores the fetched delegations, updating the ones already stored. The lock must be held.
+func (s *MemoryStore) saveDelegations(delegations []types.FetchedDelegation) {
+	for _, fetched := range delegations {
+		d := memoryDelegation{
+			Delegation: types.Delegation{
+				OperationID:  fetched.ID,
+				Hash:         fetched.Hash,
+				Counter:      fetched.Counter,
+				Timestamp:    normalizeTimestamp(fetched.Timestamp),
+				Amount:       fetched.Amount,
+				Delegator:    fetched.Sender.Address,
+				NewDelegate:  fetched.NewDelegateAddress(),
+				PrevDelegate: fetched.PrevDelegateAddress(),
+				Status:       fetched.Status,
+				BakerFee:     fetched.BakerFee,
+				GasUsed:      fetched.GasUsed,
+				Block:        fetched.Level,
+				Finality:     types.FinalityPending,
+			},
+			nonce: fetched.Nonce,
+		}
+		s.upsertDelegation(d)
+	}
+}
+
+// saveLevel records the level of a block as processed, along with the block when its hash is known. The lock must be held.
+func (s *MemoryStore) saveLevel(block types.Block) {
+	s.processed[block.Level] = true
+	if block.Hash == "" {
+		return
+	}
+	s.blocks[block.Level] = block
+	for i := range s.orphaned {
+		if s.orphaned[i].Block == block.Level && s.orphaned[i].ReplacingBlockHash == nil {
+			hash := block.Hash
+			s.orphaned[i].ReplacingBlockHash = &hash
+		}
+	}
+}
+
+// upsertDelegation stores the delegation or updates the stored one. The lock must be held.
+func (s *MemoryStore) upsertDelegation(d memoryDelegation) {
+	key, ok := d.operation()
+	if i, stored := s.byOperation[key]; ok && stored {
+		// a delegation moved to another block is pending again
+		if s.delegations[i].Block == d.Block {
+			d.Finality = s.delegations[i].Finality
+		}
+		d.Id = s.delegations[i].Id
+		s.delegations[i] = d
+		return
+	}
+	s.lastID++
+	d.Id = s.lastID
+	if ok {
+		s.byOperation[key] = len(s.delegations)
+	}
+	s.delegations = append(s.delegations, d)
+}
+
+// GetDelegations retrieves the delegations of a specified year, the latest first.
+// With finalOnly, the delegations still pending finality are left out.
+func (s *MemoryStore) GetDelegations(ctx context.Context, year string, finalOnly bool) ([]types.Delegation, error) {
+	query, err := yearQuery(year, finalOnly)
+	if err != nil {
+		return nil, err
+	}
+	delegations, _, err := s.QueryDelegations(ctx, query)
+	return delegations, err
+}
+
+// QueryDelegations retrieves the delegations matching the query, along with the cursor of the next page
+// when the page is full.
+func (s *MemoryStore) QueryDelegations(ctx context.Context, query types.DelegationQuery) ([]types.Delegation, string, error) {
+	var cursor *delegationCursor
+	if query.Cursor != "" {
+		c, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		cursor = &c
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var delegations []types.Delegation
+	for _, d := range s.delegations {
+		if matchesQuery(d, query) {
+			delegations = append(delegations, d.Delegation)
+		}
+	}
+	// before reports whether a comes before b in the query order
+	before := func(a, b delegationCursor) bool {
+		if query.Ascending {
+			a, b = b, a
+		}
+		if !a.timestamp.Equal(b.timestamp) {
+			return a.timestamp.After(b.timestamp)
+		}
+		return a.id > b.id
+	}
+	sort.Slice(delegations, func(i, j int) bool {
+		return before(positionOf(delegations[i]), positionOf(delegations[j]))
+	})
+
+	if cursor != nil {
+		start := sort.Search(len(delegations), func(i int) bool { return before(*cursor, positionOf(delegations[i])) })
+		delegations = delegations[start:]
+	}
+	var next string
+	if query.Limit > 0 && len(delegations) >= query.Limit {
+		delegations = delegations[:query.Limit]
+		next = encodeCursor(delegations[len(delegations)-1])
+	}
+	if len(delegations) == 0 {
+		return nil, "", nil
+	}
+
+	return delegations, next, nil
+}
+
+// matchesQuery tells whether the delegation passes the filters of the query.
+func matchesQuery(d memoryDelegation, query types.DelegationQuery) bool {
+	timestamp := positionOf(d.Delegation).timestamp
+	switch {
+	case !query.From.IsZero() && timestamp.Before(query.From),
+		!query.To.IsZero() && !timestamp.Before(query.To),
+		query.MinLevel > 0 && d.Block < query.MinLevel,
+		query.MaxLevel > 0 && d.Block > query.MaxLevel,
+		query.Delegator != "" && d.Delegator != query.Delegator,
+		query.Baker != "" && (d.NewDelegate == nil || *d.NewDelegate != query.Baker),
+		query.MinAmount > 0 && d.Amount < query.MinAmount,
+		query.MaxAmount > 0 && d.Amount > query.MaxAmount,
+		query.FinalOnly && d.Finality != types.FinalityFinal:
+		return false
+	}
+	return true
+}
+
+// positionOf returns the position of a delegation in the query order.
+func positionOf(d types.Delegation) delegationCursor {
+	timestamp, _ := time.Parse(time.RFC3339Nano, d.Timestamp)
+	return delegationCursor{timestamp: timestamp, id: d.Id}
+}
+
+// FinalizeDelegations promotes the pending delegations of the blocks at or below the given level to final.
+func (s *MemoryStore) FinalizeDelegations(ctx context.Context, level uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.delegations {
+		if s.delegations[i].Finality == types.FinalityPending && s.delegations[i].Block <= level {
+			s.delegations[i].Finality = types.FinalityFinal
+		}
+	}
+	return nil
+}
+
+// GetCheckpoint retrieves the last fully processed level and its block hash.
+func (s *MemoryStore) GetCheckpoint(ctx context.Context) (types.Checkpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.checkpoint, nil
+}
+
+// GetBlocks retrieves at most limit processed blocks at or below maxLevel, highest level first.
+func (s *MemoryStore) GetBlocks(ctx context.Context, maxLevel uint64, limit int) ([]types.Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var blocks []types.Block
+	for level, block := range s.blocks {
+		if level <= maxLevel {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Level > blocks[j].Level })
+	if len(blocks) > limit {
+		blocks = blocks[:limit]
+	}
+
+	return blocks, nil
+}
+
+// GetGaps returns the ranges of levels between fromLevel and toLevel (both included) that were never processed.
+func (s *MemoryStore) GetGaps(ctx context.Context, fromLevel, toLevel uint64) ([]types.LevelRange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if fromLevel > toLevel {
+		return nil, nil
+	}
+	var levels []uint64
+	for level := range s.processed {
+		if level >= fromLevel && level <= toLevel {
+			levels = append(levels, level)
+		}
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+
+	// the gaps are the ranges between consecutive processed levels
+	var gaps []types.LevelRange
+	next := fromLevel
+	for _, level := range levels {
+		if level > next {
+			gaps = append(gaps, types.LevelRange{Start: next, End: level - 1})
+		}
+		next = level + 1
+	}
+	if len(levels) == 0 || levels[len(levels)-1] < toLevel {
+		gaps = append(gaps, types.LevelRange{Start: next, End: toLevel})
+	}
+
+	return gaps, nil
+}
+
+// RollbackToLevel moves all delegations above the specified level to the orphaned delegations,
+// forgets the blocks and processed levels above it and rewinds the checkpoint to it.
+func (s *MemoryStore) RollbackToLevel(ctx context.Context, level uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	detectedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	kept := s.delegations[:0]
+	var orphaned []types.OrphanedDelegation
+	for _, d := range s.delegations {
+		if d.Block <= level {
+			if key, ok := d.operation(); ok {
+				s.byOperation[key] = len(kept)
+			}
+			kept = append(kept, d)
+			continue
+		}
+		if key, ok := d.operation(); ok {
+			delete(s.byOperation, key)
+		}
+		o := types.OrphanedDelegation{
+			Delegation: d.Delegation,
+			ReorgLevel: level,
+			DetectedAt: detectedAt,
+		}
+		o.Finality = ""
+		orphaned = append(orphaned, o)
+	}
+	s.delegations = kept
+
+	// the orphaned delegations get their ids by ascending block, like in the databases
+	sort.SliceStable(orphaned, func(i, j int) bool { return orphaned[i].Block < orphaned[j].Block })
+	for _, o := range orphaned {
+		s.lastOrphanedID++
+		o.Id = s.lastOrphanedID
+		s.orphaned = append(s.orphaned, o)
+	}
+
+	for blockLevel := range s.blocks {
+		if blockLevel > level {
+			delete(s.blocks, blockLevel)
+		}
+	}
+	for processedLevel := range s.processed {
+		if processedLevel > level {
+			delete(s.processed, processedLevel)
+		}
+	}
+
+	if s.checkpoint.Level > level {
+		s.checkpoint = types.Checkpoint{Level: level, BlockHash: s.blocks[level].Hash}
+	}
+
+	return nil
+}
+
+// GetOrphanedDelegations retrieves a page of at most limit delegations removed by reorgs, most recently orphaned first,
+// along with the cursor of the next page when the page is full. A limit of 0 returns all of them.
+func (s *MemoryStore) GetOrphanedDelegations(ctx context.Context, limit int, cursor string) ([]types.OrphanedDelegation, string, error) {
+	var after int
+	if cursor != "" {
+		id, err := decodeOrphanedCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = id
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var delegations []types.OrphanedDelegation
+	for i := len(s.orphaned) - 1; i >= 0; i-- {
+		if after > 0 && s.orphaned[i].Id >= after {
+			continue
+		}
+		delegations = append(delegations, s.orphaned[i])
+		if limit > 0 && len(delegations) == limit {
+			return delegations, encodeOrphanedCursor(s.orphaned[i].Id), nil
+		}
+	}
+
+	return delegations, "", nil
+}
+
+// SaveDiscrepancies records the levels where two sources returned different delegations.
+func (s *MemoryStore) SaveDiscrepancies(ctx context.Context, discrepancies []types.Discrepancy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	detectedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, d := range discrepancies {
+		d.MissingFromPrimary = nonNil(d.MissingFromPrimary)
+		d.MissingFromSecondary = nonNil(d.MissingFromSecondary)
+		d.Mismatched = nonNil(d.Mismatched)
+		d.DetectedAt = detectedAt
+		s.discrepancies = append(s.discrepancies, d)
+	}
+
+	return nil
+}
+
+// normalizeTimestamp formats a timestamp the way the databases return it, it is kept as is when it can't be parsed.
+func normalizeTimestamp(timestamp string) string {
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
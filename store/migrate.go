@@ -0,0 +1,227 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the advisory lock held while migrating, so replicas starting together don't race.
+const migrationLockKey = 7_212_604_315_502_461
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer version of the watcher.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// migration is a schema change, applied by its up script and reverted by its down script.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations reads the migrations of dir, named <version>_<name>.up.sql and <version>_<name>.down.sql.
+// Versions must start at 1 and follow each other, each with both scripts.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		prefix, name, found := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || !found || err != nil || version < 1 || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+
+		script, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.name, name)
+		}
+		if direction == "up" {
+			m.up = string(script)
+		} else {
+			m.down = string(script)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d must have an up and a down script", m.version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// migrator applies the migrations of a database engine.
+type migrator struct {
+	db  *sql.DB
+	dir string
+	// statements taking and releasing the migration lock, empty when the engine has none
+	lock   string
+	unlock string
+}
+
+// postgresMigrator locks with an advisory lock, so replicas starting together don't race.
+func postgresMigrator(db *sql.DB) migrator {
+	return migrator{
+		db:     db,
+		dir:    "migrations/postgres",
+		lock:   fmt.Sprintf("SELECT pg_advisory_lock(%d)", migrationLockKey),
+		unlock: fmt.Sprintf("SELECT pg_advisory_unlock(%d)", migrationLockKey),
+	}
+}
+
+// Migrate applies the migrations the database is missing. It fails with ErrSchemaTooNew when the database
+// was migrated past the latest migration of this binary.
+func (s *PostgresStore) Migrate(ctx context.Context) error {
+	return postgresMigrator(s.db).migrateTo(ctx, -1)
+}
+
+// MigrateTo applies or reverts migrations until the database schema is at the given version.
+func (s *PostgresStore) MigrateTo(ctx context.Context, version int) error {
+	return postgresMigrator(s.db).migrateTo(ctx, version)
+}
+
+// SchemaVersion returns the version the database schema is at, and the latest version known to this binary.
+func (s *PostgresStore) SchemaVersion(ctx context.Context) (current int, latest int, err error) {
+	return postgresMigrator(s.db).schemaVersion(ctx)
+}
+
+// migrateTo moves the schema to the given version, a negative version stands for the latest one.
+func (m migrator) migrateTo(ctx context.Context, version int) error {
+	migrations, err := loadMigrations(migrationFiles, m.dir)
+	if err != nil {
+		return err
+	}
+	if version < 0 {
+		version = len(migrations)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("unknown schema version %d, the latest is %d", version, len(migrations))
+	}
+	return m.migrate(ctx, migrations, version)
+}
+
+// schemaVersion returns the version the database schema is at, and the latest version of the migrations.
+func (m migrator) schemaVersion(ctx context.Context) (int, int, error) {
+	migrations, err := loadMigrations(migrationFiles, m.dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var version sql.NullInt64
+	err = m.db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	return int(version.Int64), len(migrations), nil
+}
+
+// migrate moves the schema to the target version under the migration lock, each migration in its own transaction.
+func (m migrator) migrate(ctx context.Context, migrations []migration, target int) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	// the lock belongs to the session, it must be taken and released on the same connection
+	if m.lock != "" {
+		if _, err := conn.ExecContext(ctx, m.lock); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), m.unlock); err != nil {
+				logger.Errorf("Failed to release migration lock: %v", err)
+			}
+		}()
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	var version sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+	current := int(version.Int64)
+	if current > len(migrations) {
+		return fmt.Errorf("%w: database is at version %d, the latest known version is %d", ErrSchemaTooNew, current, len(migrations))
+	}
+
+	for ; current < target; current++ {
+		mig := migrations[current]
+		if err := runMigration(ctx, conn, mig.up, `INSERT INTO schema_version (version, name) VALUES ($1, $2)`, mig.version, mig.name); err != nil {
+			return fmt.Errorf("failed to apply migration %d %s: %w", mig.version, mig.name, err)
+		}
+		logger.Infof("Applied migration %d %s", mig.version, mig.name)
+	}
+	for ; current > target; current-- {
+		mig := migrations[current-1]
+		if err := runMigration(ctx, conn, mig.down, `DELETE FROM schema_version WHERE version = $1`, mig.version); err != nil {
+			return fmt.Errorf("failed to revert migration %d %s: %w", mig.version, mig.name, err)
+		}
+		logger.Infof("Reverted migration %d %s", mig.version, mig.name)
+	}
+
+	return nil
+}
+
+// runMigration runs a migration script and records it in schema_version within a single transaction.
+func runMigration(ctx context.Context, conn *sql.Conn, script, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return fmt.Errorf("failed to record schema version: %w", err)
+	}
+
+	return tx.Commit()
+}
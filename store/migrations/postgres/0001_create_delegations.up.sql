@@ -0,0 +1,36 @@
+CREATE TABLE IF NOT EXISTS delegations (
+	id SERIAL PRIMARY KEY,
+	operation_id BIGINT NOT NULL DEFAULT 0,
+	op_hash TEXT NOT NULL DEFAULT '',
+	counter BIGINT NOT NULL DEFAULT 0,
+	timestamp TIMESTAMP NOT NULL,
+	amount BIGINT NOT NULL,
+	delegator TEXT NOT NULL,
+	new_delegate TEXT,
+	prev_delegate TEXT,
+	status TEXT NOT NULL DEFAULT '',
+	baker_fee BIGINT NOT NULL DEFAULT 0,
+	gas_used BIGINT NOT NULL DEFAULT 0,
+	nonce BIGINT,
+	block INT NOT NULL,
+	finality TEXT NOT NULL DEFAULT 'pending'
+);
+
+-- databases created before migrations only have the columns of their version
+ALTER TABLE delegations
+	ADD COLUMN IF NOT EXISTS operation_id BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS op_hash TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS counter BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS new_delegate TEXT,
+	ADD COLUMN IF NOT EXISTS prev_delegate TEXT,
+	ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS baker_fee BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS gas_used BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS nonce BIGINT;
+
+-- the rows stored before finality was tracked are old enough to be final, only the new rows start pending
+ALTER TABLE delegations ADD COLUMN IF NOT EXISTS finality TEXT NOT NULL DEFAULT 'final';
+ALTER TABLE delegations ALTER COLUMN finality SET DEFAULT 'pending';
+
+-- only the recent blocks are pending, the partial index keeps their promotion cheap
+CREATE INDEX IF NOT EXISTS delegations_pending_block ON delegations (block) WHERE finality = 'pending';
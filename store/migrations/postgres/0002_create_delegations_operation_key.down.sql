@@ -0,0 +1 @@
+DROP INDEX IF EXISTS delegations_operation_key;
@@ -0,0 +1,14 @@
+-- an operation is identified by its hash, counter and nonce (internal operations share the hash and counter
+-- of the operation emitting them), databases created before the key may already contain duplicates
+DELETE FROM delegations a USING delegations b
+WHERE a.op_hash <> '' AND a.op_hash = b.op_hash AND a.counter = b.counter
+AND COALESCE(a.nonce, -1) = COALESCE(b.nonce, -1) AND a.id > b.id;
+
+DELETE FROM delegations a USING delegations b
+WHERE a.op_hash = '' AND a.block = b.block AND a.delegator = b.delegator
+AND a.timestamp = b.timestamp AND a.amount = b.amount AND (b.op_hash <> '' OR a.id > b.id);
+
+-- rows stored before the operation hash was recorded are left out of the key
+CREATE UNIQUE INDEX IF NOT EXISTS delegations_operation_key
+ON delegations (op_hash, counter, COALESCE(nonce, -1))
+WHERE op_hash <> '';
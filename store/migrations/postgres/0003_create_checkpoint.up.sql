@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS checkpoint (
+	id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+	level BIGINT NOT NULL,
+	block_hash TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- databases created before the checkpoint are checkpointed at their highest stored level
+INSERT INTO checkpoint (level, block_hash)
+SELECT COALESCE(MAX(block), 0), '' FROM delegations
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS blocks (
+	level BIGINT PRIMARY KEY,
+	hash TEXT NOT NULL,
+	predecessor TEXT NOT NULL
+);
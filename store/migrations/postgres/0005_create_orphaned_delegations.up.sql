@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS orphaned_delegations (
+	id SERIAL PRIMARY KEY,
+	operation_id BIGINT NOT NULL,
+	op_hash TEXT NOT NULL,
+	counter BIGINT NOT NULL,
+	timestamp TIMESTAMP NOT NULL,
+	amount BIGINT NOT NULL,
+	delegator TEXT NOT NULL,
+	new_delegate TEXT,
+	prev_delegate TEXT,
+	status TEXT NOT NULL,
+	baker_fee BIGINT NOT NULL,
+	gas_used BIGINT NOT NULL,
+	nonce BIGINT,
+	block INT NOT NULL,
+	reorg_level BIGINT NOT NULL,
+	detected_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	replacing_block_hash TEXT
+);
+
+CREATE INDEX IF NOT EXISTS orphaned_delegations_block ON orphaned_delegations (block);
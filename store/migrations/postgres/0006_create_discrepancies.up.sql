@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS discrepancies (
+	id SERIAL PRIMARY KEY,
+	level BIGINT NOT NULL,
+	primary_source TEXT NOT NULL,
+	secondary_source TEXT NOT NULL,
+	missing_from_primary TEXT[] NOT NULL,
+	missing_from_secondary TEXT[] NOT NULL,
+	mismatched TEXT[] NOT NULL,
+	detected_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS discrepancies_level ON discrepancies (level);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS delegations_timestamp;
+DROP INDEX IF EXISTS delegations_block;
+DROP INDEX IF EXISTS delegations_delegator;
+DROP INDEX IF EXISTS delegations_new_delegate;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS processed_levels (
+	level BIGINT PRIMARY KEY
+);
+
+-- the levels whose block was recorded were processed
+INSERT INTO processed_levels (level)
+SELECT level FROM blocks
+ON CONFLICT DO NOTHING;
+
+-- databases created before the blocks were recorded processed the levels from their first delegation
+-- up to the checkpoint, or up to the first recorded block
+INSERT INTO processed_levels (level)
+SELECT generate_series(
+	(SELECT MIN(block) FROM delegations),
+	LEAST(level, COALESCE((SELECT MIN(level) - 1 FROM blocks), level))
+) FROM checkpoint
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS delegations (
+	id INTEGER PRIMARY KEY,
+	operation_id INTEGER NOT NULL DEFAULT 0,
+	op_hash TEXT NOT NULL DEFAULT '',
+	counter INTEGER NOT NULL DEFAULT 0,
+	timestamp TIMESTAMP NOT NULL,
+	amount INTEGER NOT NULL,
+	delegator TEXT NOT NULL,
+	new_delegate TEXT,
+	prev_delegate TEXT,
+	status TEXT NOT NULL DEFAULT '',
+	baker_fee INTEGER NOT NULL DEFAULT 0,
+	gas_used INTEGER NOT NULL DEFAULT 0,
+	nonce INTEGER,
+	block INTEGER NOT NULL,
+	finality TEXT NOT NULL DEFAULT 'pending'
+);
+
+CREATE INDEX IF NOT EXISTS delegations_pending_block ON delegations (block) WHERE finality = 'pending';
@@ -0,0 +1,3 @@
+CREATE UNIQUE INDEX IF NOT EXISTS delegations_operation_key
+ON delegations (op_hash, counter, COALESCE(nonce, -1))
+WHERE op_hash <> '';
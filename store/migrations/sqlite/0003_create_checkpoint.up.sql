@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS checkpoint (
+	id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+	level INTEGER NOT NULL,
+	block_hash TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT OR IGNORE INTO checkpoint (level, block_hash) VALUES (0, '');
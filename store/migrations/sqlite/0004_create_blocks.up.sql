@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS blocks (
+	level INTEGER PRIMARY KEY,
+	hash TEXT NOT NULL,
+	predecessor TEXT NOT NULL
+);
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS orphaned_delegations (
+	id INTEGER PRIMARY KEY,
+	operation_id INTEGER NOT NULL,
+	op_hash TEXT NOT NULL,
+	counter INTEGER NOT NULL,
+	timestamp TIMESTAMP NOT NULL,
+	amount INTEGER NOT NULL,
+	delegator TEXT NOT NULL,
+	new_delegate TEXT,
+	prev_delegate TEXT,
+	status TEXT NOT NULL,
+	baker_fee INTEGER NOT NULL,
+	gas_used INTEGER NOT NULL,
+	nonce INTEGER,
+	block INTEGER NOT NULL,
+	reorg_level INTEGER NOT NULL,
+	detected_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	replacing_block_hash TEXT
+);
+
+CREATE INDEX IF NOT EXISTS orphaned_delegations_block ON orphaned_delegations (block);
@@ -0,0 +1,13 @@
+-- the operation lists are JSON arrays
+CREATE TABLE IF NOT EXISTS discrepancies (
+	id INTEGER PRIMARY KEY,
+	level INTEGER NOT NULL,
+	primary_source TEXT NOT NULL,
+	secondary_source TEXT NOT NULL,
+	missing_from_primary TEXT NOT NULL,
+	missing_from_secondary TEXT NOT NULL,
+	mismatched TEXT NOT NULL,
+	detected_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS discrepancies_level ON discrepancies (level);
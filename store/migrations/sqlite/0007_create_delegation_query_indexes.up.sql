@@ -0,0 +1,5 @@
+-- the query filters compare the columns with their bounds and sort by timestamp then id, so they use these indexes
+CREATE INDEX IF NOT EXISTS delegations_timestamp ON delegations (timestamp, id);
+CREATE INDEX IF NOT EXISTS delegations_block ON delegations (block);
+CREATE INDEX IF NOT EXISTS delegations_delegator ON delegations (delegator, timestamp);
+CREATE INDEX IF NOT EXISTS delegations_new_delegate ON delegations (new_delegate, timestamp);
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS processed_levels (
+	level INTEGER PRIMARY KEY
+);
+
+-- the levels whose block was recorded were processed
+INSERT OR IGNORE INTO processed_levels (level)
+SELECT level FROM blocks;
+
+-- databases created before the blocks were recorded processed the levels from their first delegation
+-- up to the checkpoint, or up to the first recorded block
+WITH RECURSIVE
+	bounds (first_level, last_level) AS (
+		SELECT (SELECT MIN(block) FROM delegations), MIN(level, COALESCE((SELECT MIN(level) - 1 FROM blocks), level))
+		FROM checkpoint
+	),
+	legacy (level) AS (
+		SELECT first_level FROM bounds WHERE first_level <= last_level
+		UNION ALL
+		SELECT level + 1 FROM legacy, bounds WHERE level < last_level
+	)
+INSERT OR IGNORE INTO processed_levels (level)
+SELECT level FROM legacy;
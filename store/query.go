@@ -0,0 +1,233 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+)
+
+// ErrInvalidCursor is returned for a cursor that was not returned by a previous query.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// delegationCursor is the position of a delegation in the query order: its timestamp, then its row id.
+type delegationCursor struct {
+	timestamp time.Time
+	id        int
+}
+
+// encodeCursor returns the cursor of the page starting after the given delegation.
+func encodeCursor(d types.Delegation) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(d.Timestamp + "," + strconv.Itoa(d.Id)))
+}
+
+// decodeCursor reads a cursor returned by encodeCursor.
+func decodeCursor(cursor string) (delegationCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return delegationCursor{}, ErrInvalidCursor
+	}
+	timestamp, id, ok := strings.Cut(string(raw), ",")
+	if !ok {
+		return delegationCursor{}, ErrInvalidCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return delegationCursor{}, ErrInvalidCursor
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return delegationCursor{}, ErrInvalidCursor
+	}
+	return delegationCursor{timestamp: t, id: n}, nil
+}
+
+// encodeOrphanedCursor returns the cursor of the page of orphaned delegations starting after the given row id.
+func encodeOrphanedCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+// decodeOrphanedCursor reads a cursor returned by encodeOrphanedCursor.
+func decodeOrphanedCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(string(raw))
+	if err != nil || id <= 0 {
+		return 0, ErrInvalidCursor
+	}
+	return id, nil
+}
+
+// yearQuery returns the query of the delegations of a calendar year, of every year when it is empty.
+func yearQuery(year string, finalOnly bool) (types.DelegationQuery, error) {
+	if year == "" {
+		return types.DelegationQuery{FinalOnly: finalOnly}, nil
+	}
+	y, err := strconv.Atoi(year)
+	if err != nil {
+		return types.DelegationQuery{}, fmt.Errorf("invalid year %q: %w", year, err)
+	}
+	return types.YearQuery(y, finalOnly), nil
+}
+
+// delegationQuerySQL translates the query into SQL comparing the columns with the bounds, so the indexes are used.
+// timeArg converts a time to the argument the database compares with the timestamp column.
+func delegationQuerySQL(q types.DelegationQuery, timeArg func(time.Time) any) (string, []any, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, values ...any) {
+		placeholders := make([]any, len(values))
+		for i, value := range values {
+			args = append(args, value)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		conditions = append(conditions, fmt.Sprintf(condition, placeholders...))
+	}
+
+	if !q.From.IsZero() {
+		where("timestamp >= %s", timeArg(q.From))
+	}
+	if !q.To.IsZero() {
+		where("timestamp < %s", timeArg(q.To))
+	}
+	if q.MinLevel > 0 {
+		where("block >= %s", q.MinLevel)
+	}
+	if q.MaxLevel > 0 {
+		where("block <= %s", q.MaxLevel)
+	}
+	if q.Delegator != "" {
+		where("delegator = %s", q.Delegator)
+	}
+	if q.Baker != "" {
+		where("new_delegate = %s", q.Baker)
+	}
+	if q.MinAmount > 0 {
+		where("amount >= %s", q.MinAmount)
+	}
+	if q.MaxAmount > 0 {
+		where("amount <= %s", q.MaxAmount)
+	}
+	if q.FinalOnly {
+		where("finality = %s", types.FinalityFinal)
+	}
+
+	order, after := "DESC", "<"
+	if q.Ascending {
+		order, after = "ASC", ">"
+	}
+	if q.Cursor != "" {
+		cursor, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+		where("(timestamp, id) "+after+" (%s, %s)", timeArg(cursor.timestamp), cursor.id)
+	}
+
+	query := `
+		SELECT id, operation_id, op_hash, counter, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block, finality
+		FROM delegations
+	`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY timestamp %s, id %s", order, order)
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	return query, args, nil
+}
+
+// queryDelegations runs the query against a SQL database, along with the cursor of the next page when the page is full.
+func queryDelegations(ctx context.Context, db *sql.DB, q types.DelegationQuery, timeArg func(time.Time) any) ([]types.Delegation, string, error) {
+	query, args, err := delegationQuerySQL(q, timeArg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var delegations []types.Delegation
+	for rows.Next() {
+		var d types.Delegation
+		if err := rows.Scan(&d.Id, &d.OperationID, &d.Hash, &d.Counter, &d.Timestamp, &d.Amount, &d.Delegator,
+			&d.NewDelegate, &d.PrevDelegate, &d.Status, &d.BakerFee, &d.GasUsed, &d.Block, &d.Finality); err != nil {
+			return nil, "", err
+		}
+		delegations = append(delegations, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if q.Limit > 0 && len(delegations) == q.Limit {
+		next = encodeCursor(delegations[len(delegations)-1])
+	}
+	return delegations, next, nil
+}
+
+// queryOrphanedDelegations retrieves a page of the orphaned delegations from a SQL database, most recently orphaned
+// first, along with the cursor of the next page when the page is full. A limit of 0 returns every row.
+func queryOrphanedDelegations(ctx context.Context, db *sql.DB, limit int, cursor string) ([]types.OrphanedDelegation, string, error) {
+	query := `
+		SELECT id, operation_id, op_hash, counter, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block,
+			reorg_level, detected_at, replacing_block_hash
+		FROM orphaned_delegations
+	`
+	var args []any
+	if cursor != "" {
+		id, err := decodeOrphanedCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, id)
+		query += " WHERE id < $1"
+	}
+	// the rows of a rollback are inserted by ascending block, so the id orders them by detection then block
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		args = append(args, limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var delegations []types.OrphanedDelegation
+	for rows.Next() {
+		var d types.OrphanedDelegation
+		if err := rows.Scan(&d.Id, &d.OperationID, &d.Hash, &d.Counter, &d.Timestamp, &d.Amount, &d.Delegator,
+			&d.NewDelegate, &d.PrevDelegate, &d.Status, &d.BakerFee, &d.GasUsed, &d.Block,
+			&d.ReorgLevel, &d.DetectedAt, &d.ReplacingBlockHash); err != nil {
+			return nil, "", err
+		}
+		delegations = append(delegations, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if limit > 0 && len(delegations) == limit {
+		next = encodeOrphanedCursor(delegations[len(delegations)-1].Id)
+	}
+	return delegations, next, nil
+}
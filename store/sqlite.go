@@ -0,0 +1,315 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore manages the operations with a SQLite database file, so the watcher can run without a database server.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens the SQLite database at the configured path, creating it when missing, and migrates it.
+func NewSQLiteStore(cfg *config.DBConfig) (*SQLiteStore, error) {
+	store, err := OpenSQLiteStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.Migrate(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// OpenSQLiteStore opens the SQLite database at the configured path without migrating it, for the tools managing the schema.
+func OpenSQLiteStore(cfg *config.DBConfig) (*SQLiteStore, error) {
+	// busy_timeout waits for the write lock instead of failing when another process holds it
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate", cfg.GetPath())
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	// SQLite has a single writer, one connection avoids failing on the write lock
+	db.SetMaxOpenConns(1)
+
+	if err = db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	return &SQLiteStore{
+		db: db,
+	}, nil
+}
+
+// sqliteMigrator takes no lock, a SQLite file is used by a single watcher.
+func sqliteMigrator(db *sql.DB) migrator {
+	return migrator{
+		db:  db,
+		dir: "migrations/sqlite",
+	}
+}
+
+// Migrate applies the migrations the database is missing. It fails with ErrSchemaTooNew when the database
+// was migrated past the latest migration of this binary.
+func (s *SQLiteStore) Migrate(ctx context.Context) error {
+	return sqliteMigrator(s.db).migrateTo(ctx, -1)
+}
+
+// MigrateTo applies or reverts migrations until the database schema is at the given version.
+func (s *SQLiteStore) MigrateTo(ctx context.Context, version int) error {
+	return sqliteMigrator(s.db).migrateTo(ctx, version)
+}
+
+// SchemaVersion returns the version the database schema is at, and the latest version known to this binary.
+func (s *SQLiteStore) SchemaVersion(ctx context.Context) (current int, latest int, err error) {
+	return sqliteMigrator(s.db).schemaVersion(ctx)
+}
+
+// SaveDelegations saves the delegation data of a block to the database and checkpoints the block in the same transaction.
+// Delegations already stored are updated, so saving the same operations twice is safe. The checkpoint only moves
+// forward, a level below it, such as a repaired gap, is saved without rewinding it.
+func (s *SQLiteStore) SaveDelegations(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) error {
+	return s.SaveBlocks(ctx, []types.Block{block}, delegations)
+}
+
+// SaveBlocks saves consecutive blocks, given in level order, with their delegations in a single transaction
+// and checkpoints the last block.
+func (s *SQLiteStore) SaveBlocks(ctx context.Context, blocks []types.Block, delegations []types.FetchedDelegation) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a SQLite transaction is local, inserting one by one is fast enough for any batch
+	if len(delegations) > 0 {
+		if err := insertDelegations(ctx, tx, delegations); err != nil {
+			return err
+		}
+	}
+
+	if err := saveBlocks(ctx, tx, blocks); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// RepairLevel saves a level missing below the checkpoint with its delegations, without moving the checkpoint.
+// The transaction holds the write lock from its start, so a rollback can't happen in between: a level above
+// the checkpoint, such as one rolled back after it was fetched, is left to the poller and false is returned.
+func (s *SQLiteStore) RepairLevel(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) (bool, error) {
+	return repairLevel(ctx, s.db, `SELECT level FROM checkpoint`, block, delegations)
+}
+
+// GetDelegations retrieves delegations from the database for a specified year.
+// With finalOnly, the delegations still pending finality are left out.
+func (s *SQLiteStore) GetDelegations(ctx context.Context, year string, finalOnly bool) ([]types.Delegation, error) {
+	query, err := yearQuery(year, finalOnly)
+	if err != nil {
+		return nil, err
+	}
+	delegations, _, err := s.QueryDelegations(ctx, query)
+	return delegations, err
+}
+
+// QueryDelegations retrieves the delegations matching the query, along with the cursor of the next page
+// when the page is full.
+func (s *SQLiteStore) QueryDelegations(ctx context.Context, query types.DelegationQuery) ([]types.Delegation, string, error) {
+	return queryDelegations(ctx, s.db, query, sqliteTime)
+}
+
+// FinalizeDelegations promotes the pending delegations of the blocks at or below the given level to final.
+func (s *SQLiteStore) FinalizeDelegations(ctx context.Context, level uint64) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE delegations SET finality = $2 WHERE finality = $3 AND block <= $1
+	`, level, types.FinalityFinal, types.FinalityPending)
+	if err != nil {
+		return fmt.Errorf("failed to finalize delegations: %w", err)
+	}
+	return nil
+}
+
+// GetCheckpoint retrieves the last fully processed level and its block hash.
+func (s *SQLiteStore) GetCheckpoint(ctx context.Context) (types.Checkpoint, error) {
+	var checkpoint types.Checkpoint
+	err := s.db.QueryRowContext(ctx, `SELECT level, block_hash FROM checkpoint`).Scan(&checkpoint.Level, &checkpoint.BlockHash)
+	if err != nil {
+		return types.Checkpoint{}, fmt.Errorf("failed to query database: %w", err)
+	}
+	return checkpoint, nil
+}
+
+// GetBlocks retrieves at most limit processed blocks at or below maxLevel, highest level first.
+func (s *SQLiteStore) GetBlocks(ctx context.Context, maxLevel uint64, limit int) ([]types.Block, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT level, hash, predecessor FROM blocks
+		WHERE level <= $1
+		ORDER BY level DESC
+		LIMIT $2
+	`, maxLevel, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocks []types.Block
+	for rows.Next() {
+		var b types.Block
+		if err := rows.Scan(&b.Level, &b.Hash, &b.Predecessor); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	return blocks, rows.Err()
+}
+
+// GetGaps returns the ranges of levels between fromLevel and toLevel (both included) that were never processed.
+func (s *SQLiteStore) GetGaps(ctx context.Context, fromLevel, toLevel uint64) ([]types.LevelRange, error) {
+	// the bounds are added around the stored levels so the missing levels at both ends are found as well
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT level + 1, next_level - 1 FROM (
+			SELECT level, LEAD(level) OVER (ORDER BY level) AS next_level FROM (
+				SELECT level FROM processed_levels WHERE level BETWEEN $1 AND $2
+				UNION ALL SELECT $1 - 1
+				UNION ALL SELECT $2 + 1
+			) AS levels
+		) AS neighbours
+		WHERE next_level > level + 1
+		ORDER BY level
+	`, fromLevel, toLevel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gaps []types.LevelRange
+	for rows.Next() {
+		var gap types.LevelRange
+		if err := rows.Scan(&gap.Start, &gap.End); err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, gap)
+	}
+
+	return gaps, rows.Err()
+}
+
+// RollbackToLevel moves all delegations above the specified level to the orphaned delegations,
+// forgets the blocks and processed levels above it and rewinds the checkpoint to it in a single transaction.
+func (s *SQLiteStore) RollbackToLevel(ctx context.Context, level uint64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// SQLite can't delete in a common table expression, the rows are copied before being deleted
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO orphaned_delegations (operation_id, op_hash, counter, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, nonce, block, reorg_level)
+		SELECT operation_id, op_hash, counter, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, nonce, block, $1
+		FROM delegations WHERE block > $1
+		ORDER BY block
+	`, level)
+	if err != nil {
+		return fmt.Errorf("failed to orphan delegations: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM delegations WHERE block > $1", level)
+	if err != nil {
+		return fmt.Errorf("failed to delete delegations: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM blocks WHERE level > $1", level)
+	if err != nil {
+		return fmt.Errorf("failed to delete blocks: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM processed_levels WHERE level > $1", level)
+	if err != nil {
+		return fmt.Errorf("failed to delete processed levels: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE checkpoint SET level = $1, block_hash = COALESCE((SELECT hash FROM blocks WHERE level = $1), ''), updated_at = CURRENT_TIMESTAMP
+		WHERE level > $1
+	`, level)
+	if err != nil {
+		return fmt.Errorf("failed to rewind checkpoint: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// GetOrphanedDelegations retrieves a page of at most limit delegations removed by reorgs, most recently orphaned first,
+// along with the cursor of the next page when the page is full. A limit of 0 returns all of them.
+func (s *SQLiteStore) GetOrphanedDelegations(ctx context.Context, limit int, cursor string) ([]types.OrphanedDelegation, string, error) {
+	return queryOrphanedDelegations(ctx, s.db, limit, cursor)
+}
+
+// SaveDiscrepancies records the levels where two sources returned different delegations,
+// the operation lists are stored as JSON arrays.
+func (s *SQLiteStore) SaveDiscrepancies(ctx context.Context, discrepancies []types.Discrepancy) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO discrepancies (level, primary_source, secondary_source, missing_from_primary, missing_from_secondary, mismatched)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, d := range discrepancies {
+		_, err = stmt.ExecContext(ctx, d.Level, d.PrimarySource, d.SecondarySource,
+			jsonArray(d.MissingFromPrimary), jsonArray(d.MissingFromSecondary), jsonArray(d.Mismatched))
+		if err != nil {
+			return fmt.Errorf("failed to save discrepancy: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// jsonArray encodes the values as a JSON array, an empty one for nil.
+func jsonArray(values []string) string {
+	out, _ := json.Marshal(nonNil(values))
+	return string(out)
+}
+
+// sqliteTime formats a time like the stored timestamps, so they compare as text.
+func sqliteTime(t time.Time) any {
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSQLiteStore opens a migrated SQLite store in a temporary file.
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "delegations.db"))
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	store := &SQLiteStore{db: db}
+	require.NoError(t, store.Migrate(context.Background()))
+	return store
+}
+
+func TestSQLiteStore_Migrate(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	current, latest, err := store.SchemaVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, latest, current)
+
+	// the migrations are reverted and applied again
+	assert.NoError(t, store.MigrateTo(ctx, 0))
+	current, _, err = store.SchemaVersion(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, current)
+	assert.NoError(t, store.Migrate(ctx))
+
+	_, err = store.db.ExecContext(ctx, `INSERT INTO schema_version (version, name) VALUES ($1, 'future')`, latest+1)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, store.Migrate(ctx), ErrSchemaTooNew)
+}
+
+func TestOpenSQLiteStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := fmt.Sprintf(`
+server: {host: localhost, port: 8080, metricsPort: 8081, minValidYear: 2018}
+log: {level: info}
+tzkt: {timeout: 10, url: "http://localhost", retryAttempts: 3, retryDelay: 10}
+db: {driver: sqlite, path: "%s"}
+poller: {startLevel: 101, retryAttempts: 3}
+`, filepath.Join(t.TempDir(), "delegations.db"))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	cfg, err := config.LoadConfig(path)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	store, err := NewSQLiteStore(cfg.DB)
+	require.NoError(t, err)
+	require.NoError(t, store.MigrateTo(ctx, 3))
+	require.NoError(t, store.db.Close())
+
+	// opening the database leaves the schema where it is
+	store, err = OpenSQLiteStore(cfg.DB)
+	require.NoError(t, err)
+	defer store.db.Close()
+	current, latest, err := store.SchemaVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, current)
+	assert.Greater(t, latest, 3)
+}
+
+func TestSQLiteStore_MigrateProcessedLevels(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	// a database whose first levels were processed before the blocks were recorded
+	require.NoError(t, store.MigrateTo(ctx, 7))
+	_, err := store.db.ExecContext(ctx, `
+		INSERT INTO delegations (op_hash, counter, timestamp, amount, delegator, block) VALUES ('oo1', 1, '2024-01-01T00:00:00Z', 10, 'tz1', 100);
+		INSERT INTO blocks (level, hash, predecessor) VALUES (105, 'BL105', 'BL104'), (106, 'BL106', 'BL105'), (108, 'BL108', 'BL107');
+		UPDATE checkpoint SET level = 108;
+	`)
+	require.NoError(t, err)
+	require.NoError(t, store.Migrate(ctx))
+
+	gaps, err := store.GetGaps(ctx, 95, 108)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.LevelRange{{Start: 95, End: 99}, {Start: 107, End: 107}}, gaps)
+}
+
+func TestSQLiteStore_SaveDiscrepancies(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	err := store.SaveDiscrepancies(ctx, []types.Discrepancy{
+		{Level: 10, PrimarySource: "tzkt", SecondarySource: "node", MissingFromPrimary: []string{"oo1:7:"}},
+	})
+	assert.NoError(t, err)
+
+	var missing, mismatched string
+	err = store.db.QueryRowContext(ctx, `SELECT missing_from_primary, mismatched FROM discrepancies WHERE level = 10`).Scan(&missing, &mismatched)
+	assert.NoError(t, err)
+	assert.Equal(t, `["oo1:7:"]`, missing)
+	assert.Equal(t, `[]`, mismatched)
+}
@@ -4,77 +4,87 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/metrics"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
 	"github.com/sirupsen/logrus"
 )
 
 // PostgresStore manages the operations with the database.
 type PostgresStore struct {
-	db *sql.DB
+	db            *sql.DB
+	bulkThreshold int
 }
 
 var logger = logrus.WithField("module", "Storer")
 
 // Storer defines the interface for database operations.
 type Storer interface {
-	SaveDelegations(ctx context.Context, delegations []types.FetchedDelegation) error
-	GetDelegations(ctx context.Context, year string) ([]types.Delegation, error)
-	GetCurrentLevel(ctx context.Context) (uint64, error)
-	DeleteDelegationsFromLevel(ctx context.Context, level uint64) error
+	SaveDelegations(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) error
+	SaveBlocks(ctx context.Context, blocks []types.Block, delegations []types.FetchedDelegation) error
+	RepairLevel(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) (bool, error)
+	GetDelegations(ctx context.Context, year string, finalOnly bool) ([]types.Delegation, error)
+	QueryDelegations(ctx context.Context, query types.DelegationQuery) ([]types.Delegation, string, error)
+	FinalizeDelegations(ctx context.Context, level uint64) error
+	GetCheckpoint(ctx context.Context) (types.Checkpoint, error)
+	GetBlocks(ctx context.Context, maxLevel uint64, limit int) ([]types.Block, error)
+	RollbackToLevel(ctx context.Context, level uint64) error
+	GetOrphanedDelegations(ctx context.Context, limit int, cursor string) ([]types.OrphanedDelegation, string, error)
+	SaveDiscrepancies(ctx context.Context, discrepancies []types.Discrepancy) error
+	GetGaps(ctx context.Context, fromLevel, toLevel uint64) ([]types.LevelRange, error)
 }
 
-// NewPostgresStore creates a new instance of PostgresStore.
+// NewPostgresStore creates a new instance of PostgresStore and migrates the database to the latest schema.
 func NewPostgresStore(cfg *config.DBConfig) (*PostgresStore, error) {
-	db, err := sql.Open("postgres", cfg.GetPostgresqlDSN())
+	store, err := OpenPostgresStore(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
-	}
-
-	if err = db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to connect to database: %v", err)
-	}
-
-	store := &PostgresStore{
-		db: db,
+		return nil, err
 	}
 
-	if err := store.init(); err != nil {
+	if err := store.Migrate(context.Background()); err != nil {
 		return nil, err
 	}
 
 	return store, nil
 }
 
-// init is called to initialize necessary tables in the database
-func (s *PostgresStore) init() error {
-	return s.createDelegationTable()
-}
+// OpenPostgresStore connects to the database without migrating it, for the tools managing the schema.
+func OpenPostgresStore(cfg *config.DBConfig) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", cfg.GetPostgresqlDSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
 
-func (s *PostgresStore) createDelegationTable() error {
-	query := `
-		CREATE TABLE IF NOT EXISTS delegations (
-			id SERIAL PRIMARY KEY,
-			timestamp TIMESTAMP NOT NULL,
-			amount BIGINT NOT NULL,
-			delegator TEXT NOT NULL,
-			block INT NOT NULL
-		);
-	`
+	if err = db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
 
-	_, err := s.db.Exec(query)
-	if err != nil {
-		return fmt.Errorf("failed to create delegations table: %v", err)
+	return NewPostgresStoreFromDB(db, cfg.GetBulkThreshold()), nil
+}
+
+// NewPostgresStoreFromDB creates a PostgresStore on an open database, which is not migrated.
+// Batches of more than bulkThreshold delegations are copied in bulk, 0 disables the copy.
+func NewPostgresStoreFromDB(db *sql.DB, bulkThreshold int) *PostgresStore {
+	return &PostgresStore{
+		db:            db,
+		bulkThreshold: bulkThreshold,
 	}
+}
 
-	return nil
+// SaveDelegations saves the delegation data of a block to the database and checkpoints the block in the same transaction.
+// Delegations already stored are updated, so saving the same operations twice is safe. The checkpoint only moves
+// forward, a level below it, such as a repaired gap, is saved without rewinding it.
+func (s *PostgresStore) SaveDelegations(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) error {
+	return s.SaveBlocks(ctx, []types.Block{block}, delegations)
 }
 
-// SaveDelegations saves the delegation data to the database.
-func (s *PostgresStore) SaveDelegations(ctx context.Context, delegations []types.FetchedDelegation) error {
-	if len(delegations) == 0 {
+// SaveBlocks saves consecutive blocks, given in level order, with their delegations in a single transaction
+// and checkpoints the last block, so a backfilled range large enough is copied in bulk.
+func (s *PostgresStore) SaveBlocks(ctx context.Context, blocks []types.Block, delegations []types.FetchedDelegation) error {
+	if len(blocks) == 0 {
 		return nil
 	}
 
@@ -84,91 +94,443 @@ func (s *PostgresStore) SaveDelegations(ctx context.Context, delegations []types
 	}
 	defer tx.Rollback()
 
+	if len(delegations) > 0 {
+		start, method, save := time.Now(), "insert", insertDelegations
+		if s.bulkThreshold > 0 && len(delegations) > s.bulkThreshold {
+			method, save = "copy", copyDelegations
+		}
+		if err := save(ctx, tx, delegations); err != nil {
+			return err
+		}
+		metrics.SetSaveThroughput(method, float64(len(delegations))/time.Since(start).Seconds())
+	}
+
+	if err := saveBlocks(ctx, tx, blocks); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// RepairLevel saves a level missing below the checkpoint with its delegations, without moving the checkpoint.
+// The checkpoint row is locked until the level is saved, so a rollback can't happen in between: a level above
+// the checkpoint, such as one rolled back after it was fetched, is left to the poller and false is returned.
+func (s *PostgresStore) RepairLevel(ctx context.Context, block types.Block, delegations []types.FetchedDelegation) (bool, error) {
+	return repairLevel(ctx, s.db, `SELECT level FROM checkpoint FOR UPDATE`, block, delegations)
+}
+
+// upsertDelegation updates the delegations already stored, a delegation moved to another block is pending again.
+const upsertDelegation = `
+        ON CONFLICT (op_hash, counter, COALESCE(nonce, -1)) WHERE op_hash <> '' DO UPDATE SET
+            operation_id = EXCLUDED.operation_id,
+            timestamp = EXCLUDED.timestamp,
+            amount = EXCLUDED.amount,
+            delegator = EXCLUDED.delegator,
+            new_delegate = EXCLUDED.new_delegate,
+            prev_delegate = EXCLUDED.prev_delegate,
+            status = EXCLUDED.status,
+            baker_fee = EXCLUDED.baker_fee,
+            gas_used = EXCLUDED.gas_used,
+            block = EXCLUDED.block,
+            finality = CASE WHEN delegations.block = EXCLUDED.block THEN delegations.finality ELSE 'pending' END
+`
+
+// insertDelegations upserts the delegations within the given transaction.
+func insertDelegations(ctx context.Context, tx *sql.Tx, delegations []types.FetchedDelegation) error {
 	stmt, err := tx.PrepareContext(ctx, `
-        INSERT INTO delegations (timestamp, amount, delegator, block)
-        VALUES ($1, $2, $3, $4)
-    `)
+        INSERT INTO delegations (operation_id, op_hash, counter, nonce, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+        `+upsertDelegation)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
 	for _, d := range delegations {
-		_, err = stmt.ExecContext(ctx, d.Timestamp, d.Amount, d.Sender.Address, d.Level)
+		_, err = stmt.ExecContext(ctx, d.ID, d.Hash, d.Counter, d.Nonce, d.Timestamp, d.Amount, d.Sender.Address,
+			d.NewDelegateAddress(), d.PrevDelegateAddress(), d.Status, d.BakerFee, d.GasUsed, d.Level)
 		if err != nil {
 			return fmt.Errorf("failed to save delegation: %w", err)
 		}
 	}
 
+	return nil
+}
+
+// copyDelegations upserts the delegations within the given transaction by copying them to a staging table
+// merged into the delegations in a single statement, which is much faster than insertDelegations on large batches.
+func copyDelegations(ctx context.Context, tx *sql.Tx, delegations []types.FetchedDelegation) error {
+	_, err := tx.ExecContext(ctx, `
+		CREATE TEMP TABLE delegations_staging ON COMMIT DROP AS
+		SELECT operation_id, op_hash, counter, nonce, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block
+		FROM delegations WITH NO DATA
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create staging table: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("delegations_staging", "operation_id", "op_hash", "counter", "nonce", "timestamp",
+		"amount", "delegator", "new_delegate", "prev_delegate", "status", "baker_fee", "gas_used", "block"))
+	if err != nil {
+		return fmt.Errorf("failed to start copy: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, d := range lastOccurrences(delegations) {
+		_, err = stmt.ExecContext(ctx, d.ID, d.Hash, d.Counter, d.Nonce, d.Timestamp, d.Amount, d.Sender.Address,
+			d.NewDelegateAddress(), d.PrevDelegateAddress(), d.Status, d.BakerFee, d.GasUsed, d.Level)
+		if err != nil {
+			return fmt.Errorf("failed to copy delegation: %w", err)
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("failed to copy delegations: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO delegations (operation_id, op_hash, counter, nonce, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block)
+		SELECT operation_id, op_hash, counter, nonce, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block
+		FROM delegations_staging
+		`+upsertDelegation)
+	if err != nil {
+		return fmt.Errorf("failed to merge delegations: %w", err)
+	}
+
+	return nil
+}
+
+// lastOccurrences drops the delegations of an operation appearing again later in the batch: a single statement can't
+// update a row twice, and the last occurrence is the one insertDelegations would leave.
+func lastOccurrences(delegations []types.FetchedDelegation) []types.FetchedDelegation {
+	type key struct {
+		hash    string
+		counter uint64
+		nonce   int64
+	}
+	keyOf := func(d types.FetchedDelegation) key {
+		k := key{hash: d.Hash, counter: d.Counter, nonce: -1}
+		if d.Nonce != nil {
+			k.nonce = int64(*d.Nonce)
+		}
+		return k
+	}
+
+	last := make(map[key]int, len(delegations))
+	for i, d := range delegations {
+		if d.Hash != "" {
+			last[keyOf(d)] = i
+		}
+	}
+	if len(last) == len(delegations) {
+		return delegations
+	}
+
+	unique := make([]types.FetchedDelegation, 0, len(last))
+	for i, d := range delegations {
+		if d.Hash == "" || last[keyOf(d)] == i {
+			unique = append(unique, d)
+		}
+	}
+	return unique
+}
+
+// saveBlocks checkpoints the last of the blocks and records each of them as processed within the given transaction.
+func saveBlocks(ctx context.Context, tx *sql.Tx, blocks []types.Block) error {
+	if err := saveCheckpoint(ctx, tx, blocks[len(blocks)-1]); err != nil {
+		return err
+	}
+
+	for _, block := range blocks {
+		if err := saveLevel(ctx, tx, block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveLevel records the level of a block as processed, along with the block when its hash is known,
+// within the given transaction.
+func saveLevel(ctx context.Context, tx *sql.Tx, block types.Block) error {
+	if err := saveProcessedLevel(ctx, tx, block.Level); err != nil {
+		return err
+	}
+	if block.Hash == "" {
+		return nil
+	}
+	if err := saveBlock(ctx, tx, block); err != nil {
+		return err
+	}
+	return resolveOrphanedDelegations(ctx, tx, block)
+}
+
+// repairLevel saves a level missing below the checkpoint without moving the checkpoint. The checkpoint is read
+// by checkpointQuery in the transaction saving the level, which must keep a rollback from running in between.
+// A level above the checkpoint is not saved and false is returned.
+func repairLevel(ctx context.Context, db *sql.DB, checkpointQuery string, block types.Block, delegations []types.FetchedDelegation) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var checkpoint uint64
+	if err := tx.QueryRowContext(ctx, checkpointQuery).Scan(&checkpoint); err != nil {
+		return false, fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+	if block.Level > checkpoint {
+		return false, nil
+	}
+
+	if len(delegations) > 0 {
+		if err := insertDelegations(ctx, tx, delegations); err != nil {
+			return false, err
+		}
+	}
+	if err := saveLevel(ctx, tx, block); err != nil {
+		return false, err
+	}
+
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
+	return true, nil
+}
+
+// saveCheckpoint moves the checkpoint forward to the given block within the given transaction.
+func saveCheckpoint(ctx context.Context, tx *sql.Tx, block types.Block) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE checkpoint SET level = $1, block_hash = $2, updated_at = CURRENT_TIMESTAMP WHERE level <= $1
+	`, block.Level, block.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// saveProcessedLevel records the given level as processed within the given transaction, so the gap scan doesn't
+// depend on the blocks, which are not known for the levels processed before they were recorded.
+func saveProcessedLevel(ctx context.Context, tx *sql.Tx, level uint64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO processed_levels (level) VALUES ($1) ON CONFLICT DO NOTHING`, level)
+	if err != nil {
+		return fmt.Errorf("failed to save processed level: %w", err)
+	}
+	return nil
+}
+
+// saveBlock records the hashes of the given block within the given transaction.
+func saveBlock(ctx context.Context, tx *sql.Tx, block types.Block) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO blocks (level, hash, predecessor) VALUES ($1, $2, $3)
+		ON CONFLICT (level) DO UPDATE SET hash = EXCLUDED.hash, predecessor = EXCLUDED.predecessor
+	`, block.Level, block.Hash, block.Predecessor)
+	if err != nil {
+		return fmt.Errorf("failed to save block: %w", err)
+	}
+	return nil
+}
+
+// resolveOrphanedDelegations records the given block as the replacement of the blocks orphaned at the same level.
+func resolveOrphanedDelegations(ctx context.Context, tx *sql.Tx, block types.Block) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE orphaned_delegations SET replacing_block_hash = $2
+		WHERE block = $1 AND replacing_block_hash IS NULL
+	`, block.Level, block.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to resolve orphaned delegations: %w", err)
+	}
 	return nil
 }
 
 // GetDelegations retrieves delegations from the database for a specified year.
-func (s *PostgresStore) GetDelegations(ctx context.Context, year string) ([]types.Delegation, error) {
-	var rows *sql.Rows
-	var err error
-
-	if year != "" {
-		query := `
-			SELECT timestamp, amount, delegator, block
-			FROM delegations
-			WHERE EXTRACT(YEAR FROM timestamp) = $1
-			ORDER BY timestamp DESC
-		`
-		rows, err = s.db.QueryContext(ctx, query, year)
-	} else {
-		query := `
-			SELECT timestamp, amount, delegator, block
-			FROM delegations
-			ORDER BY timestamp DESC
-		`
-		rows, err = s.db.QueryContext(ctx, query)
+// With finalOnly, the delegations still pending finality are left out.
+func (s *PostgresStore) GetDelegations(ctx context.Context, year string, finalOnly bool) ([]types.Delegation, error) {
+	query, err := yearQuery(year, finalOnly)
+	if err != nil {
+		return nil, err
+	}
+	delegations, _, err := s.QueryDelegations(ctx, query)
+	return delegations, err
+}
+
+// QueryDelegations retrieves the delegations matching the query, along with the cursor of the next page
+// when the page is full.
+func (s *PostgresStore) QueryDelegations(ctx context.Context, query types.DelegationQuery) ([]types.Delegation, string, error) {
+	return queryDelegations(ctx, s.db, query, func(t time.Time) any { return t.UTC() })
+}
+
+// FinalizeDelegations promotes the pending delegations of the blocks at or below the given level to final.
+func (s *PostgresStore) FinalizeDelegations(ctx context.Context, level uint64) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE delegations SET finality = $2 WHERE finality = $3 AND block <= $1
+	`, level, types.FinalityFinal, types.FinalityPending)
+	if err != nil {
+		return fmt.Errorf("failed to finalize delegations: %w", err)
+	}
+	return nil
+}
+
+// GetCheckpoint retrieves the last fully processed level and its block hash.
+func (s *PostgresStore) GetCheckpoint(ctx context.Context) (types.Checkpoint, error) {
+	var checkpoint types.Checkpoint
+	err := s.db.QueryRowContext(ctx, `SELECT level, block_hash FROM checkpoint`).Scan(&checkpoint.Level, &checkpoint.BlockHash)
+	if err != nil {
+		return types.Checkpoint{}, fmt.Errorf("failed to query database: %w", err)
+	}
+	return checkpoint, nil
+}
+
+// GetBlocks retrieves at most limit processed blocks at or below maxLevel, highest level first.
+func (s *PostgresStore) GetBlocks(ctx context.Context, maxLevel uint64, limit int) ([]types.Block, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT level, hash, predecessor FROM blocks
+		WHERE level <= $1
+		ORDER BY level DESC
+		LIMIT $2
+	`, maxLevel, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocks []types.Block
+	for rows.Next() {
+		var b types.Block
+		if err := rows.Scan(&b.Level, &b.Hash, &b.Predecessor); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
 	}
 
+	return blocks, rows.Err()
+}
+
+// GetGaps returns the ranges of levels between fromLevel and toLevel (both included) that were never processed.
+func (s *PostgresStore) GetGaps(ctx context.Context, fromLevel, toLevel uint64) ([]types.LevelRange, error) {
+	// the bounds are added around the stored levels so the missing levels at both ends are found as well
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT level + 1, next_level - 1 FROM (
+			SELECT level, LEAD(level) OVER (ORDER BY level) AS next_level FROM (
+				SELECT level FROM processed_levels WHERE level BETWEEN $1 AND $2
+				UNION ALL SELECT $1::BIGINT - 1
+				UNION ALL SELECT $2::BIGINT + 1
+			) AS levels
+		) AS neighbours
+		WHERE next_level > level + 1
+		ORDER BY level
+	`, fromLevel, toLevel)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var delegations []types.Delegation
+	var gaps []types.LevelRange
 	for rows.Next() {
-		var d types.Delegation
-		if err := rows.Scan(&d.Timestamp, &d.Amount, &d.Delegator, &d.Block); err != nil {
+		var gap types.LevelRange
+		if err := rows.Scan(&gap.Start, &gap.End); err != nil {
 			return nil, err
 		}
-		delegations = append(delegations, d)
+		gaps = append(gaps, gap)
 	}
 
-	return delegations, nil
+	return gaps, rows.Err()
 }
 
-// GetCurrentLevel retrieves the highest block level from the delegations table.
-func (s *PostgresStore) GetCurrentLevel(ctx context.Context) (uint64, error) {
-	var level uint64
-	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(block),0) FROM delegations`).Scan(&level)
+// RollbackToLevel moves all delegations above the specified level to the orphaned delegations,
+// forgets the blocks and processed levels above it and rewinds the checkpoint to it in a single transaction.
+func (s *PostgresStore) RollbackToLevel(ctx context.Context, level uint64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to query database: %w", err)
+		return err
 	}
-	return level, nil
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		WITH orphaned AS (
+			DELETE FROM delegations WHERE block > $1
+			RETURNING operation_id, op_hash, counter, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, nonce, block
+		)
+		INSERT INTO orphaned_delegations (operation_id, op_hash, counter, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, nonce, block, reorg_level)
+		SELECT operation_id, op_hash, counter, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, nonce, block, $1
+		FROM orphaned
+		ORDER BY block
+	`, level)
+	if err != nil {
+		return fmt.Errorf("failed to orphan delegations: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM blocks WHERE level > $1", level)
+	if err != nil {
+		return fmt.Errorf("failed to delete blocks: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM processed_levels WHERE level > $1", level)
+	if err != nil {
+		return fmt.Errorf("failed to delete processed levels: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE checkpoint SET level = $1, block_hash = COALESCE((SELECT hash FROM blocks WHERE level = $1), ''), updated_at = NOW()
+		WHERE level > $1
+	`, level)
+	if err != nil {
+		return fmt.Errorf("failed to rewind checkpoint: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
 }
 
-// DeleteDelegationsFromLevel deletes all delegations from the database that are at or above a specified level.
-func (s *PostgresStore) DeleteDelegationsFromLevel(ctx context.Context, level uint64) error {
+// GetOrphanedDelegations retrieves a page of at most limit delegations removed by reorgs, most recently orphaned first,
+// along with the cursor of the next page when the page is full. A limit of 0 returns all of them.
+func (s *PostgresStore) GetOrphanedDelegations(ctx context.Context, limit int, cursor string) ([]types.OrphanedDelegation, string, error) {
+	return queryOrphanedDelegations(ctx, s.db, limit, cursor)
+}
 
-	stmt, err := s.db.PrepareContext(ctx, "DELETE FROM delegations WHERE level >= $1")
+// SaveDiscrepancies records the levels where two sources returned different delegations.
+func (s *PostgresStore) SaveDiscrepancies(ctx context.Context, discrepancies []types.Discrepancy) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	_, err = stmt.ExecContext(ctx, level)
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO discrepancies (level, primary_source, secondary_source, missing_from_primary, missing_from_secondary, mismatched)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
+
+	for _, d := range discrepancies {
+		_, err = stmt.ExecContext(ctx, d.Level, d.PrimarySource, d.SecondarySource,
+			pq.Array(nonNil(d.MissingFromPrimary)), pq.Array(nonNil(d.MissingFromSecondary)), pq.Array(nonNil(d.Mismatched)))
+		if err != nil {
+			return fmt.Errorf("failed to save discrepancy: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 
 	return nil
 }
+
+// nonNil returns an empty slice for nil so it is stored as an empty array instead of NULL.
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
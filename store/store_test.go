@@ -3,15 +3,22 @@ package store
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"os"
 	"regexp"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+var delegationColumns = []string{"operation_id", "op_hash", "counter", "timestamp", "amount", "delegator", "new_delegate", "prev_delegate", "status", "baker_fee", "gas_used", "block"}
+
 func TestSaveDelegations(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -22,25 +29,234 @@ func TestSaveDelegations(t *testing.T) {
 	store := &PostgresStore{db: db}
 	ctx := context.Background()
 	delegations := []types.FetchedDelegation{
-		{Timestamp: time.Now().String(), Amount: 100, Sender: types.Sender{Address: "tz1"}, Level: 1},
+		{ID: 42, Hash: "oo1", Counter: 7, Timestamp: time.Now().String(), Amount: 100, Sender: types.Sender{Address: "tz1"},
+			NewDelegate: &types.Delegate{Address: "tz1baker"}, Status: "applied", BakerFee: 400, GasUsed: 1000, Level: 1},
 	}
 
 	mock.ExpectBegin()
-	prep := mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO delegations (timestamp, amount, delegator, block) VALUES ($1, $2, $3, $4)"))
+	prep := mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO delegations (operation_id, op_hash, counter, nonce, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) ON CONFLICT (op_hash, counter, COALESCE(nonce, -1)) WHERE op_hash <> '' DO UPDATE SET"))
 	for _, d := range delegations {
-		prep.ExpectExec().WithArgs(d.Timestamp, d.Amount, d.Sender.Address, d.Level).WillReturnResult(sqlmock.NewResult(1, 1))
+		prep.ExpectExec().WithArgs(d.ID, d.Hash, d.Counter, nil, d.Timestamp, d.Amount, d.Sender.Address, "tz1baker", nil, d.Status, d.BakerFee, d.GasUsed, d.Level).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE checkpoint SET level = $1, block_hash = $2")).
+		WithArgs(uint64(1), "BL1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO processed_levels (level) VALUES ($1) ON CONFLICT DO NOTHING")).
+		WithArgs(uint64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO blocks (level, hash, predecessor) VALUES ($1, $2, $3)")).
+		WithArgs(uint64(1), "BL1", "BL0").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE orphaned_delegations SET replacing_block_hash = $2 WHERE block = $1 AND replacing_block_hash IS NULL")).
+		WithArgs(uint64(1), "BL1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	err = store.SaveDelegations(ctx, types.Block{Level: 1, Hash: "BL1", Predecessor: "BL0"}, delegations)
+	assert.NoError(t, err)
+
+	// an empty level only moves the checkpoint
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE checkpoint SET level = $1, block_hash = $2")).
+		WithArgs(uint64(2), "BL2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO processed_levels (level) VALUES ($1) ON CONFLICT DO NOTHING")).
+		WithArgs(uint64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO blocks")).
+		WithArgs(uint64(2), "BL2", "BL1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE orphaned_delegations SET replacing_block_hash = $2")).
+		WithArgs(uint64(2), "BL2").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	err = store.SaveDelegations(ctx, types.Block{Level: 2, Hash: "BL2", Predecessor: "BL1"}, nil)
+	assert.NoError(t, err)
+
+	// nothing is committed if the checkpoint can't be saved
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE checkpoint SET level = $1, block_hash = $2")).
+		WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	err = store.SaveDelegations(ctx, types.Block{Level: 3, Hash: "BL3", Predecessor: "BL2"}, nil)
+	assert.Error(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSaveDelegations_Copy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &PostgresStore{db: db, bulkThreshold: 2}
+	ctx := context.Background()
+	delegations := []types.FetchedDelegation{
+		{ID: 42, Hash: "oo1", Counter: 7, Amount: 100, Sender: types.Sender{Address: "tz1"}, Level: 1},
+		{ID: 43, Hash: "oo2", Counter: 8, Amount: 200, Sender: types.Sender{Address: "tz2"}, Level: 1},
+		{ID: 42, Hash: "oo1", Counter: 7, Amount: 150, Sender: types.Sender{Address: "tz1"}, Level: 1},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TEMP TABLE delegations_staging ON COMMIT DROP")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "delegations_staging" ("operation_id", "op_hash", "counter", "nonce", "timestamp", "amount", "delegator", "new_delegate", "prev_delegate", "status", "baker_fee", "gas_used", "block") FROM STDIN`))
+	// the operation appearing twice is only copied once, with its last values
+	prep.ExpectExec().WithArgs(43, "oo2", 8, nil, "", 200, "tz2", nil, nil, "", 0, 0, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs(42, "oo1", 7, nil, "", 150, "tz1", nil, nil, "", 0, 0, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithoutArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO delegations (operation_id, op_hash, counter, nonce, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block) SELECT")).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE checkpoint SET level = $1, block_hash = $2")).
+		WithArgs(uint64(1), "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO processed_levels (level) VALUES ($1) ON CONFLICT DO NOTHING")).
+		WithArgs(uint64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = store.SaveDelegations(ctx, types.Block{Level: 1}, delegations)
+	assert.NoError(t, err)
+
+	// batches up to the threshold are inserted one by one
+	mock.ExpectBegin()
+	prep = mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO delegations (operation_id, op_hash, counter, nonce, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block) VALUES"))
+	prep.ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
+	prep.ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE checkpoint SET level = $1, block_hash = $2")).
+		WithArgs(uint64(2), "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO processed_levels (level) VALUES ($1) ON CONFLICT DO NOTHING")).
+		WithArgs(uint64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = store.SaveDelegations(ctx, types.Block{Level: 2}, delegations[:2])
+	assert.NoError(t, err)
+
+	// nothing is committed if the merge fails
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TEMP TABLE delegations_staging")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	prep = mock.ExpectPrepare(regexp.QuoteMeta(`COPY "delegations_staging"`))
+	prep.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithoutArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("FROM delegations_staging")).WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	err = store.SaveDelegations(ctx, types.Block{Level: 3}, delegations)
+	assert.ErrorContains(t, err, "failed to merge delegations")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRepairLevel(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &PostgresStore{db: db}
+	ctx := context.Background()
+
+	// the checkpoint is locked, the level below it is saved without moving it
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT level FROM checkpoint FOR UPDATE")).
+		WillReturnRows(sqlmock.NewRows([]string{"level"}).AddRow(10))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO processed_levels (level) VALUES ($1) ON CONFLICT DO NOTHING")).
+		WithArgs(uint64(5)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO blocks (level, hash, predecessor) VALUES ($1, $2, $3)")).
+		WithArgs(uint64(5), "BL5", "BL4").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE orphaned_delegations SET replacing_block_hash = $2")).
+		WithArgs(uint64(5), "BL5").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	saved, err := store.RepairLevel(ctx, types.Block{Level: 5, Hash: "BL5", Predecessor: "BL4"}, nil)
+	assert.NoError(t, err)
+	assert.True(t, saved)
+
+	// a level above the checkpoint is not saved
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT level FROM checkpoint FOR UPDATE")).
+		WillReturnRows(sqlmock.NewRows([]string{"level"}).AddRow(10))
+	mock.ExpectRollback()
+
+	saved, err = store.RepairLevel(ctx, types.Block{Level: 11, Hash: "BL11"}, nil)
+	assert.NoError(t, err)
+	assert.False(t, saved)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSaveBlocks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &PostgresStore{db: db, bulkThreshold: 2}
+	ctx := context.Background()
+	delegations := []types.FetchedDelegation{
+		{ID: 42, Hash: "oo1", Counter: 7, Amount: 100, Sender: types.Sender{Address: "tz1"}, Level: 1},
+		{ID: 43, Hash: "oo2", Counter: 8, Amount: 200, Sender: types.Sender{Address: "tz2"}, Level: 2},
+		{ID: 44, Hash: "oo3", Counter: 9, Amount: 300, Sender: types.Sender{Address: "tz3"}, Level: 2},
+	}
+
+	// the delegations of the blocks are copied together, above the threshold of a single block
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TEMP TABLE delegations_staging")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "delegations_staging"`))
+	for range delegations {
+		prep.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	prep.ExpectExec().WithoutArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("FROM delegations_staging")).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE checkpoint SET level = $1, block_hash = $2")).
+		WithArgs(uint64(2), "BL2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for level := uint64(1); level <= 2; level++ {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO processed_levels (level) VALUES ($1) ON CONFLICT DO NOTHING")).
+			WithArgs(level).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO blocks (level, hash, predecessor) VALUES ($1, $2, $3)")).
+			WithArgs(level, fmt.Sprintf("BL%d", level), fmt.Sprintf("BL%d", level-1)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE orphaned_delegations SET replacing_block_hash = $2")).
+			WithArgs(level, fmt.Sprintf("BL%d", level)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
 	}
 	mock.ExpectCommit()
 
-	err = store.SaveDelegations(ctx, delegations)
+	err = store.SaveBlocks(ctx, []types.Block{{Level: 1, Hash: "BL1", Predecessor: "BL0"}, {Level: 2, Hash: "BL2", Predecessor: "BL1"}}, delegations)
 	assert.NoError(t, err)
 
+	// an empty batch doesn't open a transaction
+	assert.NoError(t, store.SaveBlocks(ctx, nil, nil))
+
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
 
-func TestGetCurrentLevel(t *testing.T) {
+func TestGetCheckpoint(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatal(err)
@@ -50,12 +266,113 @@ func TestGetCurrentLevel(t *testing.T) {
 	store := &PostgresStore{db: db}
 	ctx := context.Background()
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(block),0) FROM delegations")).
-		WillReturnRows(sqlmock.NewRows([]string{"COALESCE"}).AddRow(10))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT level, block_hash FROM checkpoint")).
+		WillReturnRows(sqlmock.NewRows([]string{"level", "block_hash"}).AddRow(10, "BL10"))
 
-	level, err := store.GetCurrentLevel(ctx)
+	checkpoint, err := store.GetCheckpoint(ctx)
 	assert.NoError(t, err)
-	assert.Equal(t, uint64(10), level)
+	assert.Equal(t, types.Checkpoint{Level: 10, BlockHash: "BL10"}, checkpoint)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetBlocks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &PostgresStore{db: db}
+	ctx := context.Background()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT level, hash, predecessor FROM blocks WHERE level <= $1 ORDER BY level DESC LIMIT $2")).
+		WithArgs(uint64(11), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"level", "hash", "predecessor"}).
+			AddRow(11, "BL11", "BL10").
+			AddRow(10, "BL10", "BL9"))
+
+	blocks, err := store.GetBlocks(ctx, 11, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Block{{Level: 11, Hash: "BL11", Predecessor: "BL10"}, {Level: 10, Hash: "BL10", Predecessor: "BL9"}}, blocks)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM blocks")).WillReturnError(sql.ErrConnDone)
+
+	_, err = store.GetBlocks(ctx, 11, 2)
+	assert.Error(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSaveDiscrepancies(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &PostgresStore{db: db}
+	ctx := context.Background()
+
+	discrepancies := []types.Discrepancy{
+		{Level: 10, PrimarySource: "tzkt", SecondarySource: "node", MissingFromPrimary: []string{"oo1/7"}},
+		{Level: 12, PrimarySource: "tzkt", SecondarySource: "node", Mismatched: []string{"oo2/8", "oo3/9/1"}},
+	}
+
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO discrepancies"))
+	prep.ExpectExec().
+		WithArgs(uint64(10), "tzkt", "node", pq.Array([]string{"oo1/7"}), pq.Array([]string{}), pq.Array([]string{})).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	prep.ExpectExec().
+		WithArgs(uint64(12), "tzkt", "node", pq.Array([]string{}), pq.Array([]string{}), pq.Array([]string{"oo2/8", "oo3/9/1"})).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	err = store.SaveDiscrepancies(ctx, discrepancies)
+	assert.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO discrepancies")).ExpectExec().WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	err = store.SaveDiscrepancies(ctx, discrepancies)
+	assert.Error(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetGaps(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &PostgresStore{db: db}
+	ctx := context.Background()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT level + 1, next_level - 1 FROM")).
+		WithArgs(uint64(100), uint64(200)).
+		WillReturnRows(sqlmock.NewRows([]string{"start", "end"}).
+			AddRow(100, 101).
+			AddRow(150, 150).
+			AddRow(190, 200))
+
+	gaps, err := store.GetGaps(ctx, 100, 200)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.LevelRange{{Start: 100, End: 101}, {Start: 150, End: 150}, {Start: 190, End: 200}}, gaps)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM processed_levels")).WillReturnError(sql.ErrConnDone)
+
+	_, err = store.GetGaps(ctx, 100, 200)
+	assert.Error(t, err)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -72,35 +389,65 @@ func TestGetDelegations(t *testing.T) {
 	store := &PostgresStore{db: db}
 	ctx := context.Background()
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT timestamp, amount, delegator, block FROM delegations WHERE EXTRACT(YEAR FROM timestamp) = $1 ORDER BY timestamp DESC")).
-		WithArgs("2024").
-		WillReturnRows(sqlmock.NewRows([]string{"timestamp", "amount", "delegator", "block"}).
-			AddRow("2024-04-21T16:23:27Z", 100, "tz1", 1))
+	columns := append([]string{"id"}, append(delegationColumns, "finality")...)
+	selectQuery := "SELECT id, operation_id, op_hash, counter, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block, finality FROM delegations"
+
+	// the year is a timestamp range, so the timestamp index is used
+	from := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(selectQuery+" WHERE timestamp >= $1 AND timestamp < $2 ORDER BY timestamp DESC, id DESC")).
+		WithArgs(from, to).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, 42, "oo1", 7, "2024-04-21T16:23:27Z", 100, "tz1", "tz1baker", nil, "applied", 400, 1000, 1, "final"))
 
-	delegations, err := store.GetDelegations(ctx, "2024")
+	delegations, err := store.GetDelegations(ctx, "2024", false)
 	assert.NoError(t, err)
 	assert.Len(t, delegations, 1, "Expected one delegations fetched for year 2024")
+	assert.Equal(t, "oo1", delegations[0].Hash)
+	assert.Equal(t, "tz1baker", *delegations[0].NewDelegate)
+	assert.Nil(t, delegations[0].PrevDelegate)
+	assert.Equal(t, types.FinalityFinal, delegations[0].Finality)
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT timestamp, amount, delegator, block FROM delegations ORDER BY timestamp DESC")).
-		WillReturnRows(sqlmock.NewRows([]string{"timestamp", "amount", "delegator", "block"}).
-			AddRow("2024-04-21T16:23:27Z", 200, "tz2", 2).
-			AddRow("2023-04-21T16:23:27Z", 300, "tz3", 3))
+	mock.ExpectQuery(regexp.QuoteMeta(selectQuery + " ORDER BY timestamp DESC, id DESC")).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(2, 43, "oo2", 8, "2024-04-21T16:23:27Z", 200, "tz2", "tz1baker", "tz2baker", "applied", 400, 1000, 2, "pending").
+			AddRow(3, 44, "oo3", 9, "2023-04-21T16:23:27Z", 300, "tz3", nil, "tz1baker", "applied", 400, 1000, 3, "final"))
 
-	allDelegations, err := store.GetDelegations(ctx, "")
+	allDelegations, err := store.GetDelegations(ctx, "", false)
 	assert.NoError(t, err)
 	assert.Len(t, allDelegations, 2, "Expected two delegation fetched for all years")
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT timestamp, amount, delegator, block FROM delegations ORDER BY timestamp DESC")).
+	mock.ExpectQuery(regexp.QuoteMeta(selectQuery + " WHERE finality = $1 ORDER BY timestamp DESC, id DESC")).
+		WithArgs("final").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(3, 44, "oo3", 9, "2023-04-21T16:23:27Z", 300, "tz3", nil, "tz1baker", "applied", 400, 1000, 3, "final"))
+
+	finalDelegations, err := store.GetDelegations(ctx, "", true)
+	assert.NoError(t, err)
+	assert.Len(t, finalDelegations, 1, "Expected the pending delegation to be left out")
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectQuery+" WHERE timestamp >= $1 AND timestamp < $2 AND finality = $3 ORDER BY timestamp DESC, id DESC")).
+		WithArgs(from, to, "final").
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	finalDelegations, err = store.GetDelegations(ctx, "2024", true)
+	assert.NoError(t, err)
+	assert.Empty(t, finalDelegations)
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectQuery + " ORDER BY timestamp DESC, id DESC")).
 		WillReturnError(sql.ErrConnDone)
 
-	_, err = store.GetDelegations(ctx, "")
+	_, err = store.GetDelegations(ctx, "", false)
 	assert.Error(t, err)
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT timestamp, amount, delegator, block FROM delegations ORDER BY timestamp DESC")).
-		WillReturnRows(sqlmock.NewRows([]string{"timestamp", "amount", "delegator", "block"}).
-			AddRow(time.Now(), "not-a-number", "delegator4", "not-a-number"))
+	mock.ExpectQuery(regexp.QuoteMeta(selectQuery + " ORDER BY timestamp DESC, id DESC")).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(4, 45, "oo4", 10, time.Now(), "not-a-number", "delegator4", nil, nil, "applied", 0, 0, "not-a-number", "pending"))
 
-	_, err = store.GetDelegations(ctx, "")
+	_, err = store.GetDelegations(ctx, "", false)
+	assert.Error(t, err)
+
+	_, err = store.GetDelegations(ctx, "twenty", false)
 	assert.Error(t, err)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -108,7 +455,78 @@ func TestGetDelegations(t *testing.T) {
 	}
 }
 
-func TestDeleteDelegationsFromLevel(t *testing.T) {
+func TestQueryDelegations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &PostgresStore{db: db}
+	ctx := context.Background()
+
+	columns := append([]string{"id"}, append(delegationColumns, "finality")...)
+	selectQuery := "SELECT id, operation_id, op_hash, counter, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block, finality FROM delegations"
+	query := types.DelegationQuery{MinLevel: 10, MaxLevel: 20, Delegator: "tz1", Baker: "tz1baker", MinAmount: 100, MaxAmount: 1000, Ascending: true, Limit: 2}
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectQuery+" WHERE block >= $1 AND block <= $2 AND delegator = $3 AND new_delegate = $4 AND amount >= $5 AND amount <= $6 ORDER BY timestamp ASC, id ASC LIMIT $7")).
+		WithArgs(uint64(10), uint64(20), "tz1", "tz1baker", uint64(100), uint64(1000), 2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, 42, "oo1", 7, "2024-04-21T16:23:27Z", 100, "tz1", "tz1baker", nil, "applied", 400, 1000, 11, "final").
+			AddRow(5, 43, "oo2", 8, "2024-04-21T16:23:57Z", 200, "tz1", "tz1baker", nil, "applied", 400, 1000, 12, "final"))
+
+	page, cursor, err := store.QueryDelegations(ctx, query)
+	assert.NoError(t, err)
+	assert.Len(t, page, 2)
+	assert.NotEmpty(t, cursor, "a full page has a next page")
+
+	// the next page starts after the last delegation of the page
+	query.Cursor = cursor
+	mock.ExpectQuery(regexp.QuoteMeta(selectQuery+" WHERE block >= $1 AND block <= $2 AND delegator = $3 AND new_delegate = $4 AND amount >= $5 AND amount <= $6 AND (timestamp, id) > ($7, $8) ORDER BY timestamp ASC, id ASC LIMIT $9")).
+		WithArgs(uint64(10), uint64(20), "tz1", "tz1baker", uint64(100), uint64(1000), time.Date(2024, time.April, 21, 16, 23, 57, 0, time.UTC), 5, 2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(6, 44, "oo3", 9, "2024-04-21T16:24:27Z", 300, "tz1", "tz1baker", nil, "applied", 400, 1000, 13, "final"))
+
+	page, cursor, err = store.QueryDelegations(ctx, query)
+	assert.NoError(t, err)
+	assert.Len(t, page, 1)
+	assert.Empty(t, cursor, "the last page has no next page")
+
+	_, _, err = store.QueryDelegations(ctx, types.DelegationQuery{Cursor: "not a cursor"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFinalizeDelegations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &PostgresStore{db: db}
+	ctx := context.Background()
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE delegations SET finality = $2 WHERE finality = $3 AND block <= $1")).
+		WithArgs(uint64(98), "final", "pending").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	assert.NoError(t, store.FinalizeDelegations(ctx, 98))
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE delegations SET finality")).
+		WillReturnError(sql.ErrConnDone)
+
+	assert.Error(t, store.FinalizeDelegations(ctx, 99))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRollbackToLevel(t *testing.T) {
 
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -121,24 +539,240 @@ func TestDeleteDelegationsFromLevel(t *testing.T) {
 
 	level := uint64(10)
 
-	mock.ExpectPrepare(regexp.QuoteMeta("DELETE FROM delegations WHERE level >= $1")).
-		ExpectExec().
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("WITH orphaned AS ( DELETE FROM delegations WHERE block > $1")).
+		WithArgs(level).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM blocks WHERE level > $1")).
+		WithArgs(level).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM processed_levels WHERE level > $1")).
+		WithArgs(level).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE checkpoint SET level = $1, block_hash = COALESCE((SELECT hash FROM blocks WHERE level = $1), ''), updated_at = NOW() WHERE level > $1")).
 		WithArgs(level).
 		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
 
-	err = store.DeleteDelegationsFromLevel(ctx, level)
+	err = store.RollbackToLevel(ctx, level)
 	assert.NoError(t, err)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	mock.ExpectPrepare(regexp.QuoteMeta("DELETE FROM delegations WHERE level >= $1")).
+	// the delete is rolled back if the checkpoint can't be rewound
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("WITH orphaned AS ( DELETE FROM delegations WHERE block > $1")).
+		WithArgs(level).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM blocks WHERE level > $1")).
+		WithArgs(level).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM processed_levels WHERE level > $1")).
+		WithArgs(level).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE checkpoint SET level = $1")).
 		WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
 
-	err = store.DeleteDelegationsFromLevel(ctx, level)
+	err = store.RollbackToLevel(ctx, level)
 	assert.Error(t, err)
 
-	err = store.DeleteDelegationsFromLevel(ctx, level)
+	mock.ExpectBegin().WillReturnError(sql.ErrConnDone)
+
+	err = store.RollbackToLevel(ctx, level)
 	assert.Error(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetOrphanedDelegations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &PostgresStore{db: db}
+	ctx := context.Background()
+
+	columns := append([]string{"id"}, append(delegationColumns, "reorg_level", "detected_at", "replacing_block_hash")...)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, operation_id, op_hash, counter, timestamp, amount, delegator, new_delegate, prev_delegate, status, baker_fee, gas_used, block, reorg_level, detected_at, replacing_block_hash FROM orphaned_delegations ORDER BY id DESC LIMIT $1")).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(5, 42, "oo1", 7, "2024-04-21T16:23:27Z", 100, "tz1", "tz1baker", nil, "applied", 400, 1000, 11, 10, "2024-04-21T16:24:00Z", "BL11b").
+			AddRow(4, 43, "oo2", 8, "2024-04-21T16:23:57Z", 200, "tz2", nil, "tz1baker", "applied", 400, 1000, 12, 10, "2024-04-21T16:24:00Z", nil))
+
+	orphaned, next, err := store.GetOrphanedDelegations(ctx, 2, "")
+	assert.NoError(t, err)
+	assert.Len(t, orphaned, 2)
+	assert.Equal(t, "oo1", orphaned[0].Hash)
+	assert.Equal(t, uint64(10), orphaned[0].ReorgLevel)
+	assert.Equal(t, "BL11b", *orphaned[0].ReplacingBlockHash)
+	assert.Nil(t, orphaned[1].ReplacingBlockHash, "the level was not processed again yet")
+	assert.Equal(t, encodeOrphanedCursor(4), next)
+
+	// the next page starts below the last row id
+	mock.ExpectQuery(regexp.QuoteMeta("FROM orphaned_delegations WHERE id < $1 ORDER BY id DESC LIMIT $2")).
+		WithArgs(4, 2).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	orphaned, next, err = store.GetOrphanedDelegations(ctx, 2, next)
+	assert.NoError(t, err)
+	assert.Empty(t, orphaned)
+	assert.Empty(t, next)
+
+	_, _, err = store.GetOrphanedDelegations(ctx, 2, "not a cursor")
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	// an iteration failure is returned instead of a truncated page
+	mock.ExpectQuery(regexp.QuoteMeta("FROM orphaned_delegations")).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(5, 42, "oo1", 7, "2024-04-21T16:23:27Z", 100, "tz1", "tz1baker", nil, "applied", 400, 1000, 11, 10, "2024-04-21T16:24:00Z", "BL11b").
+			RowError(0, sql.ErrConnDone))
+
+	_, _, err = store.GetOrphanedDelegations(ctx, 0, "")
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM orphaned_delegations")).WillReturnError(sql.ErrConnDone)
+
+	_, _, err = store.GetOrphanedDelegations(ctx, 0, "")
+	assert.Error(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations/postgres")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+	assert.Equal(t, "create_delegations", migrations[0].name)
+
+	_, err = loadMigrations(fstest.MapFS{
+		"m/0001_init.up.sql":   {Data: []byte("CREATE TABLE a ()")},
+		"m/0001_init.down.sql": {Data: []byte("DROP TABLE a")},
+		"m/0003_next.up.sql":   {Data: []byte("CREATE TABLE b ()")},
+		"m/0003_next.down.sql": {Data: []byte("DROP TABLE b")},
+	}, "m")
+	assert.ErrorContains(t, err, "migration 2 is missing")
+
+	_, err = loadMigrations(fstest.MapFS{"m/0001_init.up.sql": {Data: []byte("CREATE TABLE a ()")}}, "m")
+	assert.ErrorContains(t, err, "must have an up and a down script")
+
+	_, err = loadMigrations(fstest.MapFS{"m/init.up.sql": {Data: []byte("CREATE TABLE a ()")}}, "m")
+	assert.ErrorContains(t, err, "invalid migration file name")
+}
+
+func TestMigrate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrator := postgresMigrator(db)
+	ctx := context.Background()
+	migrations := []migration{
+		{version: 1, name: "create_a", up: "CREATE TABLE a ()", down: "DROP TABLE a"},
+		{version: 2, name: "create_b", up: "CREATE TABLE b ()", down: "DROP TABLE b"},
+	}
+	expectVersion := func(version any) {
+		mock.ExpectExec(regexp.QuoteMeta(migrator.lock)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_version")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT MAX(version) FROM schema_version")).
+			WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(version))
+	}
+	expectUnlock := func() {
+		mock.ExpectExec(regexp.QuoteMeta(migrator.unlock)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	// a database created before migrations has no version and gets every migration
+	expectVersion(nil)
+	for _, m := range migrations {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(m.up)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_version (version, name) VALUES ($1, $2)")).
+			WithArgs(m.version, m.name).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	expectUnlock()
+
+	err = migrator.migrate(ctx, migrations, 2)
+	assert.NoError(t, err)
+
+	// reverting runs the down scripts, latest first
+	expectVersion(2)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE b")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schema_version WHERE version = $1")).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUnlock()
+
+	err = migrator.migrate(ctx, migrations, 1)
+	assert.NoError(t, err)
+
+	// a failed migration is not recorded
+	expectVersion(1)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE b ()")).WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+	expectUnlock()
+
+	err = migrator.migrate(ctx, migrations, 2)
+	assert.ErrorContains(t, err, "failed to apply migration 2 create_b")
+
+	// a database migrated by a newer binary is refused
+	expectVersion(3)
+	expectUnlock()
+
+	err = migrator.migrate(ctx, migrations, 2)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostgresStore_MigrateLegacyDatabase(t *testing.T) {
+	dsn := os.Getenv("STORE_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("STORE_TEST_POSTGRES_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := &PostgresStore{db: db}
+	ctx := context.Background()
+	require.NoError(t, store.MigrateTo(ctx, 0))
+
+	// the table of a database created before migrations, with the rows of its previous runs
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE delegations (id SERIAL PRIMARY KEY, timestamp TIMESTAMP NOT NULL, amount BIGINT NOT NULL, delegator TEXT NOT NULL, block INT NOT NULL);
+		INSERT INTO delegations (timestamp, amount, delegator, block) VALUES ('2024-01-01T00:00:00Z', 10, 'tz1', 100);
+	`)
+	require.NoError(t, err)
+	require.NoError(t, store.Migrate(ctx))
+
+	delegations, err := store.GetDelegations(ctx, "", true)
+	assert.NoError(t, err)
+	assert.Len(t, delegations, 1, "the rows stored before the migration are final")
+
+	require.NoError(t, store.SaveDelegations(ctx, types.Block{Level: 101}, []types.FetchedDelegation{delegationAt(101, "oo1", "2024-01-01T00:01:00Z")}))
+	delegations, err = store.GetDelegations(ctx, "", false)
+	assert.NoError(t, err)
+	if assert.Len(t, delegations, 2) {
+		assert.Equal(t, types.FinalityPending, delegations[0].Finality, "the new rows start pending")
+	}
 }
@@ -0,0 +1,32 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Error classes shared by the sources, the poller and the processor. Errors are wrapped with %w
+// so the class can be checked with errors.Is at any layer, e.g. fmt.Errorf("%w: ...: %w", ErrTransport, err).
+var (
+	// ErrTransport is a network failure or an unavailable source, the request may succeed later.
+	ErrTransport = errors.New("transport error")
+	// ErrDecode is a response or message that couldn't be decoded.
+	ErrDecode = errors.New("decode error")
+	// ErrProtocol is a response or message the source was not expected to send, such as a client error status.
+	ErrProtocol = errors.New("protocol error")
+	// ErrStorage is a failure of the store.
+	ErrStorage = errors.New("storage error")
+	// ErrReorg is a reorg that couldn't be reconciled with the processed blocks.
+	ErrReorg = errors.New("reorg error")
+)
+
+// DecodeErrorClass returns the class of an error decoding a response body: ErrDecode when the body is not the
+// expected JSON, ErrTransport when it couldn't be read entirely, e.g. when the connection is cut in the middle of it.
+func DecodeErrorClass(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ErrDecode
+	}
+	return ErrTransport
+}
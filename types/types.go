@@ -1,11 +1,37 @@
 package types
 
+import "time"
+
 type Delegation struct {
-	Id        int    `json:"-"`
-	Timestamp string `json:"timestamp"`
-	Amount    uint64 `json:"amount"`
-	Delegator string `json:"delegator"`
-	Block     uint64 `json:"block"`
+	Id           int     `json:"-"`
+	OperationID  uint64  `json:"operationId"`
+	Hash         string  `json:"hash"`
+	Counter      uint64  `json:"counter"`
+	Timestamp    string  `json:"timestamp"`
+	Amount       uint64  `json:"amount"`
+	Delegator    string  `json:"delegator"`
+	NewDelegate  *string `json:"newDelegate"`
+	PrevDelegate *string `json:"prevDelegate"`
+	Status       string  `json:"status"`
+	BakerFee     uint64  `json:"bakerFee"`
+	GasUsed      uint64  `json:"gasUsed"`
+	Block        uint64  `json:"block"`
+	Finality     string  `json:"finality,omitempty"`
+}
+
+// Finality states of a stored delegation. A delegation is pending until its block is buried
+// under the configured finality depth and can't be reorged anymore.
+const (
+	FinalityPending = "pending"
+	FinalityFinal   = "final"
+)
+
+// OrphanedDelegation is a delegation removed from the store by a reorg.
+type OrphanedDelegation struct {
+	Delegation
+	ReorgLevel         uint64  `json:"reorgLevel"`
+	DetectedAt         string  `json:"detectedAt"`
+	ReplacingBlockHash *string `json:"replacingBlockHash"`
 }
 
 // Sender represents the sender of a delegation.
@@ -13,16 +39,117 @@ type Sender struct {
 	Address string `json:"address"`
 }
 
+// Delegate represents the baker a delegation is made to or withdrawn from.
+type Delegate struct {
+	Address string `json:"address"`
+}
+
 // FetchedDelegation is the response from Tzkt api
 type FetchedDelegation struct {
-	Level     uint64 `json:"level"`
-	Timestamp string `json:"timestamp"`
-	Sender    Sender `json:"sender"`
-	Amount    uint64 `json:"amount"`
+	ID           uint64    `json:"id"`
+	Level        uint64    `json:"level"`
+	Timestamp    string    `json:"timestamp"`
+	Block        string    `json:"block"`
+	Hash         string    `json:"hash"`
+	Counter      uint64    `json:"counter"`
+	Nonce        *uint64   `json:"nonce"`
+	Sender       Sender    `json:"sender"`
+	NewDelegate  *Delegate `json:"newDelegate"`
+	PrevDelegate *Delegate `json:"prevDelegate"`
+	Amount       uint64    `json:"amount"`
+	Status       string    `json:"status"`
+	BakerFee     uint64    `json:"bakerFee"`
+	GasUsed      uint64    `json:"gasUsed"`
+}
+
+// NewDelegateAddress returns the address of the new baker, nil for an undelegation.
+func (d *FetchedDelegation) NewDelegateAddress() *string {
+	if d.NewDelegate == nil {
+		return nil
+	}
+	return &d.NewDelegate.Address
+}
+
+// PrevDelegateAddress returns the address of the previous baker, nil if the sender was not delegated.
+func (d *FetchedDelegation) PrevDelegateAddress() *string {
+	if d.PrevDelegate == nil {
+		return nil
+	}
+	return &d.PrevDelegate.Address
+}
+
+// Checkpoint is the last level fully processed by the watcher.
+type Checkpoint struct {
+	Level     uint64
+	BlockHash string
+}
+
+// Block identifies a processed block and links it to its predecessor.
+// The hashes are empty when they are unknown.
+type Block struct {
+	Level       uint64
+	Hash        string
+	Predecessor string
 }
 
 type ChanMsg struct {
-	Level uint64
-	Reorg bool
-	Data  []FetchedDelegation
+	Level       uint64
+	BlockHash   string
+	Predecessor string
+	Reorg       bool
+	Data        []FetchedDelegation
+}
+
+// Discrepancy is a level where two sources returned different delegations.
+// Operations are identified by their hash, counter and nonce.
+type Discrepancy struct {
+	Level                uint64   `json:"level"`
+	PrimarySource        string   `json:"primarySource"`
+	SecondarySource      string   `json:"secondarySource"`
+	MissingFromPrimary   []string `json:"missingFromPrimary"`
+	MissingFromSecondary []string `json:"missingFromSecondary"`
+	Mismatched           []string `json:"mismatched"`
+	DetectedAt           string   `json:"detectedAt"`
+}
+
+// LevelRange is a range of levels, both bounds included.
+type LevelRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// Len returns the number of levels of the range.
+func (r LevelRange) Len() uint64 {
+	return r.End - r.Start + 1
+}
+
+// DelegationQuery filters and pages the stored delegations, the zero value of a field doesn't filter.
+type DelegationQuery struct {
+	// timestamp range, From included and To excluded
+	From time.Time
+	To   time.Time
+	// block level range, both bounds included
+	MinLevel uint64
+	MaxLevel uint64
+	// address of the sender, and of the baker delegated to
+	Delegator string
+	Baker     string
+	// amount range in mutez, both bounds included
+	MinAmount uint64
+	MaxAmount uint64
+	FinalOnly bool
+	// oldest delegations first instead of the latest
+	Ascending bool
+	// maximum number of delegations returned, the next page starts after Cursor
+	Limit  int
+	Cursor string
+}
+
+// YearQuery returns the query of the delegations of a calendar year.
+func YearQuery(year int, finalOnly bool) DelegationQuery {
+	return DelegationQuery{
+		From:      time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC),
+		To:        time.Date(year+1, time.January, 1, 0, 0, 0, 0, time.UTC),
+		FinalOnly: finalOnly,
+	}
 }
@@ -0,0 +1,239 @@
+package tzkt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/metrics"
+)
+
+// endpoint tracks the health of a TzKT instance.
+type endpoint struct {
+	url string
+	// latency is the moving average of the health checks duration, the other requests are not comparable
+	latency time.Duration
+	// errorRate is the moving average of the failed requests ratio
+	errorRate float64
+	// failures is the number of consecutive failed requests
+	failures int
+	// headLevel is the last head level known for the instance
+	headLevel uint64
+}
+
+// endpointPool selects the healthiest TzKT instance for the HTTP requests and the ws subscription.
+type endpointPool struct {
+	mu        sync.Mutex
+	endpoints []*endpoint
+	active    *endpoint
+}
+
+const (
+	// healthSmoothing is the weight of the last observation in the moving averages
+	healthSmoothing = 0.2
+	// failoverMargin is the fraction of the active endpoint score another endpoint must score below to replace it
+	failoverMargin = 0.8
+	// lagPenalty is the score penalty of each block an endpoint is behind the others
+	lagPenalty = time.Second
+	// failurePenalty is the score penalty of each consecutive failure
+	failurePenalty = time.Minute
+)
+
+// newEndpointPool creates a pool of the given urls, the first one is active until health data is collected.
+func newEndpointPool(urls ...string) *endpointPool {
+	p := &endpointPool{}
+	for _, url := range urls {
+		p.endpoints = append(p.endpoints, &endpoint{url: url})
+	}
+	p.active = p.endpoints[0]
+	return p
+}
+
+// current returns the active endpoint.
+func (p *endpointPool) current() *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
+
+// urls returns the urls of all the endpoints.
+func (p *endpointPool) urls() []string {
+	urls := make([]string, len(p.endpoints))
+	for i, ep := range p.endpoints {
+		urls[i] = ep.url
+	}
+	return urls
+}
+
+// pinnedEndpointKey is the context key of the endpoint the requests of a call are pinned to.
+type pinnedEndpointKey struct{}
+
+// pin returns a context whose requests all go to the active endpoint, even if another one becomes active meanwhile.
+// It keeps the pages of a query on the same instance, as instances don't share the operation ids used as cursor.
+// A failing pinned endpoint fails the call, the caller retries it on the endpoint active by then.
+func (p *endpointPool) pin(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(pinnedEndpointKey{}).(*endpoint); ok {
+		return ctx
+	}
+	return pinTo(ctx, p.current())
+}
+
+// pinTo returns a context whose requests all go to the given endpoint.
+func pinTo(ctx context.Context, ep *endpoint) context.Context {
+	return context.WithValue(ctx, pinnedEndpointKey{}, ep)
+}
+
+// endpointFor returns the endpoint the context is pinned to, or the active endpoint.
+func (p *endpointPool) endpointFor(ctx context.Context) *endpoint {
+	if ep, ok := ctx.Value(pinnedEndpointKey{}).(*endpoint); ok {
+		return ep
+	}
+	return p.current()
+}
+
+// record updates the health of an endpoint with the result of a request and fails over if needed.
+func (p *endpointPool) record(ep *endpoint, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		ep.errorRate = ep.errorRate*(1-healthSmoothing) + healthSmoothing
+		ep.failures++
+	} else {
+		ep.errorRate = ep.errorRate * (1 - healthSmoothing)
+		ep.failures = 0
+	}
+	p.selectActive()
+}
+
+// recordLatency updates the latency of an endpoint with the duration of a health check and fails over if needed.
+// Only the health checks are measured, as they request the same small resource from every endpoint.
+func (p *endpointPool) recordLatency(ep *endpoint, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ep.latency == 0 {
+		ep.latency = latency
+	} else {
+		ep.latency = time.Duration(float64(ep.latency)*(1-healthSmoothing) + float64(latency)*healthSmoothing)
+	}
+	p.selectActive()
+}
+
+// recordHead updates the head level known for an endpoint.
+func (p *endpointPool) recordHead(ep *endpoint, level uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ep.headLevel = max(ep.headLevel, level)
+	p.selectActive()
+}
+
+// score returns the health score of an endpoint, the lower the better. The lock must be held.
+func (p *endpointPool) score(ep *endpoint) float64 {
+	var maxHead uint64
+	for _, e := range p.endpoints {
+		maxHead = max(maxHead, e.headLevel)
+	}
+
+	score := float64(ep.latency) * (1 + 10*ep.errorRate)
+	if ep.headLevel > 0 {
+		score += float64(maxHead-ep.headLevel) * float64(lagPenalty)
+	}
+	score += float64(ep.failures) * float64(failurePenalty)
+	return score
+}
+
+// selectActive switches to the best endpoint when the active one fails or is clearly outperformed. The lock must be held.
+func (p *endpointPool) selectActive() {
+	best := p.active
+	for _, ep := range p.endpoints {
+		// endpoints without measure are only used when the active one fails
+		if ep.latency == 0 && p.active.failures == 0 {
+			continue
+		}
+		if p.score(ep) < p.score(best) {
+			best = ep
+		}
+	}
+	if best == p.active {
+		return
+	}
+	if p.active.failures == 0 && p.score(best) >= failoverMargin*p.score(p.active) {
+		return
+	}
+
+	log.Warnf("Switching TzKT endpoint from %s to %s", p.active.url, best.url)
+	p.active = best
+	p.reportMetrics()
+}
+
+// reportMetrics exposes the active endpoint in the metrics. The lock must be held.
+func (p *endpointPool) reportMetrics() {
+	metrics.SetActiveTzktEndpoint(p.active.url, p.urls())
+}
+
+// MonitorEndpoints checks the head and latency of every endpoint at the given interval until the context is done,
+// so the health of the inactive endpoints is known when a failover is needed. The active endpoint metric is refreshed after each check.
+func (t *Tzkt) MonitorEndpoints(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if len(t.endpoints.endpoints) > 1 {
+			for _, ep := range t.endpoints.endpoints {
+				t.checkEndpoint(ctx, ep)
+			}
+		}
+
+		t.endpoints.mu.Lock()
+		t.endpoints.reportMetrics()
+		t.endpoints.mu.Unlock()
+	}
+}
+
+// checkEndpoint fetches the head of an endpoint once and records its health.
+func (t *Tzkt) checkEndpoint(ctx context.Context, ep *endpoint) {
+	if err := t.limiter.Wait(ctx); err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.url+"/v1/head", nil)
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	var head struct {
+		Level uint64 `json:"level"`
+	}
+	resp, err := t.client.Do(req)
+	if err == nil {
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("non-200 status code: %v", resp.StatusCode)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&head)
+		}
+		resp.Body.Close()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Warnf("Health check of TzKT endpoint %s failed: %v", ep.url, err)
+	}
+
+	latency := time.Since(start)
+	t.endpoints.record(ep, err)
+	if err == nil {
+		t.endpoints.recordLatency(ep, latency)
+		t.endpoints.recordHead(ep, head.Level)
+	}
+}
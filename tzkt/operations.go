@@ -0,0 +1,132 @@
+package tzkt
+
+import (
+	"time"
+
+	"github.com/dipdup-net/go-lib/tzkt/data"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+)
+
+// operationsStream builds the level messages from the head and operations channels.
+// TzKT only pushes operations for blocks that contain delegations, and may push those of a block in several
+// messages, so a level is held as pending and only sent once the head of a following block shows it is complete.
+type operationsStream struct {
+	dataChan chan<- *types.ChanMsg
+	// done stops the sends when the subscription is over
+	done <-chan struct{}
+	// lastLevel and lastHash identify the last level sent
+	lastLevel uint64
+	lastHash  string
+	// pending is the last level received, its delegations may not all be received yet
+	pending *types.ChanMsg
+}
+
+// onHead records a new head and sends the pending level below it.
+func (s *operationsStream) onHead(head data.Head) {
+	if head.Level <= s.lastLevel {
+		return
+	}
+	if msg := s.pendingAt(head.Level); msg != nil {
+		msg.BlockHash = head.Hash
+	}
+}
+
+// onOperations adds the delegations of a block to its pending level.
+func (s *operationsStream) onOperations(operations []any) {
+	for _, operation := range operations {
+		d, ok := operation.(*data.Delegation)
+		if !ok {
+			continue
+		}
+		if d.Level <= s.lastLevel {
+			log.Warnf("Ignoring delegation %s of level %d received after the level was sent", d.Hash, d.Level)
+			continue
+		}
+		msg := s.pendingAt(d.Level)
+		if msg == nil {
+			// the head of this level was never received, it is fetched with the levels missing before the pending one
+			log.Debugf("Ignoring delegation %s of level %d below the pending level", d.Hash, d.Level)
+			continue
+		}
+		msg.BlockHash = d.Block
+		msg.Data = append(msg.Data, delegationFromEvent(d))
+	}
+}
+
+// pendingAt returns the pending message of the given level, the pending level below it is complete and sent first.
+// It returns nil for a level below the pending one.
+func (s *operationsStream) pendingAt(level uint64) *types.ChanMsg {
+	if s.pending != nil && s.pending.Level > level {
+		return nil
+	}
+	if s.pending != nil && s.pending.Level < level {
+		s.send(s.pending)
+		s.pending = nil
+	}
+	if s.pending == nil {
+		s.pending = &types.ChanMsg{Level: level}
+	}
+	return s.pending
+}
+
+// onReorg sends a reorg message unless nothing was sent above the reorg level.
+func (s *operationsStream) onReorg(level uint64) {
+	if s.pending != nil && s.pending.Level > level {
+		s.pending = nil
+	}
+	if level >= s.lastLevel {
+		log.Debugf("Ignoring reorg to level %d, nothing was sent above it", level)
+		return
+	}
+
+	log.Debugf("Reorg detected, processing reorg for level %d", level)
+	select {
+	case s.dataChan <- &types.ChanMsg{Level: level, Reorg: true}:
+	case <-s.done:
+		return
+	}
+	s.lastLevel = level
+	s.lastHash = ""
+}
+
+// send sends a level message, its predecessor is known when the previous level was sent just before.
+func (s *operationsStream) send(msg *types.ChanMsg) {
+	if s.lastLevel == msg.Level-1 {
+		msg.Predecessor = s.lastHash
+	}
+	log.Tracef("Sending %d delegations of level %d to channel", len(msg.Data), msg.Level)
+	select {
+	case s.dataChan <- msg:
+	case <-s.done:
+		return
+	}
+	s.lastLevel = msg.Level
+	s.lastHash = msg.BlockHash
+}
+
+// delegationFromEvent converts a delegation pushed by the ws to the model returned by the HTTP api.
+func delegationFromEvent(d *data.Delegation) types.FetchedDelegation {
+	delegation := types.FetchedDelegation{
+		ID:        d.ID,
+		Level:     d.Level,
+		Timestamp: d.Timestamp.UTC().Format(time.RFC3339),
+		Block:     d.Block,
+		Hash:      d.Hash,
+		Counter:   d.Counter,
+		Nonce:     d.Nonce,
+		Amount:    uint64(d.Amount.IntPart()),
+		Status:    d.Status,
+		BakerFee:  d.BakerFee,
+		GasUsed:   d.GasUsed,
+	}
+	if d.Sender != nil {
+		delegation.Sender = types.Sender{Address: d.Sender.Address}
+	}
+	if d.NewDelegate != nil {
+		delegation.NewDelegate = &types.Delegate{Address: d.NewDelegate.Address}
+	}
+	if d.PrevDelegate != nil {
+		delegation.PrevDelegate = &types.Delegate{Address: d.PrevDelegate.Address}
+	}
+	return delegation
+}
@@ -0,0 +1,409 @@
+package tzkt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dipdup-net/go-lib/tzkt/data"
+	"github.com/dipdup-net/go-lib/tzkt/events"
+)
+
+// recordedEntry is a line of a recording, either an HTTP response or a ws message.
+type recordedEntry struct {
+	// Offset is the time elapsed since the start of the recording
+	Offset time.Duration     `json:"offset"`
+	HTTP   *recordedResponse `json:"http,omitempty"`
+	WS     *recordedMessage  `json:"ws,omitempty"`
+}
+
+// recordedResponse is the response to a request, or the error returned instead of it.
+type recordedResponse struct {
+	Path   string      `json:"path"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// recordedMessage is a message received from the ws with its decoded body.
+type recordedMessage struct {
+	Channel string             `json:"channel"`
+	Type    events.MessageType `json:"type"`
+	State   uint64             `json:"state"`
+	Data    json.RawMessage    `json:"data,omitempty"`
+}
+
+// Recorder writes the HTTP responses and ws messages seen by a client to a file, one JSON entry per line.
+type Recorder struct {
+	mu      sync.Mutex
+	start   time.Time
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewRecorder creates the recording file at the given path, an existing file is truncated.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+	return &Recorder{
+		start:   time.Now(),
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// Close closes the recording file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// write appends an entry to the recording, a failure is logged and doesn't affect the client.
+func (r *Recorder) write(entry recordedEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry.Offset = time.Since(r.start)
+	if err := r.encoder.Encode(entry); err != nil {
+		log.Errorf("Failed to record TzKT traffic: %v", err)
+	}
+}
+
+// Record captures the HTTP responses and ws messages of the client in the recorder.
+func (t *Tzkt) Record(r *Recorder) {
+	t.client = &recordingHTTPClient{client: t.client, recorder: r}
+	newWSClient := t.newWSClient
+	t.newWSClient = func(url string) WebSocketClient {
+		return &recordingWSClient{WebSocketClient: newWSClient(url), recorder: r, done: make(chan struct{})}
+	}
+}
+
+// recordingHTTPClient records the responses of an HTTP client.
+type recordingHTTPClient struct {
+	client   HTTPClient
+	recorder *Recorder
+}
+
+// Do executes the request and records its response, the body is read entirely and replaced by a copy.
+func (c *recordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	recorded := &recordedResponse{Path: req.URL.RequestURI()}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		recorded.Error = err.Error()
+		c.recorder.write(recordedEntry{HTTP: recorded})
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		recorded.Error = err.Error()
+		c.recorder.write(recordedEntry{HTTP: recorded})
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	recorded.Status = resp.StatusCode
+	recorded.Header = resp.Header
+	recorded.Body = string(body)
+	c.recorder.write(recordedEntry{HTTP: recorded})
+	return resp, nil
+}
+
+// recordingWSClient records the messages received by a ws client.
+type recordingWSClient struct {
+	WebSocketClient
+	recorder *Recorder
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Listen forwards the messages of the client once they are recorded.
+func (c *recordingWSClient) Listen() <-chan events.Message {
+	messages := make(chan events.Message)
+	received := c.WebSocketClient.Listen()
+	go func() {
+		for {
+			var msg events.Message
+			select {
+			case m, ok := <-received:
+				if !ok {
+					close(messages)
+					return
+				}
+				msg = m
+			case <-c.done:
+				return
+			}
+
+			recorded := &recordedMessage{Channel: msg.Channel, Type: msg.Type, State: msg.State}
+			if msg.Body != nil {
+				body, err := json.Marshal(msg.Body)
+				if err != nil {
+					log.Errorf("Failed to record TzKT message: %v", err)
+				}
+				recorded.Data = body
+			}
+			c.recorder.write(recordedEntry{WS: recorded})
+
+			select {
+			case messages <- msg:
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return messages
+}
+
+// Close stops the recording of the messages and closes the client.
+func (c *recordingWSClient) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.WebSocketClient.Close()
+}
+
+// Replay feeds a recording back to a client: it implements HTTPClient and creates the ws clients.
+// Responses are served in the recorded order for each request path, the last one is served again once
+// they are all used. Ws messages are delivered with their recorded timing divided by the speed,
+// a reconnection resumes after the last delivered message.
+type Replay struct {
+	mu        sync.Mutex
+	speed     float64
+	responses map[string][]*recordedResponse
+	messages  []recordedEntry
+	// next is the index of the next ws message to deliver and lastOffset the offset of the last delivered one
+	next       int
+	lastOffset time.Duration
+}
+
+// LoadReplay reads the recording at the given path. A speed of 2 replays the ws messages twice as fast as recorded.
+func LoadReplay(path string, speed float64) (*Replay, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+
+	r := &Replay{
+		speed:     speed,
+		responses: make(map[string][]*recordedResponse),
+	}
+	scanner := bufio.NewScanner(file)
+	// responses can be large pages of operations
+	scanner.Buffer(nil, 256<<20)
+	for scanner.Scan() {
+		var entry recordedEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to decode recording entry: %w", err)
+		}
+		switch {
+		case entry.HTTP != nil:
+			r.responses[entry.HTTP.Path] = append(r.responses[entry.HTTP.Path], entry.HTTP)
+		case entry.WS != nil:
+			r.messages = append(r.messages, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	log.Infof("Loaded the recorded responses of %d paths and %d recorded messages", len(r.responses), len(r.messages))
+	return r, nil
+}
+
+// Replay serves the HTTP requests and the ws subscriptions of the client from the recording.
+func (t *Tzkt) Replay(r *Replay) {
+	t.client = r
+	t.newWSClient = func(string) WebSocketClient {
+		return r.NewWebSocketClient()
+	}
+}
+
+// Do returns the next recorded response to the path of the request.
+func (r *Replay) Do(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := req.URL.RequestURI()
+	queue := r.responses[path]
+	if len(queue) == 0 {
+		return nil, fmt.Errorf("no recorded response for %s", path)
+	}
+	recorded := queue[0]
+	if len(queue) > 1 {
+		r.responses[path] = queue[1:]
+	}
+
+	if recorded.Error != "" {
+		return nil, errors.New(recorded.Error)
+	}
+	return &http.Response{
+		StatusCode: recorded.Status,
+		Header:     recorded.Header.Clone(),
+		Body:       io.NopCloser(bytes.NewBufferString(recorded.Body)),
+		Request:    req,
+	}, nil
+}
+
+// NewWebSocketClient creates a ws client delivering the recorded messages from the last delivered one.
+func (r *Replay) NewWebSocketClient() *ReplayWebSocketClient {
+	return &ReplayWebSocketClient{
+		replay:   r,
+		messages: make(chan events.Message),
+		done:     make(chan struct{}),
+	}
+}
+
+// nextMessage returns the next ws message to deliver and the delay before it, false once they were all delivered.
+func (r *Replay) nextMessage() (recordedEntry, time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next >= len(r.messages) {
+		return recordedEntry{}, 0, false
+	}
+	entry := r.messages[r.next]
+	delay := max(entry.Offset-r.lastOffset, 0)
+	if r.speed > 0 {
+		delay = time.Duration(float64(delay) / r.speed)
+	}
+	return entry, delay, true
+}
+
+// delivered moves past the given ws message.
+func (r *Replay) delivered(entry recordedEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	r.lastOffset = entry.Offset
+}
+
+// ReplayWebSocketClient is a WebSocketClient delivering recorded messages.
+type ReplayWebSocketClient struct {
+	replay   *Replay
+	messages chan events.Message
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Connect starts delivering the recorded messages until the client is closed or the context is done.
+func (c *ReplayWebSocketClient) Connect(ctx context.Context) error {
+	go c.deliver(ctx)
+	return nil
+}
+
+// SubscribeToHead does nothing, the recorded messages include the subscribed channels.
+func (c *ReplayWebSocketClient) SubscribeToHead() error {
+	return nil
+}
+
+// SubscribeToOperations does nothing, the recorded messages include the subscribed channels.
+func (c *ReplayWebSocketClient) SubscribeToOperations(address string, types ...string) error {
+	return nil
+}
+
+// Listen returns the channel of the recorded messages. It stays open once they are all delivered, like a silent ws.
+func (c *ReplayWebSocketClient) Listen() <-chan events.Message {
+	return c.messages
+}
+
+// Close stops the delivery of the recorded messages.
+func (c *ReplayWebSocketClient) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *ReplayWebSocketClient) deliver(ctx context.Context) {
+	for {
+		entry, delay, ok := c.replay.nextMessage()
+		if !ok {
+			log.Info("All the recorded TzKT messages were replayed")
+			return
+		}
+		msg, err := decodeMessage(entry.WS)
+		if err != nil {
+			log.Errorf("Skipping recorded TzKT message: %v", err)
+			c.replay.delivered(entry)
+			continue
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		select {
+		case c.messages <- msg:
+			c.replay.delivered(entry)
+		case <-c.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// decodeMessage rebuilds a ws message with the body types of the events package.
+func decodeMessage(recorded *recordedMessage) (events.Message, error) {
+	msg := events.Message{Channel: recorded.Channel, Type: recorded.Type, State: recorded.State}
+	if len(recorded.Data) == 0 || recorded.Type != events.MessageTypeData {
+		return msg, nil
+	}
+
+	switch recorded.Channel {
+	case events.ChannelHead:
+		var head data.Head
+		if err := json.Unmarshal(recorded.Data, &head); err != nil {
+			return msg, fmt.Errorf("failed to decode head: %w", err)
+		}
+		msg.Body = head
+	case events.ChannelOperations:
+		var rawOperations []json.RawMessage
+		if err := json.Unmarshal(recorded.Data, &rawOperations); err != nil {
+			return msg, fmt.Errorf("failed to decode operations: %w", err)
+		}
+		operations := make([]any, 0, len(rawOperations))
+		for _, raw := range rawOperations {
+			// only the delegations are subscribed, the other kinds are kept undecoded like the events package does
+			var kind struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal(raw, &kind); err != nil {
+				return msg, fmt.Errorf("failed to decode operation: %w", err)
+			}
+			if kind.Type != data.KindDelegation {
+				var operation map[string]any
+				if err := json.Unmarshal(raw, &operation); err != nil {
+					return msg, fmt.Errorf("failed to decode operation: %w", err)
+				}
+				operations = append(operations, operation)
+				continue
+			}
+			delegation := &data.Delegation{}
+			if err := json.Unmarshal(raw, delegation); err != nil {
+				return msg, fmt.Errorf("failed to decode delegation: %w", err)
+			}
+			operations = append(operations, delegation)
+		}
+		msg.Body = operations
+	default:
+		msg.Body = recorded.Data
+	}
+	return msg, nil
+}
@@ -3,8 +3,11 @@ package tzkt
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/avast/retry-go/v4"
@@ -12,8 +15,10 @@ import (
 	"github.com/dipdup-net/go-lib/tzkt/events"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/utils"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 // HTTPClient defines an interface for an HTTP client that can make requests.
@@ -25,155 +30,465 @@ type HTTPClient interface {
 type WebSocketClient interface {
 	Connect(ctx context.Context) error
 	SubscribeToHead() error
+	SubscribeToOperations(address string, types ...string) error
 	Listen() <-chan events.Message
 	Close() error
 }
 
 // Tzkt represents a client for interacting with the Tzkt API.
+// Requests are sent to the healthiest of the configured endpoints.
 type Tzkt struct {
-	url           string
+	endpoints     *endpointPool
 	client        HTTPClient
-	wsClient      WebSocketClient
+	newWSClient   func(url string) WebSocketClient
 	retryAttempts int
+	subscription  string
+	// limiter is shared by all the requests sent to TzKT, including the health checks
+	limiter       *rate.Limiter
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
 }
 
 // TzktInterface defines the operations that can be performed by the Tzkt client.
 type TzktInterface interface {
 	GetDelegationsByLevel(ctx context.Context, level uint64, dataChan chan<- *types.ChanMsg) error
+	GetDelegationsByRange(ctx context.Context, startLevel, endLevel uint64, dataChan chan<- *types.ChanMsg) error
+	GetBlockHash(ctx context.Context, level uint64) (string, error)
 	SubscribeToHead(ctx context.Context, dataChan chan<- *types.ChanMsg, currentHead chan<- uint64, errorChan chan<- error)
 }
 
 var log = logrus.WithField("module", "tzktClient")
 
+// pageLimit is the maximum number of operations requested from the tzkt api in a single response.
+var pageLimit = 10000
+
 // NewClient creates a new Tzkt client using the provided configuration.
 func NewClient(cfg *config.TzktConfig) *Tzkt {
 	return &Tzkt{
-		url: cfg.GetURL(),
+		endpoints: newEndpointPool(cfg.GetURLs()...),
 		client: &http.Client{
 			Timeout: time.Duration(cfg.GetTimeout()) * time.Second,
 		},
-		wsClient:      events.NewTzKT(fmt.Sprintf("%s/v1/ws", cfg.GetURL())),
+		newWSClient: func(url string) WebSocketClient {
+			return events.NewTzKT(fmt.Sprintf("%s/v1/ws", url))
+		},
 		retryAttempts: cfg.GetRetryAttempts(),
+		subscription:  cfg.GetSubscription(),
+		limiter:       rate.NewLimiter(rate.Limit(cfg.GetRateLimit()), cfg.GetRateBurst()),
+		retryDelay:    time.Duration(cfg.GetRetryDelay()) * time.Millisecond,
+		maxRetryDelay: time.Duration(cfg.GetMaxRetryDelay()) * time.Millisecond,
 	}
 
 }
 
 // GetDelegationsByLevel fetches the delegations from the tzkt api by level.
+// A message is sent even when the level has no delegations so the level can be checkpointed.
 func (t *Tzkt) GetDelegationsByLevel(ctx context.Context, level uint64, dataChan chan<- *types.ChanMsg) error {
-	url := fmt.Sprintf("%s/v1/operations/delegations?level=%d", t.url, level)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	ctx = t.endpoints.pin(ctx)
+	delegationsResponse, err := t.getDelegationsByLevel(ctx, level)
 	if err != nil {
-		return fmt.Errorf("Creating request failed: %v", err)
+		return err
 	}
 
-	resp, err := t.executeRequest(ctx, req)
+	// the predecessor hash is fetched along so the level can be linked to the processed chain
+	hashes, err := t.getBlockHashes(ctx, max(level, 1)-1, level)
 	if err != nil {
-		return fmt.Errorf("Executing request failed: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
+	msg, err := levelMessage(level, hashes, delegationsResponse)
+	if err != nil {
+		return err
+	}
+
+	log.Tracef("Sending %d delegations to channel", len(delegationsResponse))
+	dataChan <- msg
 
-	var delegationsResponse []types.FetchedDelegation
-	err = json.NewDecoder(resp.Body).Decode(&delegationsResponse)
+	return nil
+}
+
+// GetDelegationsByRange fetches the delegations between startLevel and endLevel (both included) page by page
+// using the operation id as cursor, and sends one message per level of the range, with or without delegations,
+// carrying the hashes of its block and of its predecessor. All the pages are requested from the same endpoint.
+func (t *Tzkt) GetDelegationsByRange(ctx context.Context, startLevel, endLevel uint64, dataChan chan<- *types.ChanMsg) error {
+	ctx = t.endpoints.pin(ctx)
+	hashes, err := t.getBlockHashes(ctx, max(startLevel, 1)-1, endLevel)
 	if err != nil {
-		return fmt.Errorf("Decoding response failed: %v", err)
+		return err
+	}
+
+	// next is the level whose delegations are being received
+	next := startLevel
+	var delegations []types.FetchedDelegation
+	send := func() error {
+		msg, err := levelMessage(next, hashes, delegations)
+		if err != nil {
+			return err
+		}
+		dataChan <- msg
+		delegations = nil
+		next++
+		return nil
+	}
+
+	var lastID uint64
+	for {
+		path := fmt.Sprintf("/v1/operations/delegations?level.ge=%d&level.le=%d&id.gt=%d&sort.asc=id&limit=%d", startLevel, endLevel, lastID, pageLimit)
+		var page []types.FetchedDelegation
+		if err := t.getJSON(ctx, path, &page); err != nil {
+			return err
+		}
+		log.Tracef("Fetched page of %d delegations for levels %d to %d after id %d", len(page), startLevel, endLevel, lastID)
+
+		// operations are sorted by id so delegations of the same level are contiguous and levels are ascending;
+		// a level is only sent once we are sure all its delegations were received.
+		for _, d := range page {
+			for next < d.Level {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+			delegations = append(delegations, d)
+		}
+
+		if len(page) < pageLimit {
+			break
+		}
+		lastID = page[len(page)-1].ID
+	}
+
+	for next <= endLevel {
+		if err := send(); err != nil {
+			return err
+		}
 	}
 
-	if len(delegationsResponse) > 0 {
-		log.Tracef("Sending %d delegations to channel", len(delegationsResponse))
-		dataChan <- &types.ChanMsg{
-			Level: level,
-			Reorg: false,
-			Data:  delegationsResponse,
+	return nil
+}
+
+// levelMessage builds the message of a level from the block hashes fetched for it and its predecessor.
+// The delegations must belong to the fetched block, otherwise the chain changed between the requests.
+func levelMessage(level uint64, hashes map[uint64]string, delegations []types.FetchedDelegation) (*types.ChanMsg, error) {
+	hash, ok := hashes[level]
+	if !ok {
+		return nil, fmt.Errorf("%w: block %d not found", types.ErrTransport, level)
+	}
+	for _, d := range delegations {
+		if d.Block != hash {
+			return nil, fmt.Errorf("%w: block %d changed from %s to %s while fetching it", types.ErrTransport, level, hash, d.Block)
+		}
+	}
+
+	return &types.ChanMsg{
+		Level:       level,
+		BlockHash:   hash,
+		Predecessor: hashes[level-1],
+		Reorg:       false,
+		Data:        delegations,
+	}, nil
+}
+
+// getBlockHashes fetches the hashes of the blocks between startLevel and endLevel (both included) page by page, by level.
+func (t *Tzkt) getBlockHashes(ctx context.Context, startLevel, endLevel uint64) (map[uint64]string, error) {
+	hashes := make(map[uint64]string, endLevel-startLevel+1)
+	for from := startLevel; from <= endLevel; {
+		path := fmt.Sprintf("/v1/blocks?level.ge=%d&level.le=%d&sort.asc=level&select=level,hash&limit=%d", from, endLevel, pageLimit)
+		var page []struct {
+			Level uint64 `json:"level"`
+			Hash  string `json:"hash"`
+		}
+		if err := t.getJSON(ctx, path, &page); err != nil {
+			return nil, err
+		}
+		for _, b := range page {
+			hashes[b.Level] = b.Hash
+		}
+
+		if len(page) < pageLimit {
+			break
 		}
+		from = page[len(page)-1].Level + 1
+	}
+	return hashes, nil
+}
+
+// getDelegationsByLevel fetches the delegations included in the given level.
+func (t *Tzkt) getDelegationsByLevel(ctx context.Context, level uint64) ([]types.FetchedDelegation, error) {
+	var delegations []types.FetchedDelegation
+	path := fmt.Sprintf("/v1/operations/delegations?level=%d", level)
+	if err := t.getJSON(ctx, path, &delegations); err != nil {
+		return nil, err
+	}
+	return delegations, nil
+}
+
+// GetBlockHash fetches the hash of the block at the given level.
+func (t *Tzkt) GetBlockHash(ctx context.Context, level uint64) (string, error) {
+	var block struct {
+		Hash string `json:"hash"`
+	}
+	path := fmt.Sprintf("/v1/blocks/%d", level)
+	if err := t.getJSON(ctx, path, &block); err != nil {
+		return "", err
+	}
+	return block.Hash, nil
+}
+
+// getJSON executes a GET request on the given path and decodes the response into out.
+func (t *Tzkt) getJSON(ctx context.Context, path string, out any) error {
+	resp, err := t.executeRequest(ctx, path)
+	if err != nil {
+		return fmt.Errorf("Executing request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("%w: Decoding response failed: %w", types.DecodeErrorClass(err), err)
 	}
 
 	return nil
 }
 
 // SubscribeToHead subscribes to new blockchain heads via a WebSocket.
+// In operations mode the delegations of new blocks are also received from the ws instead of being fetched over HTTP.
 func (t *Tzkt) SubscribeToHead(ctx context.Context, dataChan chan<- *types.ChanMsg, currentHead chan<- uint64, errorChan chan<- error) {
-	log.Debug("Subscribing to TzKT WebSocket for new heads")
+	// the endpoint used for the subscription is chosen at each reconnection
+	ep := t.endpoints.current()
+	wsClient := t.newWSClient(ep.url)
+	log.Debugf("Subscribing to TzKT WebSocket of %s for new heads", ep.url)
 
-	if err := t.wsClient.Connect(ctx); err != nil {
-		errorChan <- fmt.Errorf("couldn't connect to tzkt ws: %v", err)
+	if err := wsClient.Connect(ctx); err != nil {
+		t.endpoints.record(ep, err)
+		errorChan <- fmt.Errorf("%w: couldn't connect to tzkt ws: %w", types.ErrTransport, err)
 		return
 	}
-	defer t.wsClient.Close()
+	defer wsClient.Close()
 
-	if err := t.wsClient.SubscribeToHead(); err != nil {
+	if err := wsClient.SubscribeToHead(); err != nil {
 		log.Errorf("WebSocket subscription failed: %v", err)
-		errorChan <- fmt.Errorf("couldn't subscribe to tzkt head: %v", err)
+		errorChan <- fmt.Errorf("%w: couldn't subscribe to tzkt head: %w", types.ErrTransport, err)
 		return
 	}
 
+	operationsMode := t.subscription == config.SubscriptionOperations
+	if operationsMode {
+		log.Debug("Subscribing to TzKT WebSocket for delegation operations")
+		if err := wsClient.SubscribeToOperations("", data.KindDelegation); err != nil {
+			log.Errorf("WebSocket subscription failed: %v", err)
+			errorChan <- fmt.Errorf("%w: couldn't subscribe to tzkt operations: %w", types.ErrTransport, err)
+			return
+		}
+	}
+
 	messageQueue := make(chan events.Message, 100)
 
 	// Asynchronous reception and synchronous processing for ws
 	go func() {
-		for msg := range t.wsClient.Listen() {
+		defer close(messageQueue)
+		for msg := range wsClient.Listen() {
 			log.Tracef("Received message: %v", msg)
-			messageQueue <- msg
+			select {
+			case messageQueue <- msg:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(messageQueue)
 	}()
 
 	var initHead uint64
-	for msg := range messageQueue {
+	var stateReceived bool
+	stream := &operationsStream{dataChan: dataChan, done: ctx.Done()}
+	for {
+		// the subscription stops when the context is done, e.g. when the poller forces a reconnection
+		var msg events.Message
+		select {
+		case m, ok := <-messageQueue:
+			if !ok {
+				return
+			}
+			msg = m
+		case <-ctx.Done():
+			return
+		}
 		log.Tracef("Processing message: %v", msg)
 		switch msg.Type {
 		case events.MessageTypeState:
 			// this is the first message received from the ws
 			// we use this state as the limit between blocks that will be processed by the ws
-			// and blocks that will be processed by the getPastDelegations function
-			currentHead <- msg.State
+			// and blocks that will be processed by the getPastDelegations function.
+			// Each channel sends its own state, only the first one is used.
+			if stateReceived {
+				continue
+			}
+			stateReceived = true
+			select {
+			case currentHead <- msg.State:
+			case <-ctx.Done():
+				return
+			}
 			initHead = msg.State
+			stream.lastLevel = msg.State
 		case events.MessageTypeData:
-			if msg.Channel == events.ChannelHead {
+			switch msg.Channel {
+			case events.ChannelHead:
 				head, ok := msg.Body.(data.Head)
 				if !ok {
-					errorChan <- fmt.Errorf("unexpected type %T for head message", msg.Body)
+					errorChan <- fmt.Errorf("%w: unexpected type %T for head message", types.ErrProtocol, msg.Body)
 					return
 				}
+				t.endpoints.recordHead(ep, head.Level)
+				if operationsMode {
+					stream.onHead(head)
+					continue
+				}
 				if head.Level > initHead {
 					log.Infof("Fetching delegations for new head level: %d", head.Level)
-					err := t.GetDelegationsByLevel(ctx, head.Level, dataChan)
+					// another instance may not have seen the head yet, the block is fetched from the one announcing it
+					fetchCtx := pinTo(ctx, ep)
+					delegations, err := t.getDelegationsByLevel(fetchCtx, head.Level)
+					if err != nil {
+						errorChan <- fmt.Errorf("error fetching delegations: %w", err)
+						return
+					}
+					// the head doesn't carry its predecessor, it is needed to check the chain continuity
+					predecessor, err := t.GetBlockHash(fetchCtx, head.Level-1)
 					if err != nil {
-						errorChan <- fmt.Errorf("error fetching delegations: %v", err)
+						errorChan <- fmt.Errorf("error fetching predecessor hash: %w", err)
+						return
+					}
+					select {
+					case dataChan <- &types.ChanMsg{
+						Level:       head.Level,
+						BlockHash:   head.Hash,
+						Predecessor: predecessor,
+						Reorg:       false,
+						Data:        delegations,
+					}:
+					case <-ctx.Done():
 						return
 					}
 				}
+			case events.ChannelOperations:
+				operations, ok := msg.Body.([]any)
+				if !ok {
+					errorChan <- fmt.Errorf("%w: unexpected type %T for operations message", types.ErrProtocol, msg.Body)
+					return
+				}
+				stream.onOperations(operations)
 			}
 		case events.MessageTypeReorg:
+			if operationsMode {
+				stream.onReorg(msg.State)
+				continue
+			}
 			log.Debugf("Reorg detected, processing reorg for level %d", msg.State)
-			dataChan <- &types.ChanMsg{
-				Level: msg.State,
-				Reorg: true,
+			select {
+			case dataChan <- &types.ChanMsg{Level: msg.State, Reorg: true}:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}
 }
 
-func (t *Tzkt) executeRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
-	log.Tracef("Executing HTTP request to %s", req.URL)
+// statusError is returned for the responses with a non-200 status code.
+type statusError struct {
+	code int
+	// retryAfter is the delay requested by the server before the next attempt
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("non-200 status code: %v", e.code)
+}
+
+// Unwrap classifies the status: permanent errors are protocol errors, the others transport errors.
+func (e *statusError) Unwrap() error {
+	if e.permanent() {
+		return types.ErrProtocol
+	}
+	return types.ErrTransport
+}
+
+// permanent reports whether the request will never succeed: client errors other than timeouts and throttling.
+func (e *statusError) permanent() bool {
+	return e.code >= 400 && e.code < 500 && e.code != http.StatusRequestTimeout && e.code != http.StatusTooManyRequests
+}
+
+// executeRequest executes a GET request on the given path of the active endpoint, or of the endpoint the context is pinned to.
+// Each attempt is recorded in the endpoint health so a failing endpoint is replaced for the next attempts of unpinned requests.
+// Transient errors are retried with an exponential backoff, or after the delay requested by the server.
+func (t *Tzkt) executeRequest(ctx context.Context, path string) (*http.Response, error) {
 	return retry.DoWithData(
 		func() (*http.Response, error) {
-			req = req.WithContext(ctx)
-			resp, err := t.client.Do(req)
+			if err := t.limiter.Wait(ctx); err != nil {
+				return nil, retry.Unrecoverable(err)
+			}
+
+			ep := t.endpoints.endpointFor(ctx)
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.url+path, nil)
 			if err != nil {
+				return nil, retry.Unrecoverable(fmt.Errorf("Creating request failed: %w", err))
+			}
+			log.Tracef("Executing HTTP request to %s", req.URL)
 
-				return nil, fmt.Errorf("HTTP request failed: %v", err)
+			resp, err := t.client.Do(req)
+			if err != nil {
+				err = fmt.Errorf("%w: HTTP request failed: %w", types.ErrTransport, err)
+				t.endpoints.record(ep, err)
+				return nil, err
 			}
 
 			if resp.StatusCode != http.StatusOK {
-				return nil, fmt.Errorf("non-200 status code: %v", resp.StatusCode)
+				resp.Body.Close()
+				statusErr := &statusError{code: resp.StatusCode, retryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+				if statusErr.permanent() {
+					// the endpoint answered, the request is at fault
+					t.endpoints.record(ep, nil)
+					return nil, retry.Unrecoverable(statusErr)
+				}
+				t.endpoints.record(ep, statusErr)
+				return nil, statusErr
 			}
 
+			t.endpoints.record(ep, nil)
 			return resp, nil
 		},
 		retry.Context(ctx),
 		retry.Attempts(uint(t.retryAttempts)),
+		retry.DelayType(t.retryDelayFor),
 		retry.OnRetry(func(n uint, err error) {
 			log.Errorf("Retry %d for error: %v", n+1, err)
 		}),
 	)
 }
+
+// retryDelayFor returns the delay before the retry n: the delay requested by the server if any,
+// or an exponential backoff with full jitter, both capped at maxRetryDelay.
+func (t *Tzkt) retryDelayFor(n uint, err error, _ *retry.Config) time.Duration {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.retryAfter > 0 {
+		// a long Retry-After would stall the caller, it is capped like the backoff
+		return min(statusErr.retryAfter, t.maxRetryDelay)
+	}
+
+	backoff := utils.Backoff(t.retryDelay, t.maxRetryDelay, n)
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// retryAfter parses a Retry-After header, given in seconds or as an HTTP date. It returns 0 when missing or invalid.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
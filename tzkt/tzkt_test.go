@@ -5,15 +5,22 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/dipdup-net/go-lib/tzkt/data"
 	"github.com/dipdup-net/go-lib/tzkt/events"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
 	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/tzkttest"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/time/rate"
 )
 
 type mockHttpClient struct {
@@ -38,6 +45,10 @@ func (m *mockWebSocketClient) SubscribeToHead() error {
 	return m.Called().Error(0)
 }
 
+func (m *mockWebSocketClient) SubscribeToOperations(address string, types ...string) error {
+	return m.Called(address, types).Error(0)
+}
+
 func (m *mockWebSocketClient) Listen() <-chan events.Message {
 	args := m.Called()
 	return args.Get(0).(chan events.Message)
@@ -47,22 +58,39 @@ func (m *mockWebSocketClient) Close() error {
 	return m.Called().Error(0)
 }
 
+// staticWSClient returns the same ws client for every endpoint.
+func staticWSClient(client WebSocketClient) func(string) WebSocketClient {
+	return func(string) WebSocketClient {
+		return client
+	}
+}
+
+// jsonResponse returns a successful response with the given JSON body.
+func jsonResponse(body string) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBufferString(body))}
+}
+
+// onPath answers the requests to the given path with the JSON body once.
+func onPath(client *mockHttpClient, path, body string) {
+	client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == path
+	})).Return(jsonResponse(body), nil).Once()
+}
+
 func TestGetDelegationsByLevel(t *testing.T) {
 	client := new(mockHttpClient)
 	tzkt := &Tzkt{
-		url:           "https://fake.api.tzkt.io",
+		endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
 		client:        client,
 		retryAttempts: 3,
+		limiter:       rate.NewLimiter(rate.Inf, 0),
 	}
 
-	delegations := []types.FetchedDelegation{{Level: 1234}}
+	delegations := []types.FetchedDelegation{{Level: 1234, Block: "BL1234"}}
 	buf := new(bytes.Buffer)
 	json.NewEncoder(buf).Encode(delegations)
-	resp := &http.Response{
-		StatusCode: http.StatusOK,
-		Body:       io.NopCloser(buf),
-	}
-	client.On("Do", mock.Anything).Return(resp, nil)
+	onPath(client, "/v1/operations/delegations", buf.String())
+	onPath(client, "/v1/blocks", `[{"level":1233,"hash":"BL1233"},{"level":1234,"hash":"BL1234"}]`)
 
 	dataChan := make(chan *types.ChanMsg, 1)
 	err := tzkt.GetDelegationsByLevel(context.Background(), 1234, dataChan)
@@ -70,8 +98,155 @@ func TestGetDelegationsByLevel(t *testing.T) {
 	assert.Len(t, dataChan, 1)
 	msg := <-dataChan
 	assert.Equal(t, uint64(1234), msg.Level)
+	assert.Equal(t, "BL1234", msg.BlockHash)
+	assert.Equal(t, "BL1233", msg.Predecessor)
 	assert.False(t, msg.Reorg)
 	assert.Equal(t, delegations, msg.Data)
+	client.AssertExpectations(t)
+}
+
+func TestGetDelegationsByLevel_Decoding(t *testing.T) {
+	client := new(mockHttpClient)
+	tzkt := &Tzkt{
+		endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
+		client:        client,
+		retryAttempts: 3,
+		limiter:       rate.NewLimiter(rate.Inf, 0),
+	}
+
+	body := `[{"type":"delegation","id":510049419345920,"level":5479747,"timestamp":"2024-05-03T09:42:35Z",
+		"block":"BLKsAPgZDMfrNTBPRUBgC1tHTbXAM7eWFnDzTDBVzxaLuUGjp7B","hash":"ooLTvENLUGXWRDUwDz6LpAUgMBBBhyaZTbGPcwX6VtFmyjXXWv6",
+		"counter":79437385,"sender":{"address":"tz1VNP4ruDaKmbk9Z2Lw1gmVv1p5AYtwuA2r"},"gasLimit":1100,"gasUsed":1000,
+		"storageLimit":0,"bakerFee":398,"amount":4102934,"prevDelegate":{"alias":"Baking Benjamins","address":"tz1S5WxdZR5f9NzsPXhr7L9L1vrEb5spZFur"},
+		"status":"applied"}]`
+	onPath(client, "/v1/operations/delegations", body)
+	onPath(client, "/v1/blocks", `[{"level":5479746,"hash":"BLprev"},{"level":5479747,"hash":"BLKsAPgZDMfrNTBPRUBgC1tHTbXAM7eWFnDzTDBVzxaLuUGjp7B"}]`)
+
+	dataChan := make(chan *types.ChanMsg, 1)
+	err := tzkt.GetDelegationsByLevel(context.Background(), 5479747, dataChan)
+	assert.NoError(t, err)
+
+	d := (<-dataChan).Data[0]
+	assert.Equal(t, uint64(510049419345920), d.ID)
+	assert.Equal(t, "ooLTvENLUGXWRDUwDz6LpAUgMBBBhyaZTbGPcwX6VtFmyjXXWv6", d.Hash)
+	assert.Equal(t, uint64(79437385), d.Counter)
+	assert.Equal(t, "tz1VNP4ruDaKmbk9Z2Lw1gmVv1p5AYtwuA2r", d.Sender.Address)
+	assert.Nil(t, d.NewDelegate, "an undelegation has no new delegate")
+	assert.Equal(t, "tz1S5WxdZR5f9NzsPXhr7L9L1vrEb5spZFur", d.PrevDelegate.Address)
+	assert.Equal(t, "applied", d.Status)
+	assert.Equal(t, uint64(398), d.BakerFee)
+	assert.Equal(t, uint64(1000), d.GasUsed)
+	assert.Equal(t, uint64(4102934), d.Amount)
+}
+
+func TestGetBlockHash_ErrorClass(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		class error
+	}{
+		{name: "Invalid JSON", body: `{"hash":}`, class: types.ErrDecode},
+		{name: "Unexpected type", body: `{"hash":42}`, class: types.ErrDecode},
+		{name: "Truncated body", body: `{"hash":"BL`, class: types.ErrTransport},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := new(mockHttpClient)
+			tzkt := &Tzkt{
+				endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
+				client:        client,
+				retryAttempts: 1,
+				limiter:       rate.NewLimiter(rate.Inf, 0),
+			}
+			onPath(client, "/v1/blocks/1", tt.body)
+
+			_, err := tzkt.GetBlockHash(context.Background(), 1)
+			assert.ErrorIs(t, err, tt.class)
+		})
+	}
+}
+
+func TestGetDelegationsByRange(t *testing.T) {
+	defaultPageLimit := pageLimit
+	pageLimit = 2
+	defer func() { pageLimit = defaultPageLimit }()
+
+	client := new(mockHttpClient)
+	tzkt := &Tzkt{
+		endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
+		client:        client,
+		retryAttempts: 3,
+		limiter:       rate.NewLimiter(rate.Inf, 0),
+	}
+
+	pages := map[string][]types.FetchedDelegation{
+		"0": {{ID: 1, Level: 10, Block: "BL10"}, {ID: 2, Level: 10, Block: "BL10"}},
+		"2": {{ID: 3, Level: 10, Block: "BL10"}, {ID: 4, Level: 12, Block: "BL12"}},
+		"4": {{ID: 5, Level: 13, Block: "BL13"}},
+	}
+	for cursor, page := range pages {
+		buf := new(bytes.Buffer)
+		json.NewEncoder(buf).Encode(page)
+		cursor := cursor
+		client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+			query := req.URL.Query()
+			return req.URL.Path == "/v1/operations/delegations" && query.Get("id.gt") == cursor && query.Get("level.ge") == "10" && query.Get("level.le") == "13"
+		})).Return(jsonResponse(buf.String()), nil).Once()
+	}
+	// the hashes are paged by level as well, starting at the predecessor of the range
+	blockPages := map[string]string{
+		"9":  `[{"level":9,"hash":"BL9"},{"level":10,"hash":"BL10"}]`,
+		"11": `[{"level":11,"hash":"BL11"},{"level":12,"hash":"BL12"}]`,
+		"13": `[{"level":13,"hash":"BL13"}]`,
+	}
+	for from, body := range blockPages {
+		from := from
+		client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+			return req.URL.Path == "/v1/blocks" && req.URL.Query().Get("level.ge") == from && req.URL.Query().Get("level.le") == "13"
+		})).Return(jsonResponse(body), nil).Once()
+	}
+
+	dataChan := make(chan *types.ChanMsg, 10)
+	err := tzkt.GetDelegationsByRange(context.Background(), 10, 13, dataChan)
+	assert.NoError(t, err)
+	close(dataChan)
+
+	// every level is sent, linked to the previous one
+	var msgs []*types.ChanMsg
+	for msg := range dataChan {
+		msgs = append(msgs, msg)
+	}
+	if assert.Len(t, msgs, 4) {
+		for i, msg := range msgs {
+			level := uint64(10 + i)
+			assert.Equal(t, level, msg.Level)
+			assert.Equal(t, fmt.Sprintf("BL%d", level), msg.BlockHash)
+			assert.Equal(t, fmt.Sprintf("BL%d", level-1), msg.Predecessor)
+		}
+		assert.Len(t, msgs[0].Data, 3)
+		assert.Empty(t, msgs[1].Data)
+		assert.Len(t, msgs[2].Data, 1)
+		assert.Len(t, msgs[3].Data, 1)
+	}
+
+	client.AssertExpectations(t)
+}
+
+func TestGetDelegationsByRange_ChainChanged(t *testing.T) {
+	client := new(mockHttpClient)
+	tzkt := &Tzkt{
+		endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
+		client:        client,
+		retryAttempts: 3,
+		limiter:       rate.NewLimiter(rate.Inf, 0),
+	}
+
+	onPath(client, "/v1/blocks", `[{"level":9,"hash":"BL9"},{"level":10,"hash":"BL10"}]`)
+	onPath(client, "/v1/operations/delegations", `[{"id":1,"level":10,"block":"BL10b"}]`)
+
+	// the delegations were fetched from another branch than the hashes, the range must be fetched again
+	err := tzkt.GetDelegationsByRange(context.Background(), 10, 10, make(chan *types.ChanMsg, 10))
+	assert.ErrorIs(t, err, types.ErrTransport)
 }
 
 func TestSubscribeToHead(t *testing.T) {
@@ -90,10 +265,11 @@ func TestSubscribeToHead(t *testing.T) {
 		client := new(mockHttpClient)
 
 		tzkt := &Tzkt{
-			url:           "https://fake.api.tzkt.io",
-			wsClient:      mockWsClient,
+			endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
+			newWSClient:   staticWSClient(mockWsClient),
 			client:        client,
 			retryAttempts: 3,
+			limiter:       rate.NewLimiter(rate.Inf, 0),
 		}
 		delegations := []types.FetchedDelegation{{Level: 101}}
 		buf := new(bytes.Buffer)
@@ -104,7 +280,12 @@ func TestSubscribeToHead(t *testing.T) {
 		}
 
 		// Prepare client mocks
-		client.On("Do", mock.Anything).Return(resp, nil)
+		client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+			return req.URL.Path == "/v1/operations/delegations"
+		})).Return(resp, nil)
+		client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+			return req.URL.Path == "/v1/blocks/100"
+		})).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBufferString(`{"hash":"BL100"}`))}, nil)
 
 		// Prepare wsClient mocks
 		mockWsClient.On("Connect", ctx).Return(nil)
@@ -117,14 +298,17 @@ func TestSubscribeToHead(t *testing.T) {
 		// Simulating messages
 		go func() {
 			messageChan <- events.Message{Type: events.MessageTypeState, State: 100}
-			messageChan <- events.Message{Type: events.MessageTypeData, Channel: events.ChannelHead, Body: data.Head{Level: 101}}
+			messageChan <- events.Message{Type: events.MessageTypeData, Channel: events.ChannelHead, Body: data.Head{Level: 101, Hash: "BL101"}}
 			messageChan <- events.Message{Type: events.MessageTypeReorg, State: 99}
 			close(messageChan)
 		}()
 
 		// Check outputs
 		assert.Equal(t, uint64(100), <-currentHead)
-		assert.Equal(t, uint64(101), (<-dataChan).Level)
+		msg := <-dataChan
+		assert.Equal(t, uint64(101), msg.Level)
+		assert.Equal(t, "BL101", msg.BlockHash)
+		assert.Equal(t, "BL100", msg.Predecessor)
 		assert.Equal(t, true, (<-dataChan).Reorg)
 		assert.Empty(t, errorChan)
 
@@ -135,14 +319,17 @@ func TestSubscribeToHead(t *testing.T) {
 		client := new(mockHttpClient)
 
 		tzkt := &Tzkt{
-			url:           "https://fake.api.tzkt.io",
-			wsClient:      mockWsClient,
+			endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
+			newWSClient:   staticWSClient(mockWsClient),
 			client:        client,
 			retryAttempts: 3,
+			limiter:       rate.NewLimiter(rate.Inf, 0),
 		}
 		mockWsClient.On("Connect", mock.Anything).Return(errors.New("connection failed"))
 		go tzkt.SubscribeToHead(ctx, dataChan, currentHead, errorChan)
-		assert.Equal(t, "couldn't connect to tzkt ws: connection failed", (<-errorChan).Error())
+		err := <-errorChan
+		assert.ErrorIs(t, err, types.ErrTransport)
+		assert.EqualError(t, err, "transport error: couldn't connect to tzkt ws: connection failed")
 	})
 
 	t.Run("Subscription failed", func(t *testing.T) {
@@ -150,26 +337,137 @@ func TestSubscribeToHead(t *testing.T) {
 		client := new(mockHttpClient)
 
 		tzkt := &Tzkt{
-			url:           "https://fake.api.tzkt.io",
-			wsClient:      mockWsClient,
+			endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
+			newWSClient:   staticWSClient(mockWsClient),
 			client:        client,
 			retryAttempts: 3,
+			limiter:       rate.NewLimiter(rate.Inf, 0),
 		}
 		mockWsClient.On("Connect", ctx).Return(nil)
 		mockWsClient.On("Close").Return(nil)
 		mockWsClient.On("SubscribeToHead").Return(errors.New("subscription failed"))
 
 		go tzkt.SubscribeToHead(ctx, dataChan, currentHead, errorChan)
-		assert.Equal(t, "couldn't subscribe to tzkt head: subscription failed", (<-errorChan).Error())
+		err := <-errorChan
+		assert.ErrorIs(t, err, types.ErrTransport)
+		assert.EqualError(t, err, "transport error: couldn't subscribe to tzkt head: subscription failed")
 	})
 
 }
 
+func TestSubscribeToHead_Operations(t *testing.T) {
+	dataChan := make(chan *types.ChanMsg, 10)
+	currentHead := make(chan uint64, 10)
+	errorChan := make(chan error, 10)
+	messageChan := make(chan events.Message, 20)
+
+	ctx := context.Background()
+
+	mockWsClient := new(mockWebSocketClient)
+	client := new(mockHttpClient)
+
+	tzkt := &Tzkt{
+		endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
+		newWSClient:   staticWSClient(mockWsClient),
+		client:        client,
+		retryAttempts: 3,
+		limiter:       rate.NewLimiter(rate.Inf, 0),
+		subscription:  config.SubscriptionOperations,
+	}
+
+	mockWsClient.On("Connect", ctx).Return(nil)
+	mockWsClient.On("SubscribeToHead").Return(nil)
+	mockWsClient.On("SubscribeToOperations", "", []string{data.KindDelegation}).Return(nil)
+	mockWsClient.On("Listen").Return(messageChan)
+	mockWsClient.On("Close").Return(nil)
+
+	delegation := &data.Delegation{
+		ID: 42, Level: 101, Block: "BL101", Hash: "oo1", Counter: 7, Status: "applied",
+		Timestamp:   time.Date(2024, 4, 21, 16, 23, 27, 0, time.UTC),
+		Amount:      decimal.NewFromInt(1234),
+		Sender:      &data.Address{Address: "tz1"},
+		NewDelegate: &data.Address{Address: "tz1baker"},
+	}
+
+	go tzkt.SubscribeToHead(ctx, dataChan, currentHead, errorChan)
+
+	go func() {
+		// each channel sends its state
+		messageChan <- events.Message{Type: events.MessageTypeState, Channel: events.ChannelHead, State: 100}
+		messageChan <- events.Message{Type: events.MessageTypeState, Channel: events.ChannelOperations, State: 100}
+		messageChan <- events.Message{Type: events.MessageTypeData, Channel: events.ChannelHead, Body: data.Head{Level: 101, Hash: "BL101"}}
+		messageChan <- events.Message{Type: events.MessageTypeData, Channel: events.ChannelOperations, State: 101, Body: []any{delegation}}
+		// level 102 has no delegations, it is sent with the next head
+		messageChan <- events.Message{Type: events.MessageTypeData, Channel: events.ChannelHead, Body: data.Head{Level: 102, Hash: "BL102"}}
+		messageChan <- events.Message{Type: events.MessageTypeData, Channel: events.ChannelHead, Body: data.Head{Level: 103, Hash: "BL103"}}
+		// the reorg is notified on both channels
+		messageChan <- events.Message{Type: events.MessageTypeReorg, Channel: events.ChannelHead, State: 101}
+		messageChan <- events.Message{Type: events.MessageTypeReorg, Channel: events.ChannelOperations, State: 101}
+		close(messageChan)
+	}()
+
+	assert.Equal(t, uint64(100), <-currentHead)
+
+	msg := <-dataChan
+	assert.Equal(t, uint64(101), msg.Level)
+	assert.Equal(t, "BL101", msg.BlockHash)
+	assert.Equal(t, []types.FetchedDelegation{{
+		ID: 42, Level: 101, Block: "BL101", Hash: "oo1", Counter: 7, Status: "applied",
+		Timestamp:   "2024-04-21T16:23:27Z",
+		Amount:      1234,
+		Sender:      types.Sender{Address: "tz1"},
+		NewDelegate: &types.Delegate{Address: "tz1baker"},
+	}}, msg.Data)
+
+	msg = <-dataChan
+	assert.Equal(t, uint64(102), msg.Level)
+	assert.Equal(t, "BL102", msg.BlockHash)
+	assert.Equal(t, "BL101", msg.Predecessor)
+	assert.Empty(t, msg.Data)
+
+	msg = <-dataChan
+	assert.True(t, msg.Reorg)
+	assert.Equal(t, uint64(101), msg.Level)
+
+	assert.Empty(t, dataChan, "the pending level 103 is dropped by the reorg and the reorg is sent once")
+	assert.Empty(t, currentHead)
+	assert.Empty(t, errorChan)
+	// no delegations are fetched over HTTP
+	client.AssertNotCalled(t, "Do", mock.Anything)
+}
+
+func TestOperationsStream_SplitLevel(t *testing.T) {
+	dataChan := make(chan *types.ChanMsg, 10)
+	stream := &operationsStream{dataChan: dataChan, lastLevel: 100, lastHash: "BL100"}
+	delegation := func(id uint64, hash string) *data.Delegation {
+		return &data.Delegation{ID: id, Level: 101, Block: "BL101", Hash: hash, Sender: &data.Address{Address: "tz1"}}
+	}
+
+	// the delegations of level 101 are pushed in two messages, one of them before the head
+	stream.onOperations([]any{delegation(1, "oo1")})
+	stream.onHead(data.Head{Level: 101, Hash: "BL101"})
+	stream.onOperations([]any{delegation(2, "oo2")})
+	assert.Empty(t, dataChan, "the level is held until the next head")
+
+	stream.onHead(data.Head{Level: 102, Hash: "BL102"})
+	if assert.Len(t, dataChan, 1) {
+		msg := <-dataChan
+		assert.Equal(t, uint64(101), msg.Level)
+		assert.Equal(t, "BL101", msg.BlockHash)
+		assert.Equal(t, "BL100", msg.Predecessor)
+		if assert.Len(t, msg.Data, 2) {
+			assert.Equal(t, "oo1", msg.Data[0].Hash)
+			assert.Equal(t, "oo2", msg.Data[1].Hash)
+		}
+	}
+}
+
 func TestExecuteRequest(t *testing.T) {
 	tests := []struct {
 		name            string
 		prepare         func(*mockHttpClient)
 		expectedError   string
+		expectedClass   error
 		expectedRetries int
 	}{
 		{
@@ -178,6 +476,7 @@ func TestExecuteRequest(t *testing.T) {
 				client.On("Do", mock.Anything).Return(&http.Response{}, errors.New("network error")).Times(3)
 			},
 			expectedError:   "network error",
+			expectedClass:   types.ErrTransport,
 			expectedRetries: 3,
 		},
 		{
@@ -190,8 +489,39 @@ func TestExecuteRequest(t *testing.T) {
 				client.On("Do", mock.Anything).Return(resp, nil).Times(3)
 			},
 			expectedError:   "non-200 status code: 500",
+			expectedClass:   types.ErrTransport,
 			expectedRetries: 3,
 		},
+		{
+			name: "HTTP 404 Error, should fail without retry",
+			prepare: func(client *mockHttpClient) {
+				resp := &http.Response{
+					StatusCode: http.StatusNotFound,
+					Body:       io.NopCloser(bytes.NewReader([]byte{})),
+				}
+				client.On("Do", mock.Anything).Return(resp, nil).Once()
+			},
+			expectedError:   "non-200 status code: 404",
+			expectedClass:   types.ErrProtocol,
+			expectedRetries: 1,
+		},
+		{
+			name: "HTTP 429 Error, should retry and succeed",
+			prepare: func(client *mockHttpClient) {
+				resp := &http.Response{
+					StatusCode: http.StatusTooManyRequests,
+					Header:     http.Header{"Retry-After": []string{"0"}},
+					Body:       io.NopCloser(bytes.NewReader([]byte{})),
+				}
+				client.On("Do", mock.Anything).Return(resp, nil).Once()
+				client.On("Do", mock.Anything).Return(&http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewReader([]byte{})),
+				}, nil).Once()
+			},
+			expectedError:   "",
+			expectedRetries: 2,
+		},
 		{
 			name: "HTTP 200 OK, should succeed",
 			prepare: func(client *mockHttpClient) {
@@ -212,15 +542,15 @@ func TestExecuteRequest(t *testing.T) {
 			tc.prepare(client)
 			tzkt := &Tzkt{
 				client:        client,
-				url:           "https://fake.api.tzkt.io",
+				endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
 				retryAttempts: 3,
+				limiter:       rate.NewLimiter(rate.Inf, 0),
 			}
-			req, _ := http.NewRequest("GET", tzkt.url, nil)
 			ctx := context.Background()
 
-			resp, err := tzkt.executeRequest(ctx, req)
+			resp, err := tzkt.executeRequest(ctx, "/v1/head")
 			if tc.expectedError != "" {
-				assert.Error(t, err)
+				assert.ErrorIs(t, err, tc.expectedClass)
 				assert.Contains(t, err.Error(), tc.expectedError)
 			} else {
 				assert.NoError(t, err)
@@ -230,3 +560,487 @@ func TestExecuteRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestExecuteRequest_RateLimit(t *testing.T) {
+	client := new(mockHttpClient)
+	for i := 0; i < 3; i++ {
+		resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader([]byte{}))}
+		client.On("Do", mock.Anything).Return(resp, nil).Once()
+	}
+	tzkt := &Tzkt{
+		client:        client,
+		endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
+		retryAttempts: 3,
+		limiter:       rate.NewLimiter(rate.Every(50*time.Millisecond), 1),
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := tzkt.executeRequest(context.Background(), "/v1/head")
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	// the first request uses the burst, the next ones wait for a token
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+}
+
+func TestRetryDelay(t *testing.T) {
+	tzkt := &Tzkt{retryDelay: 100 * time.Millisecond, maxRetryDelay: time.Second}
+
+	t.Run("Retry-After is honored up to the maximum delay", func(t *testing.T) {
+		err := &statusError{code: http.StatusServiceUnavailable, retryAfter: 500 * time.Millisecond}
+		assert.Equal(t, 500*time.Millisecond, tzkt.retryDelayFor(0, err, nil))
+
+		err = &statusError{code: http.StatusServiceUnavailable, retryAfter: time.Hour}
+		assert.Equal(t, time.Second, tzkt.retryDelayFor(0, err, nil))
+	})
+
+	t.Run("Exponential backoff with jitter", func(t *testing.T) {
+		err := errors.New("network error")
+		for n := uint(0); n < 40; n++ {
+			delay := tzkt.retryDelayFor(n, err, nil)
+			assert.GreaterOrEqual(t, delay, time.Duration(0))
+			assert.LessOrEqual(t, delay, min(100*time.Millisecond<<min(n, 10), time.Second))
+		}
+	})
+
+	t.Run("Long backoff doesn't overflow", func(t *testing.T) {
+		tzkt := &Tzkt{retryDelay: 30 * time.Second, maxRetryDelay: time.Hour}
+		err := errors.New("network error")
+		for n := uint(0); n < 100; n++ {
+			delay := tzkt.retryDelayFor(n, err, nil)
+			assert.GreaterOrEqual(t, delay, time.Duration(0))
+			assert.LessOrEqual(t, delay, time.Hour)
+		}
+		// the jitter makes a zero delay possible but not for all the late retries
+		var total time.Duration
+		for i := 0; i < 10; i++ {
+			total += tzkt.retryDelayFor(60, err, nil)
+		}
+		assert.Greater(t, total, time.Duration(0))
+	})
+
+	t.Run("Retry-After header", func(t *testing.T) {
+		assert.Equal(t, 120*time.Second, retryAfter("120"))
+		assert.Equal(t, time.Duration(0), retryAfter(""))
+		assert.Equal(t, time.Duration(0), retryAfter("soon"))
+		assert.InDelta(t, float64(time.Minute), float64(retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))), float64(2*time.Second))
+	})
+}
+
+func TestEndpointFailover(t *testing.T) {
+	t.Run("Failing endpoint is replaced between retries", func(t *testing.T) {
+		client := new(mockHttpClient)
+		tzkt := &Tzkt{
+			endpoints:     newEndpointPool("https://a.tzkt.io", "https://b.tzkt.io"),
+			client:        client,
+			retryAttempts: 3,
+			limiter:       rate.NewLimiter(rate.Inf, 0),
+		}
+		client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+			return req.URL.Host == "a.tzkt.io"
+		})).Return(&http.Response{}, errors.New("connection refused"))
+		client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+			return req.URL.Host == "b.tzkt.io"
+		})).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBufferString(`{"hash":"BL1"}`))}, nil)
+
+		hash, err := tzkt.GetBlockHash(context.Background(), 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "BL1", hash)
+		assert.Equal(t, "https://b.tzkt.io", tzkt.endpoints.current().url)
+		client.AssertNumberOfCalls(t, "Do", 2)
+	})
+
+	t.Run("Endpoints are scored on latency, errors and head lag", func(t *testing.T) {
+		pool := newEndpointPool("https://a.tzkt.io", "https://b.tzkt.io")
+		a, b := pool.endpoints[0], pool.endpoints[1]
+
+		pool.recordLatency(a, 100*time.Millisecond)
+		assert.Equal(t, a, pool.current(), "b was never measured")
+
+		pool.recordLatency(b, 90*time.Millisecond)
+		assert.Equal(t, a, pool.current(), "b is not enough faster to switch")
+
+		pool.recordLatency(b, 10*time.Millisecond)
+		pool.recordLatency(b, 10*time.Millisecond)
+		pool.recordLatency(b, 10*time.Millisecond)
+		pool.recordLatency(b, 10*time.Millisecond)
+		assert.Equal(t, b, pool.current())
+
+		pool.recordHead(a, 100)
+		pool.recordHead(b, 95)
+		assert.Equal(t, a, pool.current(), "b is lagging behind")
+
+		pool.record(a, errors.New("timeout"))
+		assert.Equal(t, b, pool.current(), "a failed")
+	})
+
+	t.Run("Requests don't change the latency", func(t *testing.T) {
+		client := new(mockHttpClient)
+		tzkt := &Tzkt{
+			endpoints:     newEndpointPool("https://a.tzkt.io", "https://b.tzkt.io"),
+			client:        client,
+			retryAttempts: 3,
+			limiter:       rate.NewLimiter(rate.Inf, 0),
+		}
+		client.On("Do", mock.Anything).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBufferString(`{"hash":"BL1"}`))}, nil).
+			After(10 * time.Millisecond)
+
+		_, err := tzkt.GetBlockHash(context.Background(), 1)
+		assert.NoError(t, err)
+		assert.Zero(t, tzkt.endpoints.endpoints[0].latency, "a slow query is not a slow endpoint")
+	})
+
+	t.Run("Range requests are pinned to an endpoint", func(t *testing.T) {
+		defer func(limit int) { pageLimit = limit }(pageLimit)
+		pageLimit = 1
+
+		client := new(mockHttpClient)
+		tzkt := &Tzkt{
+			endpoints:     newEndpointPool("https://a.tzkt.io", "https://b.tzkt.io"),
+			client:        client,
+			retryAttempts: 3,
+			limiter:       rate.NewLimiter(rate.Inf, 0),
+		}
+		a, b := tzkt.endpoints.endpoints[0], tzkt.endpoints.endpoints[1]
+		tzkt.endpoints.recordLatency(a, 100*time.Millisecond)
+
+		var hosts []string
+		on := func(path, param, value, body string) {
+			client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+				return req.URL.Path == path && req.URL.Query().Get(param) == value
+			})).Return(jsonResponse(body), nil).Once().Run(func(args mock.Arguments) {
+				hosts = append(hosts, args.Get(0).(*http.Request).URL.Host)
+				// b becomes much faster while the range is fetched
+				tzkt.endpoints.recordLatency(b, time.Millisecond)
+			})
+		}
+		on("/v1/blocks", "level.ge", "100", `[{"level":100,"hash":"BL100"}]`)
+		on("/v1/blocks", "level.ge", "101", `[{"level":101,"hash":"BL101"}]`)
+		on("/v1/operations/delegations", "id.gt", "0", `[{"id":1,"level":101,"block":"BL101"}]`)
+		on("/v1/operations/delegations", "id.gt", "1", `[]`)
+
+		dataChan := make(chan *types.ChanMsg, 1)
+		err := tzkt.GetDelegationsByRange(context.Background(), 101, 101, dataChan)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a.tzkt.io", "a.tzkt.io", "a.tzkt.io", "a.tzkt.io"}, hosts)
+		assert.Equal(t, b, tzkt.endpoints.current(), "the next calls use the fastest endpoint")
+	})
+
+	t.Run("Head fetches are pinned to the subscription endpoint", func(t *testing.T) {
+		mockWsClient := new(mockWebSocketClient)
+		client := new(mockHttpClient)
+		tzkt := &Tzkt{
+			endpoints:     newEndpointPool("https://a.tzkt.io", "https://b.tzkt.io"),
+			newWSClient:   staticWSClient(mockWsClient),
+			client:        client,
+			retryAttempts: 3,
+			limiter:       rate.NewLimiter(rate.Inf, 0),
+		}
+		a, b := tzkt.endpoints.endpoints[0], tzkt.endpoints.endpoints[1]
+		tzkt.endpoints.recordLatency(a, 100*time.Millisecond)
+
+		var hosts []string
+		on := func(path, body string) {
+			client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+				return req.URL.Path == path
+			})).Return(jsonResponse(body), nil).Once().Run(func(args mock.Arguments) {
+				hosts = append(hosts, args.Get(0).(*http.Request).URL.Host)
+			})
+		}
+		on("/v1/operations/delegations", `[]`)
+		on("/v1/blocks/100", `{"hash":"BL100"}`)
+
+		messageChan := make(chan events.Message, 2)
+		mockWsClient.On("Connect", mock.Anything).Return(nil)
+		mockWsClient.On("SubscribeToHead").Return(nil)
+		mockWsClient.On("Listen").Return(messageChan)
+		mockWsClient.On("Close").Return(nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dataChan := make(chan *types.ChanMsg, 1)
+		currentHead := make(chan uint64, 1)
+		go tzkt.SubscribeToHead(ctx, dataChan, currentHead, make(chan error, 1))
+
+		messageChan <- events.Message{Type: events.MessageTypeState, State: 100}
+		assert.Equal(t, uint64(100), <-currentHead)
+		// b becomes the active endpoint before the head is announced by a
+		tzkt.endpoints.recordLatency(b, time.Millisecond)
+		assert.Equal(t, b, tzkt.endpoints.current())
+		messageChan <- events.Message{Type: events.MessageTypeData, Channel: events.ChannelHead, Body: data.Head{Level: 101, Hash: "BL101"}}
+
+		msg := <-dataChan
+		assert.Equal(t, "BL100", msg.Predecessor)
+		assert.Equal(t, []string{"a.tzkt.io", "a.tzkt.io"}, hosts)
+	})
+
+	t.Run("Subscription uses the next endpoint after a connection failure", func(t *testing.T) {
+		failingWs := new(mockWebSocketClient)
+		failingWs.On("Connect", mock.Anything).Return(errors.New("connection failed"))
+
+		var dialed []string
+		tzkt := &Tzkt{
+			endpoints: newEndpointPool("https://a.tzkt.io", "https://b.tzkt.io"),
+			newWSClient: func(url string) WebSocketClient {
+				dialed = append(dialed, url)
+				return failingWs
+			},
+			retryAttempts: 3,
+			limiter:       rate.NewLimiter(rate.Inf, 0),
+		}
+		errorChan := make(chan error, 2)
+
+		tzkt.SubscribeToHead(context.Background(), make(chan *types.ChanMsg), make(chan uint64), errorChan)
+		tzkt.SubscribeToHead(context.Background(), make(chan *types.ChanMsg), make(chan uint64), errorChan)
+
+		assert.Equal(t, []string{"https://a.tzkt.io", "https://b.tzkt.io"}, dialed)
+		assert.Len(t, errorChan, 2)
+	})
+
+	t.Run("Health checks record the head of every endpoint", func(t *testing.T) {
+		client := new(mockHttpClient)
+		tzkt := &Tzkt{
+			endpoints:     newEndpointPool("https://a.tzkt.io", "https://b.tzkt.io"),
+			client:        client,
+			retryAttempts: 3,
+			limiter:       rate.NewLimiter(rate.Inf, 0),
+		}
+		client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+			return req.URL.Host == "a.tzkt.io" && req.URL.Path == "/v1/head"
+		})).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBufferString(`{"level":90}`))}, nil)
+		client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+			return req.URL.Host == "b.tzkt.io" && req.URL.Path == "/v1/head"
+		})).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBufferString(`{"level":100}`))}, nil)
+
+		for _, ep := range tzkt.endpoints.endpoints {
+			tzkt.checkEndpoint(context.Background(), ep)
+		}
+
+		assert.Equal(t, uint64(90), tzkt.endpoints.endpoints[0].headLevel)
+		assert.Equal(t, uint64(100), tzkt.endpoints.endpoints[1].headLevel)
+		assert.Equal(t, "https://b.tzkt.io", tzkt.endpoints.current().url, "a is 10 blocks behind")
+	})
+}
+
+func TestRecordReplay(t *testing.T) {
+	path := t.TempDir() + "/recording.jsonl"
+	delegations := []types.FetchedDelegation{{ID: 1, Level: 101, Block: "BL101", Hash: "oo1", Sender: types.Sender{Address: "tz1"}}}
+
+	// subscribe returns the messages sent by a head subscription until the reorg message
+	subscribe := func(tzkt *Tzkt) []*types.ChanMsg {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		dataChan := make(chan *types.ChanMsg, 10)
+		go tzkt.SubscribeToHead(ctx, dataChan, make(chan uint64, 10), make(chan error, 10))
+
+		var msgs []*types.ChanMsg
+		for msg := range dataChan {
+			msgs = append(msgs, msg)
+			if msg.Reorg {
+				return msgs
+			}
+		}
+		return msgs
+	}
+
+	client := new(mockHttpClient)
+	mockWsClient := new(mockWebSocketClient)
+	messageChan := make(chan events.Message, 10)
+	recorded := &Tzkt{
+		endpoints:     newEndpointPool("https://fake.api.tzkt.io"),
+		newWSClient:   staticWSClient(mockWsClient),
+		client:        client,
+		retryAttempts: 3,
+		limiter:       rate.NewLimiter(rate.Inf, 0),
+	}
+	buf := new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(delegations)
+	client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v1/operations/delegations"
+	})).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(buf)}, nil)
+	client.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v1/blocks/100"
+	})).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBufferString(`{"hash":"BL100"}`))}, nil)
+	mockWsClient.On("Connect", mock.Anything).Return(nil)
+	mockWsClient.On("SubscribeToHead").Return(nil)
+	mockWsClient.On("Listen").Return(messageChan)
+	mockWsClient.On("Close").Return(nil)
+
+	recorder, err := NewRecorder(path)
+	assert.NoError(t, err)
+	recorded.Record(recorder)
+
+	messageChan <- events.Message{Type: events.MessageTypeState, State: 100}
+	messageChan <- events.Message{Type: events.MessageTypeData, Channel: events.ChannelHead, Body: data.Head{Level: 101, Hash: "BL101"}}
+	messageChan <- events.Message{Type: events.MessageTypeReorg, State: 100}
+	expected := subscribe(recorded)
+	assert.NoError(t, recorder.Close())
+	assert.Len(t, expected, 2)
+	assert.Equal(t, delegations, expected[0].Data)
+
+	t.Run("Replay", func(t *testing.T) {
+		replay, err := LoadReplay(path, 1000)
+		assert.NoError(t, err)
+
+		replayed := &Tzkt{
+			endpoints:     newEndpointPool("https://another.api.tzkt.io"),
+			retryAttempts: 1,
+			limiter:       rate.NewLimiter(rate.Inf, 0),
+		}
+		replayed.Replay(replay)
+
+		assert.Equal(t, expected, subscribe(replayed))
+
+		// the last response to a path is served again
+		hash, err := replayed.GetBlockHash(context.Background(), 100)
+		assert.NoError(t, err)
+		assert.Equal(t, "BL100", hash)
+	})
+
+	t.Run("Missing response", func(t *testing.T) {
+		replay, err := LoadReplay(path, 1000)
+		assert.NoError(t, err)
+
+		_, err = replay.Do(httptest.NewRequest(http.MethodGet, "/v1/blocks/99", nil))
+		assert.EqualError(t, err, "no recorded response for /v1/blocks/99")
+	})
+
+	t.Run("Missing recording", func(t *testing.T) {
+		_, err := LoadReplay(t.TempDir()+"/missing.jsonl", 1)
+		assert.Error(t, err)
+	})
+}
+
+// newFakeClient creates a client of the fake TzKT server like NewClient does.
+func newFakeClient(server *tzkttest.Server, subscription string) *Tzkt {
+	return &Tzkt{
+		endpoints: newEndpointPool(server.URL),
+		client:    server.Client(),
+		newWSClient: func(url string) WebSocketClient {
+			return events.NewTzKT(url + "/v1/ws")
+		},
+		retryAttempts: 3,
+		subscription:  subscription,
+		limiter:       rate.NewLimiter(rate.Inf, 0),
+	}
+}
+
+func TestFakeServer_Subscription(t *testing.T) {
+	for _, subscription := range []string{config.SubscriptionHead, config.SubscriptionOperations} {
+		t.Run(subscription, func(t *testing.T) {
+			server := tzkttest.NewServer(100)
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			dataChan := make(chan *types.ChanMsg, 10)
+			currentHead := make(chan uint64, 10)
+			errorChan := make(chan error, 10)
+			go newFakeClient(server, subscription).SubscribeToHead(ctx, dataChan, currentHead, errorChan)
+
+			assert.Equal(t, uint64(100), <-currentHead)
+
+			delegation := types.FetchedDelegation{Sender: types.Sender{Address: "tz1"}, NewDelegate: &types.Delegate{Address: "tz1baker"}, Amount: 100}
+			// in operations mode a level is only sent once the next block is received
+			server.AppendBlock(delegation)
+			server.AppendBlock()
+			server.AppendBlock(delegation)
+			server.AppendBlock()
+			msg := <-dataChan
+			assert.Equal(t, uint64(101), msg.Level)
+			assert.Equal(t, "BL101", msg.BlockHash)
+			if subscription == config.SubscriptionHead {
+				assert.Equal(t, "BL100", msg.Predecessor)
+			}
+			if assert.Len(t, msg.Data, 1) {
+				assert.Equal(t, "tz1", msg.Data[0].Sender.Address)
+				assert.Equal(t, "tz1baker", *msg.Data[0].NewDelegateAddress())
+				assert.Equal(t, uint64(100), msg.Data[0].Amount)
+				assert.Equal(t, "BL101", msg.Data[0].Block)
+			}
+
+			msg = <-dataChan
+			assert.Equal(t, uint64(102), msg.Level)
+			assert.Equal(t, "BL101", msg.Predecessor)
+			assert.Empty(t, msg.Data)
+			msg = <-dataChan
+			assert.Equal(t, uint64(103), msg.Level)
+			assert.Equal(t, "BL102", msg.Predecessor)
+			assert.Len(t, msg.Data, 1)
+			if subscription == config.SubscriptionHead {
+				assert.Equal(t, uint64(104), (<-dataChan).Level)
+			}
+
+			server.Reorg(102)
+			msg = <-dataChan
+			assert.True(t, msg.Reorg)
+			assert.Equal(t, uint64(102), msg.Level)
+
+			server.AppendBlock(delegation)
+			server.AppendBlock()
+			msg = <-dataChan
+			assert.Equal(t, uint64(103), msg.Level)
+			assert.Equal(t, "BL103r1", msg.BlockHash)
+			assert.Equal(t, "BL103r1", msg.Data[0].Block)
+			assert.Empty(t, errorChan)
+		})
+	}
+}
+
+func TestFakeServer_GetDelegationsByRange(t *testing.T) {
+	defer func(limit int) { pageLimit = limit }(pageLimit)
+	pageLimit = 2
+
+	server := tzkttest.NewServer(100)
+	defer server.Close()
+	delegation := types.FetchedDelegation{Sender: types.Sender{Address: "tz1"}}
+	server.AppendBlock(delegation, delegation, delegation)
+	server.AppendBlock()
+	server.AppendBlock(delegation)
+	server.AppendBlock()
+
+	dataChan := make(chan *types.ChanMsg, 10)
+	err := newFakeClient(server, config.SubscriptionHead).GetDelegationsByRange(context.Background(), 100, 104, dataChan)
+	assert.NoError(t, err)
+	close(dataChan)
+
+	// every level of the range is sent and extends the previous one
+	var levels []uint64
+	var count int
+	predecessor := server.BlockHash(99)
+	for msg := range dataChan {
+		levels = append(levels, msg.Level)
+		count += len(msg.Data)
+		assert.Equal(t, server.BlockHash(msg.Level), msg.BlockHash)
+		assert.Equal(t, predecessor, msg.Predecessor, "level %d", msg.Level)
+		predecessor = msg.BlockHash
+	}
+	assert.Equal(t, []uint64{100, 101, 102, 103, 104}, levels)
+	assert.Equal(t, 4, count)
+}
+
+func TestFakeServer_Retry(t *testing.T) {
+	server := tzkttest.NewServer(100)
+	defer server.Close()
+	client := newFakeClient(server, config.SubscriptionHead)
+
+	t.Run("Transient errors are retried", func(t *testing.T) {
+		server.FailRequests(2, http.StatusServiceUnavailable)
+		hash, err := client.GetBlockHash(context.Background(), 100)
+		assert.NoError(t, err)
+		assert.Equal(t, "BL100", hash)
+	})
+
+	t.Run("Unknown block", func(t *testing.T) {
+		_, err := client.GetBlockHash(context.Background(), 101)
+		assert.ErrorIs(t, err, types.ErrProtocol)
+	})
+
+	t.Run("Too many failures", func(t *testing.T) {
+		server.FailRequests(3, http.StatusInternalServerError)
+		_, err := client.GetBlockHash(context.Background(), 100)
+		assert.ErrorIs(t, err, types.ErrTransport)
+	})
+}
@@ -0,0 +1,501 @@
+// Package tzkttest provides an in-process TzKT server backed by a scriptable fake chain, so the tzkt client
+// and the pipeline built on it can be tested against real HTTP responses and SignalR WebSocket messages.
+package tzkttest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+)
+
+// Server is a fake TzKT instance serving the HTTP endpoints and the ws events used by the watcher.
+// Its URL is the base url of the tzkt configuration.
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	head    uint64
+	blocks  map[uint64]*block
+	nextID  uint64
+	reorgs  int
+	clients map[*client]struct{}
+	// failures is the number of HTTP requests still to fail with failureStatus
+	failures      int
+	failureStatus int
+}
+
+// block is a block of the fake chain. The blocks below the initial head are empty and not stored.
+type block struct {
+	level       uint64
+	hash        string
+	timestamp   string
+	delegations []types.FetchedDelegation
+}
+
+// genesisTime is the timestamp of level 0, blocks are baked every blockTime.
+var genesisTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const blockTime = 8 * time.Second
+
+// NewServer starts a server whose chain has empty blocks up to the given head level.
+// The server is closed with Close.
+func NewServer(head uint64) *Server {
+	s := &Server{
+		head:    head,
+		blocks:  make(map[uint64]*block),
+		nextID:  1,
+		clients: make(map[*client]struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/head", s.withFailures(s.handleHead))
+	mux.HandleFunc("/v1/blocks", s.withFailures(s.handleBlocks))
+	mux.HandleFunc("/v1/blocks/", s.withFailures(s.handleBlock))
+	mux.HandleFunc("/v1/operations/delegations", s.withFailures(s.handleDelegations))
+	mux.HandleFunc("/v1/ws/negotiate", s.handleNegotiate)
+	mux.HandleFunc("/v1/ws", s.handleWS)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Close drops the ws connections and shuts the server down.
+func (s *Server) Close() {
+	s.DropConnections()
+	s.Server.Close()
+}
+
+// Head returns the level of the head of the chain.
+func (s *Server) Head() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.head
+}
+
+// BlockHash returns the hash of the block at the given level, empty above the head.
+func (s *Server) BlockHash(level uint64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.block(level)
+	if !ok {
+		return ""
+	}
+	return b.hash
+}
+
+// AppendBlock bakes a block on top of the head with the given delegations and pushes it to the subscribers.
+// The level, block and timestamp of the delegations are set, as well as their id, hash and status when missing.
+// It returns the level of the new block.
+func (s *Server) AppendBlock(delegations ...types.FetchedDelegation) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	level := s.head + 1
+	b := &block{
+		level:     level,
+		hash:      s.hash(level),
+		timestamp: timestamp(level),
+	}
+	for _, d := range delegations {
+		if d.ID == 0 {
+			d.ID = s.nextID
+		}
+		s.nextID = max(s.nextID, d.ID+1)
+		if d.Hash == "" {
+			d.Hash = fmt.Sprintf("oo%d", d.ID)
+		}
+		if d.Status == "" {
+			d.Status = "applied"
+		}
+		d.Level = level
+		d.Block = b.hash
+		d.Timestamp = b.timestamp
+		b.delegations = append(b.delegations, d)
+	}
+	s.blocks[level] = b
+	s.head = level
+
+	s.broadcast(channelHead, packet{Type: messageTypeData, State: level, Data: headJSON(b)})
+	if len(b.delegations) > 0 {
+		s.broadcast(channelOperations, packet{Type: messageTypeData, State: level, Data: operationsJSON(b.delegations)})
+	}
+	return level
+}
+
+// Reorg drops the blocks above the given level and notifies the subscribers. The blocks appended
+// afterwards get new hashes.
+func (s *Server) Reorg(level uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for l := range s.blocks {
+		if l > level {
+			delete(s.blocks, l)
+		}
+	}
+	s.head = min(s.head, level)
+	s.reorgs++
+
+	s.broadcast(channelHead, packet{Type: messageTypeReorg, State: level})
+	s.broadcast(channelOperations, packet{Type: messageTypeReorg, State: level})
+}
+
+// FailRequests makes the next n HTTP requests to the api fail with the given status code.
+func (s *Server) FailRequests(n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+	s.failureStatus = status
+}
+
+// DropConnections closes the ws connections without closing handshake, like a network failure.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+		delete(s.clients, c)
+	}
+}
+
+// block returns the block at the given level, the blocks below the initial head are synthesized.
+func (s *Server) block(level uint64) (*block, bool) {
+	if level > s.head {
+		return nil, false
+	}
+	if b, ok := s.blocks[level]; ok {
+		return b, true
+	}
+	return &block{level: level, hash: fmt.Sprintf("BL%d", level), timestamp: timestamp(level)}, true
+}
+
+// hash returns the hash of a new block at the given level, it differs on each branch.
+func (s *Server) hash(level uint64) string {
+	if s.reorgs == 0 {
+		return fmt.Sprintf("BL%d", level)
+	}
+	return fmt.Sprintf("BL%dr%d", level, s.reorgs)
+}
+
+func timestamp(level uint64) string {
+	return genesisTime.Add(time.Duration(level) * blockTime).Format(time.RFC3339)
+}
+
+// withFailures answers with the scripted failures before handling the requests.
+func (s *Server) withFailures(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		fail := s.failures > 0
+		if fail {
+			s.failures--
+		}
+		status := s.failureStatus
+		s.mu.Unlock()
+
+		if fail {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *Server) handleHead(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	b, _ := s.block(s.head)
+	s.mu.Unlock()
+	writeJSON(w, headJSON(b))
+}
+
+func (s *Server) handleBlock(w http.ResponseWriter, r *http.Request) {
+	level, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/v1/blocks/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid level", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	b, ok := s.block(level)
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, map[string]any{"level": b.level, "hash": b.hash, "timestamp": b.timestamp})
+}
+
+// handleBlocks serves the levels and hashes of a level range sorted by level, with the limit.
+func (s *Server) handleBlocks(w http.ResponseWriter, r *http.Request) {
+	params, ok := uintParams(w, r, map[string]uint64{"level.ge": 0, "level.le": ^uint64(0), "limit": 100})
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	blocks := []map[string]any{}
+	for level := params["level.ge"]; level <= min(params["level.le"], s.head) && uint64(len(blocks)) < params["limit"]; level++ {
+		b, _ := s.block(level)
+		blocks = append(blocks, map[string]any{"level": b.level, "hash": b.hash})
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, blocks)
+}
+
+// uintParams reads the given query parameters, keeping the defaults of the missing ones.
+// It answers with a bad request and returns false when one is invalid.
+func uintParams(w http.ResponseWriter, r *http.Request, params map[string]uint64) (map[string]uint64, bool) {
+	query := r.URL.Query()
+	for name := range params {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return nil, false
+			}
+			params[name] = n
+		}
+	}
+	return params, true
+}
+
+// handleDelegations serves the delegations of a level, or of a level range sorted by id with the id cursor and limit.
+func (s *Server) handleDelegations(w http.ResponseWriter, r *http.Request) {
+	params, ok := uintParams(w, r, map[string]uint64{"level": 0, "level.ge": 0, "level.le": ^uint64(0), "id.gt": 0, "limit": 100})
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("level") != "" {
+		params["level.ge"], params["level.le"] = params["level"], params["level"]
+	}
+
+	s.mu.Lock()
+	levels := make([]uint64, 0, len(s.blocks))
+	for level := range s.blocks {
+		if level >= params["level.ge"] && level <= params["level.le"] {
+			levels = append(levels, level)
+		}
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+
+	delegations := []types.FetchedDelegation{}
+	for _, level := range levels {
+		for _, d := range s.blocks[level].delegations {
+			if d.ID > params["id.gt"] && uint64(len(delegations)) < params["limit"] {
+				delegations = append(delegations, d)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, delegations)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func headJSON(b *block) json.RawMessage {
+	data, _ := json.Marshal(map[string]any{"level": b.level, "hash": b.hash, "timestamp": b.timestamp, "synced": true})
+	return data
+}
+
+// operationsJSON returns the delegations in the format of the operations channel.
+func operationsJSON(delegations []types.FetchedDelegation) json.RawMessage {
+	operations := make([]any, len(delegations))
+	for i, d := range delegations {
+		operations[i] = struct {
+			Type string `json:"type"`
+			types.FetchedDelegation
+		}{Type: "delegation", FetchedDelegation: d}
+	}
+	data, _ := json.Marshal(operations)
+	return data
+}
+
+// SignalR JSON protocol, each message is terminated by the record separator.
+const recordSeparator = 0x1e
+
+const (
+	signalrInvocation = 1
+	signalrCompletion = 3
+	signalrPing       = 6
+	signalrClose      = 7
+)
+
+// TzKT message types and channels.
+const (
+	messageTypeState = 0
+	messageTypeData  = 1
+	messageTypeReorg = 2
+
+	channelHead       = "head"
+	channelOperations = "operations"
+)
+
+// pingInterval keeps the connections alive, the client times out after 15s without message.
+var pingInterval = time.Second
+
+// packet is the argument of the invocations pushed on the channels.
+type packet struct {
+	Type  int             `json:"type"`
+	State uint64          `json:"state"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// client is a ws connection and the channels it subscribed to.
+type client struct {
+	mu       sync.Mutex
+	conn     *websocket.Conn
+	channels map[string]bool
+}
+
+// send writes a SignalR message to the connection.
+func (c *client) send(msg any) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, append(data, recordSeparator))
+}
+
+// broadcast pushes a packet to the clients subscribed to the channel, the caller holds the server lock.
+func (s *Server) broadcast(channel string, p packet) {
+	for c := range s.clients {
+		c.mu.Lock()
+		subscribed := c.channels[channel]
+		c.mu.Unlock()
+		if subscribed {
+			c.send(invocation(channel, p))
+		}
+	}
+}
+
+func invocation(target string, p packet) map[string]any {
+	return map[string]any{"type": signalrInvocation, "target": target, "arguments": []packet{p}}
+}
+
+func (s *Server) handleNegotiate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"connectionId":     "fake",
+		"connectionToken":  "fake",
+		"negotiateVersion": 1,
+		"availableTransports": []map[string]any{
+			{"transport": "WebSockets", "transferFormats": []string{"Text"}},
+		},
+	})
+}
+
+var upgrader = websocket.Upgrader{}
+
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &client{conn: conn, channels: make(map[string]bool)}
+
+	s.mu.Lock()
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.send(map[string]any{"type": signalrPing}); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		for _, raw := range bytes.Split(data, []byte{recordSeparator}) {
+			if len(raw) == 0 {
+				continue
+			}
+			if !s.handleMessage(c, raw) {
+				return
+			}
+		}
+	}
+}
+
+// handleMessage answers a message of the client, it returns false when the connection must be closed.
+func (s *Server) handleMessage(c *client, raw []byte) bool {
+	var msg struct {
+		Protocol     string `json:"protocol"`
+		Type         int    `json:"type"`
+		InvocationID string `json:"invocationId"`
+		Target       string `json:"target"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return false
+	}
+
+	switch {
+	case msg.Protocol != "":
+		// handshake, an empty message accepts it
+		return c.send(struct{}{}) == nil
+	case msg.Type == signalrClose:
+		return false
+	case msg.Type != signalrInvocation:
+		return true
+	}
+
+	var channel string
+	switch msg.Target {
+	case "SubscribeToHead":
+		channel = channelHead
+	case "SubscribeToOperations":
+		channel = channelOperations
+	default:
+		return c.send(map[string]any{"type": signalrCompletion, "invocationId": msg.InvocationID, "error": "unknown method " + msg.Target}) == nil
+	}
+
+	// the state is sent before any data of the channel, the server lock keeps them ordered
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.mu.Lock()
+	c.channels[channel] = true
+	c.mu.Unlock()
+	if err := c.send(invocation(channel, packet{Type: messageTypeState, State: s.head})); err != nil {
+		return false
+	}
+	return c.send(map[string]any{"type": signalrCompletion, "invocationId": msg.InvocationID, "result": s.head}) == nil
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -17,3 +18,16 @@ func HandleErrors(ctx context.Context, cancel context.CancelFunc, errors chan er
 		logrus.Info("Shutdown completed")
 	}
 }
+
+// Backoff returns the delay of an exponential backoff at the given attempt: the base delay doubled at each attempt,
+// capped at maxDelay. The doubling stops once the cap is reached, so a late attempt can't overflow the delay.
+func Backoff(base, maxDelay time.Duration, attempt uint) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	delay := base
+	for ; attempt > 0 && delay < maxDelay; attempt-- {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
@@ -0,0 +1,248 @@
+package verifier
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/metrics"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/sirupsen/logrus"
+)
+
+type sourceInterface interface {
+	GetDelegationsByRange(ctx context.Context, startLevel, endLevel uint64, dataChan chan<- *types.ChanMsg) error
+}
+
+type storeInterface interface {
+	GetCheckpoint(ctx context.Context) (types.Checkpoint, error)
+	SaveDiscrepancies(ctx context.Context, discrepancies []types.Discrepancy) error
+}
+
+type configInterface interface {
+	GetInterval() int
+	GetLevels() uint64
+	GetLag() uint64
+}
+
+// Source is a source of delegations identified by a name in the discrepancies.
+type Source struct {
+	Name   string
+	Client sourceInterface
+}
+
+type verifier struct {
+	primary   Source
+	secondary Source
+	store     storeInterface
+	cfg       configInterface
+	// nextLevel is the first level not verified yet by the background job
+	nextLevel uint64
+}
+
+var log = logrus.WithField("module", "verifier")
+
+// NewVerifier creates a verifier comparing the delegations of the primary source, the one the poller ingests from,
+// with the delegations of the secondary source.
+func NewVerifier(primary, secondary Source, store storeInterface, cfg configInterface) *verifier {
+	return &verifier{
+		primary:   primary,
+		secondary: secondary,
+		store:     store,
+		cfg:       cfg,
+	}
+}
+
+// Run verifies the levels processed since the last run at each interval until the context is done.
+// Errors are logged and the levels are verified again at the next run.
+func (v *verifier) Run(ctx context.Context) {
+	log.Infof("Starting the verifier comparing %s with %s", v.primary.Name, v.secondary.Name)
+
+	ticker := time.NewTicker(time.Duration(v.cfg.GetInterval()) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := v.verifyNext(ctx); err != nil && ctx.Err() == nil {
+				log.Errorf("Verification failed: %v", err)
+			}
+		case <-ctx.Done():
+			log.Info("Verifier shutdown initiated, stopping operations")
+			return
+		}
+	}
+}
+
+// verifyNext verifies the levels processed since the last verification, the most recent ones are left
+// for later as the sources may not have indexed them yet.
+func (v *verifier) verifyNext(ctx context.Context) error {
+	checkpoint, err := v.store.GetCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	if checkpoint.Level <= v.cfg.GetLag() {
+		return nil
+	}
+
+	endLevel := checkpoint.Level - v.cfg.GetLag()
+	startLevel := v.nextLevel
+	// only the most recent levels are verified when the verifier is too far behind
+	levels := v.cfg.GetLevels()
+	if startLevel == 0 || (startLevel <= endLevel && endLevel-startLevel >= levels) {
+		startLevel = endLevel - min(levels, endLevel) + 1
+	}
+	if startLevel > endLevel {
+		return nil
+	}
+
+	if _, err := v.Verify(ctx, startLevel, endLevel); err != nil {
+		return err
+	}
+	v.nextLevel = endLevel + 1
+	return nil
+}
+
+// Verify compares the delegations of both sources between startLevel and endLevel (both included),
+// saves the discrepancies found to the store and returns them.
+func (v *verifier) Verify(ctx context.Context, startLevel, endLevel uint64) ([]types.Discrepancy, error) {
+	var discrepancies []types.Discrepancy
+	batchSize := max(v.cfg.GetLevels(), 1)
+
+	for from := startLevel; from <= endLevel; from += batchSize {
+		to := min(from+batchSize-1, endLevel)
+		found, err := v.verifyRange(ctx, from, to)
+		if err != nil {
+			return discrepancies, err
+		}
+		discrepancies = append(discrepancies, found...)
+	}
+
+	log.Infof("Verified levels %d to %d: %d discrepancies found", startLevel, endLevel, len(discrepancies))
+	return discrepancies, nil
+}
+
+// verifyRange compares and saves the discrepancies of a range small enough to be held in memory.
+func (v *verifier) verifyRange(ctx context.Context, startLevel, endLevel uint64) ([]types.Discrepancy, error) {
+	type result struct {
+		delegations map[uint64][]types.FetchedDelegation
+		err         error
+	}
+
+	secondaryResult := make(chan result, 1)
+	go func() {
+		delegations, err := fetch(ctx, v.secondary, startLevel, endLevel)
+		secondaryResult <- result{delegations, err}
+	}()
+	primary, err := fetch(ctx, v.primary, startLevel, endLevel)
+	if err != nil {
+		return nil, err
+	}
+	res := <-secondaryResult
+	if res.err != nil {
+		return nil, res.err
+	}
+	secondary := res.delegations
+
+	var discrepancies []types.Discrepancy
+	detectedAt := time.Now().UTC().Format(time.RFC3339)
+	for level := startLevel; level <= endLevel; level++ {
+		d := compare(primary[level], secondary[level])
+		if d == nil {
+			continue
+		}
+		d.Level = level
+		d.PrimarySource = v.primary.Name
+		d.SecondarySource = v.secondary.Name
+		d.DetectedAt = detectedAt
+		log.Warnf("Sources disagree on level %d: %d missing from %s, %d missing from %s, %d mismatched",
+			level, len(d.MissingFromPrimary), v.primary.Name, len(d.MissingFromSecondary), v.secondary.Name, len(d.Mismatched))
+		discrepancies = append(discrepancies, *d)
+	}
+
+	if len(discrepancies) > 0 {
+		if err := v.store.SaveDiscrepancies(ctx, discrepancies); err != nil {
+			return nil, fmt.Errorf("failed to save discrepancies: %w", err)
+		}
+		metrics.DiscrepancyCountAdd(len(discrepancies))
+	}
+	return discrepancies, nil
+}
+
+// fetch returns the delegations of a source between startLevel and endLevel by level.
+func fetch(ctx context.Context, source Source, startLevel, endLevel uint64) (map[uint64][]types.FetchedDelegation, error) {
+	// sources send at most one message per level
+	dataChan := make(chan *types.ChanMsg, endLevel-startLevel+1)
+	if err := source.Client.GetDelegationsByRange(ctx, startLevel, endLevel, dataChan); err != nil {
+		return nil, fmt.Errorf("failed to fetch levels %d to %d from %s: %w", startLevel, endLevel, source.Name, err)
+	}
+	close(dataChan)
+
+	delegations := make(map[uint64][]types.FetchedDelegation)
+	for msg := range dataChan {
+		delegations[msg.Level] = append(delegations[msg.Level], msg.Data...)
+	}
+	return delegations, nil
+}
+
+// compare returns the differences between the delegations of a level, nil if both sources agree.
+// The amount and the TzKT id are not compared as a node doesn't report them the same way.
+func compare(primary, secondary []types.FetchedDelegation) *types.Discrepancy {
+	primaryByKey := byKey(primary)
+	secondaryByKey := byKey(secondary)
+
+	d := &types.Discrepancy{}
+	for key, p := range primaryByKey {
+		s, ok := secondaryByKey[key]
+		switch {
+		case !ok:
+			d.MissingFromSecondary = append(d.MissingFromSecondary, key)
+		case !sameDelegation(p, s):
+			d.Mismatched = append(d.Mismatched, key)
+		}
+	}
+	for key := range secondaryByKey {
+		if _, ok := primaryByKey[key]; !ok {
+			d.MissingFromPrimary = append(d.MissingFromPrimary, key)
+		}
+	}
+
+	if len(d.MissingFromPrimary) == 0 && len(d.MissingFromSecondary) == 0 && len(d.Mismatched) == 0 {
+		return nil
+	}
+	sort.Strings(d.MissingFromPrimary)
+	sort.Strings(d.MissingFromSecondary)
+	sort.Strings(d.Mismatched)
+	return d
+}
+
+// byKey indexes delegations by operation key.
+func byKey(delegations []types.FetchedDelegation) map[string]types.FetchedDelegation {
+	indexed := make(map[string]types.FetchedDelegation, len(delegations))
+	for _, d := range delegations {
+		indexed[operationKey(d)] = d
+	}
+	return indexed
+}
+
+// operationKey identifies an operation the same way in every source: hash/counter, followed by /nonce for internal operations.
+func operationKey(d types.FetchedDelegation) string {
+	if d.Nonce != nil {
+		return fmt.Sprintf("%s/%d/%d", d.Hash, d.Counter, *d.Nonce)
+	}
+	return fmt.Sprintf("%s/%d", d.Hash, d.Counter)
+}
+
+// sameDelegation reports whether two sources agree on the content of a delegation.
+func sameDelegation(a, b types.FetchedDelegation) bool {
+	return a.Sender.Address == b.Sender.Address &&
+		equalAddress(a.NewDelegateAddress(), b.NewDelegateAddress()) &&
+		a.Status == b.Status
+}
+
+func equalAddress(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
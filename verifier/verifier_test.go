@@ -0,0 +1,151 @@
+package verifier
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockSource struct {
+	mock.Mock
+}
+
+func (m *mockSource) GetDelegationsByRange(ctx context.Context, startLevel, endLevel uint64, dataChan chan<- *types.ChanMsg) error {
+	args := m.Called(ctx, startLevel, endLevel, dataChan)
+	return args.Error(0)
+}
+
+type mockStore struct {
+	mock.Mock
+}
+
+func (m *mockStore) GetCheckpoint(ctx context.Context) (types.Checkpoint, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(types.Checkpoint), args.Error(1)
+}
+
+func (m *mockStore) SaveDiscrepancies(ctx context.Context, discrepancies []types.Discrepancy) error {
+	args := m.Called(ctx, discrepancies)
+	return args.Error(0)
+}
+
+type mockConfig struct{}
+
+func (m *mockConfig) GetInterval() int  { return 1 }
+func (m *mockConfig) GetLevels() uint64 { return 10 }
+func (m *mockConfig) GetLag() uint64    { return 5 }
+
+func delegation(hash string, counter uint64, sender string) types.FetchedDelegation {
+	return types.FetchedDelegation{Hash: hash, Counter: counter, Sender: types.Sender{Address: sender}, Status: "applied"}
+}
+
+// sendLevels makes the source send the given delegations by level for every requested range.
+func sendLevels(source *mockSource, delegations map[uint64][]types.FetchedDelegation) {
+	source.On("GetDelegationsByRange", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		startLevel, endLevel := args.Get(1).(uint64), args.Get(2).(uint64)
+		dataChan := args.Get(3).(chan<- *types.ChanMsg)
+		for level := startLevel; level <= endLevel; level++ {
+			dataChan <- &types.ChanMsg{Level: level, Data: delegations[level]}
+		}
+	})
+}
+
+func TestCompare(t *testing.T) {
+	nonce := uint64(1)
+	internal := delegation("oo3", 9, "KT1a")
+	internal.Nonce = &nonce
+	undelegation := delegation("oo4", 10, "tz1d")
+	delegated := undelegation
+	delegated.NewDelegate = &types.Delegate{Address: "tz1baker"}
+	differentAmount := delegation("oo1", 7, "tz1a")
+	differentAmount.Amount = 42
+
+	t.Run("Sources agree", func(t *testing.T) {
+		primary := []types.FetchedDelegation{delegation("oo1", 7, "tz1a"), internal}
+		secondary := []types.FetchedDelegation{internal, differentAmount}
+		assert.Nil(t, compare(primary, secondary))
+		assert.Nil(t, compare(nil, nil))
+	})
+
+	t.Run("Sources disagree", func(t *testing.T) {
+		primary := []types.FetchedDelegation{delegation("oo1", 7, "tz1a"), undelegation}
+		secondary := []types.FetchedDelegation{internal, delegation("oo2", 8, "tz1b"), delegated}
+
+		assert.Equal(t, &types.Discrepancy{
+			MissingFromPrimary:   []string{"oo2/8", "oo3/9/1"},
+			MissingFromSecondary: []string{"oo1/7"},
+			Mismatched:           []string{"oo4/10"},
+		}, compare(primary, secondary))
+	})
+}
+
+func TestVerify(t *testing.T) {
+	t.Run("Discrepancies are saved", func(t *testing.T) {
+		primary, secondary, store := new(mockSource), new(mockSource), new(mockStore)
+		sendLevels(primary, map[uint64][]types.FetchedDelegation{
+			3:  {delegation("oo1", 7, "tz1a")},
+			12: {delegation("oo2", 8, "tz1b")},
+		})
+		sendLevels(secondary, map[uint64][]types.FetchedDelegation{
+			3: {delegation("oo1", 7, "tz1a")},
+		})
+		store.On("SaveDiscrepancies", mock.Anything, mock.Anything).Return(nil)
+
+		v := NewVerifier(Source{"primary", primary}, Source{"secondary", secondary}, store, &mockConfig{})
+		discrepancies, err := v.Verify(context.Background(), 1, 15)
+		assert.NoError(t, err)
+		assert.Len(t, discrepancies, 1)
+		assert.Equal(t, uint64(12), discrepancies[0].Level)
+		assert.Equal(t, "primary", discrepancies[0].PrimarySource)
+		assert.Equal(t, "secondary", discrepancies[0].SecondarySource)
+		assert.Equal(t, []string{"oo2/8"}, discrepancies[0].MissingFromSecondary)
+
+		// the range is verified in batches of the configured size
+		primary.AssertCalled(t, "GetDelegationsByRange", mock.Anything, uint64(1), uint64(10), mock.Anything)
+		primary.AssertCalled(t, "GetDelegationsByRange", mock.Anything, uint64(11), uint64(15), mock.Anything)
+		store.AssertNumberOfCalls(t, "SaveDiscrepancies", 1)
+	})
+
+	t.Run("Source error", func(t *testing.T) {
+		primary, secondary, store := new(mockSource), new(mockSource), new(mockStore)
+		sendLevels(primary, nil)
+		secondary.On("GetDelegationsByRange", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("unavailable"))
+
+		v := NewVerifier(Source{"primary", primary}, Source{"secondary", secondary}, store, &mockConfig{})
+		_, err := v.Verify(context.Background(), 1, 5)
+		assert.ErrorContains(t, err, "secondary")
+		store.AssertNotCalled(t, "SaveDiscrepancies", mock.Anything, mock.Anything)
+	})
+}
+
+func TestVerifyNext(t *testing.T) {
+	primary, secondary, store := new(mockSource), new(mockSource), new(mockStore)
+	sendLevels(primary, nil)
+	sendLevels(secondary, nil)
+	v := NewVerifier(Source{"primary", primary}, Source{"secondary", secondary}, store, &mockConfig{})
+	ctx := context.Background()
+
+	// the first run verifies the last levels below the lag
+	store.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 100}, nil).Once()
+	assert.NoError(t, v.verifyNext(ctx))
+	primary.AssertCalled(t, "GetDelegationsByRange", mock.Anything, uint64(86), uint64(95), mock.Anything)
+
+	// the next runs continue from the last verified level
+	store.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 103}, nil).Once()
+	assert.NoError(t, v.verifyNext(ctx))
+	primary.AssertCalled(t, "GetDelegationsByRange", mock.Anything, uint64(96), uint64(98), mock.Anything)
+
+	// nothing is verified when no level was processed
+	store.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 103}, nil).Once()
+	assert.NoError(t, v.verifyNext(ctx))
+	primary.AssertNumberOfCalls(t, "GetDelegationsByRange", 2)
+
+	// levels are skipped when the verifier is too far behind
+	store.On("GetCheckpoint", mock.Anything).Return(types.Checkpoint{Level: 200}, nil).Once()
+	assert.NoError(t, v.verifyNext(ctx))
+	primary.AssertCalled(t, "GetDelegationsByRange", mock.Anything, uint64(186), uint64(195), mock.Anything)
+}
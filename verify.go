@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/safwentrabelsi/tezos-delegation-watcher/config"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/store"
+	"github.com/safwentrabelsi/tezos-delegation-watcher/verifier"
+	log "github.com/sirupsen/logrus"
+)
+
+// runVerify compares the poller source with the verifier source once over a level range and prints
+// the discrepancies found as JSON. It returns the exit code: 1 on failure and 2 when discrepancies are found.
+func runVerify(cfg *config.Config, s store.Storer, args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	from := flags.Uint64("from", 0, "first level to verify, defaults to the last verifier.levels levels below the checkpoint")
+	to := flags.Uint64("to", 0, "last level to verify, defaults to the checkpoint minus verifier.lag")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if cfg.Verifier.GetTzkt() == nil && cfg.Verifier.GetNode() == nil {
+		log.Error("The verify command needs a verifier.tzkt or verifier.node source")
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	endLevel := *to
+	if endLevel == 0 {
+		checkpoint, err := s.GetCheckpoint(ctx)
+		if err != nil {
+			log.Errorf("Failed to get the checkpoint: %v", err)
+			return 1
+		}
+		if checkpoint.Level <= cfg.Verifier.GetLag() {
+			log.Info("No level to verify yet")
+			return 0
+		}
+		endLevel = checkpoint.Level - cfg.Verifier.GetLag()
+	}
+	startLevel := *from
+	if startLevel == 0 {
+		startLevel = endLevel - min(cfg.Verifier.GetLevels(), endLevel) + 1
+	}
+	if startLevel > endLevel {
+		log.Errorf("Invalid level range %d to %d", startLevel, endLevel)
+		return 1
+	}
+
+	_, primary := newPollerSource(ctx, cfg)
+	_, secondary := newSource(ctx, cfg.Verifier.GetTzkt(), cfg.Verifier.GetNode())
+	discrepancies, err := verifier.NewVerifier(primary, secondary, s, cfg.Verifier).Verify(ctx, startLevel, endLevel)
+	if err != nil {
+		log.Errorf("Verification failed: %v", err)
+		return 1
+	}
+
+	for _, d := range discrepancies {
+		out, _ := json.Marshal(d)
+		fmt.Println(string(out))
+	}
+	if len(discrepancies) > 0 {
+		return 2
+	}
+	return 0
+}